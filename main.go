@@ -2,51 +2,533 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+
 	vpauth "github.com/Openmesh-Network/nft-authorise/tracker"
 )
 
+const usage = `Usage: nft-authorise <command> [flags] [arguments]
+
+Commands:
+  backfill                      Search for redeem events up to the head and save them to the store
+  verify <address> [tokenId]    Check an address is authorised, or bound to tokenId, at the latest or --at height
+  export <snapshot.json>        Write a snapshot of all redeem events up to the head
+  import <snapshot.json>        Check a snapshot and save it to the store
+  watch                         Follow the chain and print redeem changes as they happen, serving the query API and metrics with -http
+  find-deploy-block             Find the block the contract was deployed in
+
+Run nft-authorise <command> -h for the flags of a command.
+Settings are read from the -config file and NFT_AUTHORISE_* environment variables, flags override both.
+verify exits with status 1 if the address is not authorised, all commands exit with status 2 on errors.
+`
+
+// Flags shared by every command. Flags that are set override the config file and environment, see vpauth.LoadConfig.
+type command struct {
+	flags         *flag.FlagSet
+	configPath    string
+	rpc           string
+	contract      string
+	event         string
+	deployBlock   int
+	searchLimit   int
+	confirmations int
+	interval      time.Duration
+	storeDir      string
+	httpAddress   string
+	name          string
+	logLevel      slog.Level
+}
+
+func newCommand(name string) *command {
+	cmd := &command{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	cmd.flags.StringVar(&cmd.configPath, "config", os.Getenv("NFT_AUTHORISE_CONFIG"), "JSON config file, see config.example.json")
+	cmd.flags.StringVar(&cmd.rpc, "rpc", "", "comma separated Ethereum JSON-RPC URLs, later ones are used when earlier ones fail")
+	cmd.flags.StringVar(&cmd.contract, "contract", "", "Validator Pass contract address")
+	cmd.flags.StringVar(&cmd.event, "event", "", "signature of the redeem event (default "+vpauth.DefaultRedeemEvent+")")
+	cmd.flags.IntVar(&cmd.deployBlock, "deploy-block", 0, "block the contract was deployed in, see find-deploy-block")
+	cmd.flags.IntVar(&cmd.searchLimit, "search-limit", 0, "blocks per eth_getLogs request after the first, 0 for unlimited")
+	cmd.flags.IntVar(&cmd.confirmations, "confirmations", 0, "blocks to wait before a redeem is accepted")
+	cmd.flags.DurationVar(&cmd.interval, "interval", 0, "time between checks for new blocks")
+	cmd.flags.StringVar(&cmd.storeDir, "store", "", "directory the tracker state is kept in between runs, nothing is kept if empty")
+	cmd.flags.StringVar(&cmd.httpAddress, "http", "", "address to serve the query API on while watching, eg. 127.0.0.1:8645")
+	cmd.flags.StringVar(&cmd.name, "name", "", "contract to use when the config tracks several")
+	cmd.flags.TextVar(&cmd.logLevel, "log-level", slog.LevelInfo, "tracker log level written to stderr: debug, info, warn or error")
+	return cmd
+}
+
+// Parse flags given before, between or after the positional arguments, and return the positional arguments.
+func (cmd *command) parse(args []string) []string {
+	positional := []string{}
+	for {
+		cmd.flags.Parse(args)
+		if cmd.flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, cmd.flags.Arg(0))
+		args = cmd.flags.Args()[1:]
+	}
+}
+
+// Load the config file and environment, override them with the flags that were set, and validate the result.
+func (cmd *command) config() (*vpauth.Config, error) {
+	config, err := vpauth.ReadConfig(cmd.configPath)
+	if err != nil {
+		return nil, err
+	}
+	contract := func() *vpauth.ContractConfig {
+		if len(config.Contracts) == 0 {
+			config.Contracts = []vpauth.ContractConfig{{}}
+		}
+		return &config.Contracts[0]
+	}
+	cmd.flags.Visit(func(set *flag.Flag) {
+		switch set.Name {
+		case "rpc":
+			config.Endpoints = []string{}
+			for _, endpoint := range strings.Split(cmd.rpc, ",") {
+				config.Endpoints = append(config.Endpoints, strings.TrimSpace(endpoint))
+			}
+		case "contract":
+			contract().Address = cmd.contract
+		case "event":
+			contract().Event = cmd.event
+		case "deploy-block":
+			contract().DeployBlock = cmd.deployBlock
+		case "search-limit":
+			config.SearchLimit = cmd.searchLimit
+		case "confirmations":
+			config.Confirmations = cmd.confirmations
+		case "interval":
+			config.Interval = vpauth.Duration{Duration: cmd.interval}
+		case "store":
+			config.Store = cmd.storeDir
+		case "http":
+			config.HTTPAddress = cmd.httpAddress
+		}
+	})
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// A tracker for one of the configured contracts.
+type tracked struct {
+	contract vpauth.ContractConfig
+	tracker  *vpauth.Tracker
+	store    vpauth.Store // nil if no store is configured
+}
+
+// Create the trackers for every configured contract, resuming from their stores.
+func (cmd *command) openTrackers(config *vpauth.Config) ([]tracked, error) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cmd.logLevel}))
+	trackers, err := config.Trackers(vpauth.WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	opened := make([]tracked, len(trackers))
+	for i, contract := range config.Contracts {
+		opened[i] = tracked{contract: contract, tracker: trackers[i], store: trackers[i].Store()}
+		trackers[i].SetProgressFunc(opened[i].printProgress())
+	}
+	return opened, nil
+}
+
+// The tracker of the contract selected with -name, the only contract if there is one.
+func (cmd *command) selected(trackers []tracked) (tracked, error) {
+	if cmd.name == "" {
+		if len(trackers) > 1 {
+			return tracked{}, errors.New("the config tracks several contracts, choose one with -name")
+		}
+		return trackers[0], nil
+	}
+	for _, candidate := range trackers {
+		if candidate.contract.Name == cmd.name {
+			return candidate, nil
+		}
+	}
+	return tracked{}, fmt.Errorf("no contract named %q in the config", cmd.name)
+}
+
+// Print long searches' progress to stderr at every whole percent. Nothing is printed in a search's last second, so
+// the short searches made while polling stay quiet.
+func (entry tracked) printProgress() func(vpauth.SyncStatus) {
+	lastPercent := 0
+	return func(status vpauth.SyncStatus) {
+		if !status.Searching {
+			lastPercent = 0
+			return
+		}
+		if percent := int(status.BackfillPercent); percent > lastPercent && status.ETA.Duration > 0 {
+			fmt.Fprintf(os.Stderr, "%sSearched %d%% of blocks up to %d, about %s left\n", entry.label(), percent, status.ScannedHeight, status.ETA)
+			lastPercent = percent
+		}
+	}
+}
+
+// Search up to the head, the tracker saves the result to its store.
+func (entry tracked) backfill(ctx context.Context, confirmations int) error {
+	_, err := entry.tracker.Backfill(ctx, confirmations)
+	return err
+}
+
+// Open the trackers and pick the selected one, searched up to the head.
+func (cmd *command) backfilled(ctx context.Context) (tracked, error) {
+	config, err := cmd.config()
+	if err != nil {
+		return tracked{}, err
+	}
+	trackers, err := cmd.openTrackers(config)
+	if err != nil {
+		return tracked{}, err
+	}
+	entry, err := cmd.selected(trackers)
+	if err != nil {
+		return tracked{}, err
+	}
+	return entry, entry.backfill(ctx, config.Confirmations)
+}
+
+// Prefix output with the contract name when several contracts are tracked.
+func (entry tracked) label() string {
+	if entry.contract.Name == "" {
+		return ""
+	}
+	return entry.contract.Name + ": "
+}
+
 func main() {
-	// RPC constants
-	const contractAddress string = "0x8D64aB58a17dA7d8788367549c513386f09a0A70"
-	const rpcSource = "https://rpc.ankr.com/eth_sepolia"
-	const deployBlock = 5618691 // 0x55bc06 This is the block at which the validator pass contact was deployed on-chain.
+	os.Exit(run())
+}
 
-	// Concatenate "0x" with the event signature
+// Run the command and return the exit code, after the deferred cleanup has run.
+func run() int {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	trackerobj := vpauth.NewTracker(rpcSource, 3000, vpauth.NewRedeemEvent("Redeemed(uint256,bytes32)", contractAddress, deployBlock))
-	fmt.Printf("Tracking event with signature: %s\n", trackerobj.TrackedEvent.EventSignature)
-	ctx := context.Background()
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "backfill":
+		err = backfill(ctx, args)
+	case "verify":
+		err = verify(ctx, args)
+	case "export":
+		err = export(ctx, args)
+	case "import":
+		err = importSnapshot(args)
+	case "watch":
+		err = watch(ctx, args)
+	case "find-deploy-block":
+		err = findDeployBlock(ctx, args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errNotAuthorised):
+		return 1 // verify already printed the result.
+	case ctx.Err() != nil && errors.Is(err, context.Canceled):
+		fmt.Fprintln(os.Stderr, "Interrupted")
+		return 130
+	}
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	return 2
+}
 
-	trackerobj.StartTracking(ctx, 2*time.Minute, 20)
+func backfill(ctx context.Context, args []string) error {
+	cmd := newCommand("backfill")
+	cmd.parse(args)
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	trackers, err := cmd.openTrackers(config)
+	if err != nil {
+		return err
+	}
+	for _, entry := range trackers {
+		startTime := time.Now()
+		if err := entry.backfill(ctx, config.Confirmations); err != nil {
+			return err
+		}
+		height := entry.tracker.FinalizedHeight()
+		fmt.Println(entry.label()+"Tracking", len(entry.tracker.RedeemsBetween(0, height)), "redeem events up to block", height, "took time:", time.Since(startTime))
+	}
+	return nil
+}
+
+// Returned by verify for an address that is not authorised, the tool exits with status 1.
+var errNotAuthorised = errors.New("not authorised")
 
+func verify(ctx context.Context, args []string) error {
+	cmd := newCommand("verify")
+	at := cmd.flags.Int64("at", -1, "Ethereum height to verify at, the latest searched block if negative")
+	positional := cmd.parse(args)
+	if len(positional) < 1 || len(positional) > 2 {
+		return errors.New("verify takes an address and an optional tokenId")
+	}
+	entry, err := cmd.backfilled(ctx)
+	if err != nil {
+		return err
+	}
+	height := *at
+	if height < 0 {
+		height = entry.tracker.FinalizedHeight()
+	}
+	var authorised bool
+	if len(positional) == 2 {
+		tokenId, tokenErr := vpauth.CanonicalTokenId(positional[1])
+		if tokenErr != nil {
+			return tokenErr
+		}
+		authorised, err = vpauth.VerifyValidatorAddressAt(positional[0], tokenId, height, entry.tracker)
+	} else {
+		authorised, err = vpauth.VerifyAddressAt(positional[0], height, entry.tracker)
+	}
+	if err != nil {
+		return err
+	}
+	if !authorised {
+		fmt.Println(positional[0], "is not authorised at block", height)
+		return errNotAuthorised
+	}
+	fmt.Println(positional[0], "is authorised at block", height)
+	return nil
 }
 
-/*
-	// Run tracking inside a go routine so that you can run checks on it every 2 minutes.
-	go func() {
-		trackerobj.StartTracking(ctx, contractAddress, deployBlock, 2*time.Minute, 20)
-		defer trackerobj.Stop()
-	}()
+func export(ctx context.Context, args []string) error {
+	cmd := newCommand("export")
+	positional := cmd.parse(args)
+	if len(positional) != 1 {
+		return errors.New("export takes the snapshot file to write")
+	}
+	entry, err := cmd.backfilled(ctx)
+	if err != nil {
+		return err
+	}
+	if err := entry.tracker.ExportSnapshot(positional[0]); err != nil {
+		return err
+	}
+	fmt.Println("Exported snapshot at block", entry.tracker.FinalizedHeight(), "to", positional[0])
+	return nil
+}
 
-	// Ask the tracker about what's happening on ethereum using cometbft callbacks every 2 minutes
-	ticker := time.NewTicker(2 * time.Minute)
+func importSnapshot(args []string) error {
+	cmd := newCommand("import")
+	signerList := cmd.flags.String("signers", "", "comma separated hex ed25519 public keys of the nodes trusted to attest snapshots")
+	threshold := cmd.flags.Int("threshold", 0, "attestations from signers required to import, all signers if 0")
+	unauthenticated := cmd.flags.Bool("unauthenticated", false, "import without -signers, trusting whoever produced the snapshot file")
+	positional := cmd.parse(args)
+	if len(positional) != 1 {
+		return errors.New("import takes the snapshot file to read")
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	if config.Store == "" {
+		return errors.New("import needs a store to keep the snapshot in, set -store")
+	}
+	trackers, err := cmd.openTrackers(config)
+	if err != nil {
+		return err
+	}
+	entry, err := cmd.selected(trackers)
+	if err != nil {
+		return err
+	}
+	if *signerList == "" {
+		if !*unauthenticated {
+			return errors.New("import needs -signers to check the snapshot's attestations, or -unauthenticated to trust the file")
+		}
+		fmt.Fprintln(os.Stderr, entry.label()+"Importing a snapshot without checking attestations, it is only as trustworthy as its source")
+		err = entry.tracker.ImportSnapshot(positional[0])
+	} else {
+		signers := []crypto.PubKey{}
+		for _, signer := range strings.Split(*signerList, ",") {
+			pubKey, decodeErr := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(signer), "0x"))
+			if decodeErr != nil || len(pubKey) != ed25519.PubKeySize {
+				return fmt.Errorf("invalid signer public key %q", signer)
+			}
+			signers = append(signers, ed25519.PubKey(pubKey))
+		}
+		if *threshold == 0 {
+			*threshold = len(signers)
+		}
+		err = entry.tracker.ImportAttestedSnapshot(positional[0], signers, *threshold)
+	}
+	if err != nil {
+		return err
+	}
+	if err := entry.tracker.SaveSnapshot(entry.store); err != nil {
+		return err
+	}
+	fmt.Println("Imported snapshot at block", entry.tracker.FinalizedHeight(), "into", config.Store)
+	return nil
+}
+
+func watch(ctx context.Context, args []string) error {
+	cmd := newCommand("watch")
+	cmd.parse(args)
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	trackers, err := cmd.openTrackers(config)
+	if err != nil {
+		return err
+	}
+	type labelledChange struct {
+		label  string
+		change vpauth.ValidatorChange
+	}
+	failed := make(chan error, len(trackers)+1)
+	if config.HTTPAddress != "" {
+		// Served while searching, so orchestrators can tell the trackers are alive but not ready yet.
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", vpauth.MetricsHandler())
+			health := vpauth.NewHealthHandler(trackerList(trackers)...)
+			mux.Handle("GET /healthz", health)
+			mux.Handle("GET /readyz", health)
+			mux.Handle("/", queryHandler(trackers))
+			failed <- vpauth.ListenAndServe(ctx, config.HTTPAddress, mux)
+		}()
+		fmt.Println("Serving the query API, health checks and metrics on", config.HTTPAddress)
+	}
+	changes := make(chan labelledChange)
+	savedHeights := make([]int64, len(trackers))
+	for i, entry := range trackers {
+		// StartTracking searches up to the head before it starts polling, retrying failed searches until interrupted.
+		go entry.tracker.StartTracking(ctx, config.Interval.Duration, config.Confirmations)
+		select {
+		case <-entry.tracker.Synced():
+		case <-ctx.Done():
+			return nil
+		}
+		savedHeights[i] = entry.tracker.FinalizedHeight()
+		fmt.Printf("%sTracking event with signature %s, searched up to block %d\n", entry.label(), entry.tracker.Event().EventSignature, savedHeights[i])
+		go func(entry tracked, subscribed <-chan vpauth.ValidatorChange) {
+			for change := range subscribed {
+				select {
+				case changes <- labelledChange{entry.label(), change}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(entry, entry.tracker.Subscribe(ctx, savedHeights[i]))
+	}
+
+	if len(config.Webhooks) > 0 {
+		for _, entry := range trackers {
+			store := entry.store
+			if store == nil {
+				store = vpauth.NewMemoryStore() // Deliveries are retried until the tool exits.
+			}
+			notifier := vpauth.NewNotifier(entry.tracker, store, config.Webhooks)
+			go func() {
+				failed <- notifier.Run(ctx)
+			}()
+		}
+		fmt.Println("Sending changes to", len(config.Webhooks), "webhooks")
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-failed:
+			return err
+		case labelled := <-changes:
+			fmt.Println(labelled.label + describeChange(labelled.change))
 		case <-ticker.C:
-			askAboutRedeems(trackerobj)
+			for i, entry := range trackers {
+				height := entry.tracker.FinalizedHeight()
+				if height != savedHeights[i] && entry.store != nil {
+					if err := entry.tracker.SaveSnapshot(entry.store); err != nil {
+						fmt.Fprintln(os.Stderr, entry.label()+"Could not save the tracker state:", err)
+					}
+				}
+				savedHeights[i] = height
+			}
 		}
 	}
 }
-// Testing function
-func askAboutRedeems(tracker *vpauth.Tracker) {
-	// Ask the tracker about what's happening on ethereum using cometbft callbacks every 2 minutes
-	fmt.Println("Found first redeem: ", vpauth.Verify_join_callback("0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", tracker))
-	fmt.Println("Found second redeem: ", vpauth.Verify_join_callback("0x2757295701725127590000000000000000000000000000000000000000000000", tracker))
-	fmt.Println("Found third redeem: ", vpauth.Verify_join_callback("0x2175091590317500000000000000000000000000000000000000000000000000", tracker))
 
-	// vpauth.Verify_ValidatorRedeemEvent_callback()
-	fmt.Println("Length of validator list (including re-redeems):", len(tracker.ValidatorList))
-*/
+func trackerList(trackers []tracked) []*vpauth.Tracker {
+	list := make([]*vpauth.Tracker, len(trackers))
+	for i, entry := range trackers {
+		list[i] = entry.tracker
+	}
+	return list
+}
+
+func describeChange(change vpauth.ValidatorChange) string {
+	switch {
+	case change.Kind == vpauth.ChangeAdded:
+		return fmt.Sprintf("Token %s redeemed for %s at block %d", change.TokenId, change.Address, change.Height)
+	case change.Kind == vpauth.ChangeReRedeemed && change.Redeem != nil:
+		return fmt.Sprintf("Token %s re-redeemed from %s to %s at block %d", change.TokenId, change.PreviousAddress, change.Address, change.Height)
+	case change.Kind == vpauth.ChangeReRedeemed:
+		return fmt.Sprintf("Chain reorganised, token %s returned from %s to %s at block %d", change.TokenId, change.PreviousAddress, change.Address, change.Height)
+	default:
+		return fmt.Sprintf("Chain reorganised, token %s is no longer redeemed for %s after block %d", change.TokenId, change.Address, change.Height)
+	}
+}
+
+// The query API for the trackers: at the root for a single contract, under /<name>/ for each of several.
+func queryHandler(trackers []tracked) http.Handler {
+	if len(trackers) == 1 {
+		return vpauth.NewQueryHandler(trackers[0].tracker)
+	}
+	mux := http.NewServeMux()
+	for _, entry := range trackers {
+		prefix := "/" + entry.contract.Name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, vpauth.NewQueryHandler(entry.tracker)))
+	}
+	return mux
+}
+
+func findDeployBlock(ctx context.Context, args []string) error {
+	cmd := newCommand("find-deploy-block")
+	cmd.parse(args)
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	trackers, err := cmd.openTrackers(config)
+	if err != nil {
+		return err
+	}
+	entry, err := cmd.selected(trackers)
+	if err != nil {
+		return err
+	}
+	deployBlock, err := vpauth.FindDeployBlock(ctx, config.Source(), entry.contract.Address)
+	if err != nil {
+		return err
+	}
+	fmt.Println(deployBlock)
+	return nil
+}
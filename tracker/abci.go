@@ -0,0 +1,321 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+)
+
+// ABCI MIDDLEWARE
+
+// ABCI response codes for join transactions rejected by the middleware.
+const (
+	CodeUnauthorisedJoin uint32 = 2 // The validator does not hold an active validator pass
+	CodeInvalidJoin      uint32 = 3 // The join transaction could not be decoded or requests too much voting power
+	CodeNoAgreedHeight   uint32 = 4 // No Ethereum height has been agreed by consensus yet, see EnableHeightAgreement
+	CodeReservedTx       uint32 = 5 // The transaction uses the agreed height prefix, which only proposers may add
+)
+
+// Voting power given to a joining validator when the join transaction does not specify one.
+// It is also the most a join may request unless the wrapper is configured otherwise, see WithMaxJoinPower.
+const DefaultJoinPower int64 = 10
+
+// A request from a validator to join the validator set.
+type ValidatorJoin struct {
+	PubKey crypto.PubKey
+	Power  int64
+}
+
+// Decodes a transaction into a validator join request.
+// isJoin is false for transactions that should be passed through to the wrapped application.
+type JoinTxDecoder func(tx []byte) (join ValidatorJoin, isJoin bool, err error)
+
+var joinTxPrefix = []byte("join:")
+
+// Default join transaction format: "join:<base64 ed25519 public key>" with an optional "!<power>" suffix,
+// eg. "join:2f2Xx0...Lw=!10". Transactions without the "join:" prefix are passed through.
+func DecodeJoinTx(tx []byte) (ValidatorJoin, bool, error) {
+	if !bytes.HasPrefix(tx, joinTxPrefix) {
+		return ValidatorJoin{}, false, nil
+	}
+	encodedKey, encodedPower, hasPower := bytes.Cut(bytes.TrimPrefix(tx, joinTxPrefix), []byte("!"))
+	keyBytes, err := base64.StdEncoding.DecodeString(string(encodedKey))
+	if err != nil {
+		return ValidatorJoin{}, true, fmt.Errorf("invalid join public key: %w", err)
+	}
+	if len(keyBytes) != ed25519.PubKeySize {
+		return ValidatorJoin{}, true, fmt.Errorf("join public key is %d bytes, expected %d", len(keyBytes), ed25519.PubKeySize)
+	}
+	join := ValidatorJoin{PubKey: ed25519.PubKey(keyBytes), Power: DefaultJoinPower}
+	if hasPower {
+		join.Power, err = strconv.ParseInt(string(encodedPower), 10, 64)
+		if err != nil || join.Power <= 0 {
+			return ValidatorJoin{}, true, fmt.Errorf("invalid join power %q", encodedPower)
+		}
+	}
+	return join, true, nil
+}
+
+// Encode a join transaction in the format read by DecodeJoinTx.
+func EncodeJoinTx(pubKey crypto.PubKey, power int64) []byte {
+	return []byte(fmt.Sprintf("%s%s!%d", joinTxPrefix, base64.StdEncoding.EncodeToString(pubKey.Bytes()), power))
+}
+
+// ABCI application wrapper that gates validator joins on the tracker.
+// Join transactions are checked and executed by the wrapper, everything else is passed through to the wrapped application.
+// Validators admitted through the wrapper are removed with a power 0 update once their pass is re-redeemed to another address.
+// Blocks only execute joins at the Ethereum height agreed through vote extensions, so every node reaches the same
+// decision; until a height is agreed joins are rejected. The wrapper's state is part of the app hash, see WithStateStore.
+type AuthorisedApplication struct {
+	abcitypes.Application
+	trackerIns *Tracker
+	decodeJoin JoinTxDecoder
+	mu         sync.Mutex
+	admitted   map[string]ValidatorJoin // Validators admitted by the wrapper, keyed by CometBFT address
+	// Verify joins at the Ethereum height agreed through vote extensions, see EnableHeightAgreement
+	heightAgreement bool
+	agreedHeight    int64 // Ethereum height joins in blocks are verified at, 0 until one is agreed
+	chainID         string
+	validatorKeys   map[string]crypto.PubKey // Keys of every validator seen, keyed by address, to verify vote extensions
+	stateStore      Store                    // Where the state of every block is kept, see WithStateStore
+	restored        bool                     // The state of the last committed block has been restored by Info
+	maxJoinPower    int64                    // Highest voting power a join may request, see WithMaxJoinPower
+}
+
+var _ abcitypes.Application = (*AuthorisedApplication)(nil)
+
+// Wrap an existing ABCI application so that joins are only accepted from validators with an active validator pass.
+// Passing a nil decoder uses DecodeJoinTx.
+func NewAuthorisedApplication(app abcitypes.Application, trackerIns *Tracker, decodeJoin JoinTxDecoder) *AuthorisedApplication {
+	if decodeJoin == nil {
+		decodeJoin = DecodeJoinTx
+	}
+	return &AuthorisedApplication{
+		Application:   app,
+		trackerIns:    trackerIns,
+		decodeJoin:    decodeJoin,
+		admitted:      map[string]ValidatorJoin{},
+		validatorKeys: map[string]crypto.PubKey{},
+		stateStore:    NewMemoryStore(),
+		maxJoinPower:  DefaultJoinPower,
+	}
+}
+
+// Set the highest voting power a join transaction may request, DefaultJoinPower by default.
+// Joins requesting more are rejected in CheckTx and FinalizeBlock, so a pass holder can't take over the validator set.
+// Keep it well below CometBFT's MaxTotalVotingPower divided by the number of passes.
+func (app *AuthorisedApplication) WithMaxJoinPower(power int64) *AuthorisedApplication {
+	app.maxJoinPower = power
+	return app
+}
+
+// Rejects a join requesting more voting power than the wrapper allows.
+func (app *AuthorisedApplication) validateJoin(join ValidatorJoin, decodeErr error) error {
+	if decodeErr != nil {
+		return decodeErr
+	}
+	if join.Power > app.maxJoinPower {
+		return fmt.Errorf("join power %d exceeds the maximum of %d", join.Power, app.maxJoinPower)
+	}
+	return nil
+}
+
+// Reject join transactions from unauthorised validators before they enter the mempool.
+// Agreed height transactions are rejected too: ProcessProposal rejects a block carrying one anywhere but first.
+func (app *AuthorisedApplication) CheckTx(ctx context.Context, req *abcitypes.RequestCheckTx) (*abcitypes.ResponseCheckTx, error) {
+	if app.heightAgreement && bytes.HasPrefix(req.Tx, agreedHeightTxPrefix) {
+		return &abcitypes.ResponseCheckTx{Code: CodeReservedTx, Log: "agreed height transactions are only added by the proposer"}, nil
+	}
+	join, isJoin, err := app.decodeJoin(req.Tx)
+	if !isJoin {
+		return app.Application.CheckTx(ctx, req)
+	}
+	code, log := app.checkJoin(join, err)
+	return &abcitypes.ResponseCheckTx{Code: code, Log: log}, nil
+}
+
+// Returns the ABCI code and log for a join transaction entering the mempool, checked against the agreed height once
+// there is one and the tracker's latest view before that. FinalizeBlock decides whether the join is executed.
+func (app *AuthorisedApplication) checkJoin(join ValidatorJoin, decodeErr error) (uint32, string) {
+	if err := app.validateJoin(join, decodeErr); err != nil {
+		return CodeInvalidJoin, err.Error()
+	}
+	authorised := VerifyPubKey(join.PubKey, app.trackerIns)
+	if height := app.trackerIns.AgreedHeight(); app.heightAgreement && height > 0 {
+		verified, err := VerifyPubKeyAt(join.PubKey, height, app.trackerIns)
+		authorised = err == nil && verified
+	}
+	if !authorised {
+		return CodeUnauthorisedJoin, fmt.Sprintf("validator %s does not hold an active validator pass", join.PubKey.Address())
+	}
+	return abcitypes.CodeTypeOK, ""
+}
+
+// Execute join transactions, pass all other transactions to the wrapped application and inject the resulting validator updates.
+func (app *AuthorisedApplication) FinalizeBlock(ctx context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.restored = true // Blocks are executed on top of the in-memory state from now on.
+
+	txResults := make([]*abcitypes.ExecTxResult, len(req.Txs))
+	txs, agreedHeightResult := app.applyAgreedHeight(req.Txs)
+	offset := 0
+	if agreedHeightResult != nil {
+		txResults[0] = agreedHeightResult
+		offset = 1
+	}
+	passThrough := [][]byte{}
+	passThroughIndex := []int{}
+	joins := []ValidatorJoin{}
+	for txIndex, tx := range txs {
+		i := txIndex + offset
+		join, isJoin, err := app.decodeJoin(tx)
+		if !isJoin {
+			passThrough = append(passThrough, tx)
+			passThroughIndex = append(passThroughIndex, i)
+			continue
+		}
+		code, log, err := app.executeJoin(ctx, join, err)
+		if err != nil {
+			return nil, err
+		}
+		txResults[i] = &abcitypes.ExecTxResult{Code: code, Log: log}
+		if code == abcitypes.CodeTypeOK {
+			joins = append(joins, join)
+		}
+	}
+
+	innerReq := *req
+	innerReq.Txs = passThrough
+	res, err := app.Application.FinalizeBlock(ctx, &innerReq)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.TxResults) != len(passThrough) {
+		return nil, fmt.Errorf("wrapped application returned %d tx results for %d transactions", len(res.TxResults), len(passThrough))
+	}
+	for i, txResult := range res.TxResults {
+		txResults[passThroughIndex[i]] = txResult
+	}
+	res.TxResults = txResults
+
+	updates, err := app.validatorUpdates(ctx, joins)
+	if err != nil {
+		return nil, err
+	}
+	res.ValidatorUpdates = mergeValidatorUpdates(res.ValidatorUpdates, updates)
+	if err := app.recordValidatorKeys(res.ValidatorUpdates); err != nil {
+		return nil, err
+	}
+
+	stored, err := app.currentState(req.Height, res.AppHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.saveState(stored); err != nil {
+		return nil, err
+	}
+	if res.AppHash, err = stored.combinedAppHash(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Returns the ABCI code and log for a join transaction in a block. The caller must hold the app lock.
+func (app *AuthorisedApplication) executeJoin(ctx context.Context, join ValidatorJoin, decodeErr error) (uint32, string, error) {
+	if err := app.validateJoin(join, decodeErr); err != nil {
+		return CodeInvalidJoin, err.Error(), nil
+	}
+	if app.agreedHeight == 0 {
+		return CodeNoAgreedHeight, "no Ethereum height has been agreed by consensus yet", nil
+	}
+	authorised, err := app.authorise(ctx, join.PubKey)
+	if err != nil {
+		return 0, "", err
+	}
+	if !authorised {
+		return CodeUnauthorisedJoin, fmt.Sprintf("validator %s does not hold an active validator pass", join.PubKey.Address()), nil
+	}
+	return abcitypes.CodeTypeOK, "", nil
+}
+
+// Verify against the agreed Ethereum height, so every node reaches the same decision. Waits for this node's tracker
+// to reach it, eg. when replaying blocks after a restart while the tracker backfills or during block sync, rather than
+// deciding differently from the other nodes. Only fails if the context is cancelled. The caller must hold the app lock.
+func (app *AuthorisedApplication) authorise(ctx context.Context, pubKey crypto.PubKey) (bool, error) {
+	if app.trackerIns.FinalizedHeight() < app.agreedHeight {
+		app.trackerIns.logger.Info("Waiting for the tracker to reach the agreed Ethereum height", "agreedHeight", app.agreedHeight, "finalizedHeight", app.trackerIns.FinalizedHeight())
+		if err := app.trackerIns.WaitForHeight(ctx, app.agreedHeight); err != nil {
+			return false, fmt.Errorf("tracker did not reach agreed Ethereum height %d: %w", app.agreedHeight, err)
+		}
+	}
+	authorised, err := VerifyPubKeyAt(pubKey, app.agreedHeight, app.trackerIns)
+	if err != nil {
+		return false, fmt.Errorf("could not verify validator %s at agreed Ethereum height %d: %w", pubKey.Address(), app.agreedHeight, err)
+	}
+	return authorised, nil
+}
+
+// Merge the wrapper's validator updates into the wrapped application's. CometBFT rejects two updates for the same key,
+// and the wrapper's decision about a validator it admitted or removed takes precedence.
+func mergeValidatorUpdates(inner []abcitypes.ValidatorUpdate, own []abcitypes.ValidatorUpdate) []abcitypes.ValidatorUpdate {
+	ownKeys := map[string]bool{}
+	for _, update := range own {
+		ownKeys[update.PubKey.String()] = true
+	}
+	merged := make([]abcitypes.ValidatorUpdate, 0, len(inner)+len(own))
+	for _, update := range inner {
+		if !ownKeys[update.PubKey.String()] {
+			merged = append(merged, update)
+		}
+	}
+	return append(merged, own...)
+}
+
+// Admit the joining validators and remove previously admitted validators that are no longer authorised.
+// Updates are ordered by address so every node produces the same list. The caller must hold the app lock.
+func (app *AuthorisedApplication) validatorUpdates(ctx context.Context, joins []ValidatorJoin) ([]abcitypes.ValidatorUpdate, error) {
+	changed := map[string]ValidatorJoin{}
+	for _, join := range joins {
+		key := addressKey(join.PubKey.Address())
+		app.admitted[key] = join
+		changed[key] = join
+	}
+	for key, member := range app.admitted {
+		if app.agreedHeight == 0 {
+			break // Nothing to verify against, keep the admitted validators.
+		}
+		authorised, err := app.authorise(ctx, member.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		if !authorised {
+			delete(app.admitted, key)
+			changed[key] = ValidatorJoin{PubKey: member.PubKey, Power: 0}
+		}
+	}
+
+	keys := make([]string, 0, len(changed))
+	for key := range changed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	updates := make([]abcitypes.ValidatorUpdate, 0, len(keys))
+	for _, key := range keys {
+		protoKey, err := cryptoenc.PubKeyToProto(changed[key].PubKey)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, abcitypes.ValidatorUpdate{PubKey: protoKey, Power: changed[key].Power})
+	}
+	return updates, nil
+}
@@ -0,0 +1,288 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	pc "github.com/cometbft/cometbft/proto/tendermint/crypto"
+)
+
+// ABCI MIDDLEWARE STATE
+
+// The middleware's decisions depend on what it admitted, on the agreed Ethereum height and on the validator keys vote
+// extensions are verified with, so all of them are part of the application state: they are stored for every block,
+// committed to in the app hash, restored by Info after a restart and carried in state sync snapshots.
+
+// Keys the middleware state of each block is stored under, followed by the zero padded block height.
+const abciStatePrefix = "abci-state/"
+
+// The middleware's part of the application state after a block.
+type middlewareState struct {
+	AgreedHeight  int64               `json:"agreedHeight"`
+	Admitted      []admittedValidator `json:"admitted"` // Ordered by address
+	ChainId       string              `json:"chainId"`
+	ValidatorKeys [][]byte            `json:"validatorKeys"` // Protobuf encoded keys of every validator seen, ordered by address
+}
+
+// A validator admitted by the middleware.
+type admittedValidator struct {
+	PubKey []byte `json:"pubKey"` // Protobuf encoded CometBFT public key
+	Power  int64  `json:"power"`
+}
+
+// The middleware state of a block as stored, with the wrapped application's app hash it is combined with.
+type storedState struct {
+	Height  int64           `json:"height"`
+	AppHash []byte          `json:"appHash"` // Of the wrapped application
+	State   middlewareState `json:"state"`
+}
+
+// The app hash reported to CometBFT: the wrapped application's app hash and the middleware state, hashed together.
+func (stored storedState) combinedAppHash() ([]byte, error) {
+	encoded, err := json.Marshal(stored.State)
+	if err != nil {
+		return nil, err
+	}
+	stateHash := sha256.Sum256(encoded)
+	combined := sha256.Sum256(append(append([]byte{}, stored.AppHash...), stateHash[:]...))
+	return combined[:], nil
+}
+
+// Metadata of a snapshot offered through state sync: the wrapped application's metadata and the middleware state at
+// the snapshot height.
+type snapshotMetadata struct {
+	State    storedState `json:"state"`
+	Metadata []byte      `json:"metadata"`
+}
+
+// Keep the middleware state in a store, so it survives restarts. A memory store if never set, in which case a node
+// can't restart without resyncing.
+func (app *AuthorisedApplication) WithStateStore(store Store) *AuthorisedApplication {
+	app.stateStore = store
+	return app
+}
+
+func abciStateKey(height int64) string {
+	return fmt.Sprintf("%s%020d", abciStatePrefix, height)
+}
+
+// The middleware state after the block being finalized. The caller must hold the app lock.
+func (app *AuthorisedApplication) currentState(height int64, appHash []byte) (storedState, error) {
+	stored := storedState{Height: height, AppHash: appHash, State: middlewareState{
+		AgreedHeight:  app.agreedHeight,
+		Admitted:      []admittedValidator{},
+		ChainId:       app.chainID,
+		ValidatorKeys: [][]byte{},
+	}}
+	for _, key := range sortedKeys(app.admitted) {
+		encodedKey, err := encodePubKey(app.admitted[key].PubKey)
+		if err != nil {
+			return storedState{}, err
+		}
+		stored.State.Admitted = append(stored.State.Admitted, admittedValidator{PubKey: encodedKey, Power: app.admitted[key].Power})
+	}
+	for _, key := range sortedKeys(app.validatorKeys) {
+		encodedKey, err := encodePubKey(app.validatorKeys[key])
+		if err != nil {
+			return storedState{}, err
+		}
+		stored.State.ValidatorKeys = append(stored.State.ValidatorKeys, encodedKey)
+	}
+	return stored, nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodePubKey(pubKey crypto.PubKey) ([]byte, error) {
+	protoKey, err := cryptoenc.PubKeyToProto(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return protoKey.Marshal()
+}
+
+func decodePubKey(encoded []byte) (crypto.PubKey, error) {
+	protoKey := pc.PublicKey{}
+	if err := protoKey.Unmarshal(encoded); err != nil {
+		return nil, err
+	}
+	return cryptoenc.PubKeyFromProto(protoKey)
+}
+
+// Replace the in-memory state with a stored one. The caller must hold the app lock.
+func (app *AuthorisedApplication) restoreState(stored storedState) error {
+	admitted := map[string]ValidatorJoin{}
+	for _, validator := range stored.State.Admitted {
+		pubKey, err := decodePubKey(validator.PubKey)
+		if err != nil {
+			return err
+		}
+		admitted[addressKey(pubKey.Address())] = ValidatorJoin{PubKey: pubKey, Power: validator.Power}
+	}
+	validatorKeys := map[string]crypto.PubKey{}
+	for _, encodedKey := range stored.State.ValidatorKeys {
+		pubKey, err := decodePubKey(encodedKey)
+		if err != nil {
+			return err
+		}
+		validatorKeys[addressKey(pubKey.Address())] = pubKey
+	}
+	app.admitted, app.validatorKeys = admitted, validatorKeys
+	app.chainID = stored.State.ChainId
+	app.agreedHeight = stored.State.AgreedHeight
+	if app.agreedHeight > 0 {
+		app.trackerIns.SetAgreedHeight(app.agreedHeight)
+	}
+	return nil
+}
+
+func (app *AuthorisedApplication) saveState(stored storedState) error {
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return app.stateStore.Put(abciStateKey(stored.Height), encoded)
+}
+
+func (app *AuthorisedApplication) loadState(height int64) (storedState, error) {
+	encoded, err := app.stateStore.Get(abciStateKey(height))
+	if err != nil {
+		return storedState{}, err
+	}
+	stored := storedState{}
+	if err := json.Unmarshal(encoded, &stored); err != nil {
+		return storedState{}, fmt.Errorf("invalid middleware state for block %d: %w", height, err)
+	}
+	return stored, nil
+}
+
+// Restore the middleware state of the last committed block on the first call, and report the combined app hash so
+// CometBFT's handshake finds the app hash it committed.
+func (app *AuthorisedApplication) Info(ctx context.Context, req *abcitypes.RequestInfo) (*abcitypes.ResponseInfo, error) {
+	res, err := app.Application.Info(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if res.LastBlockHeight == 0 {
+		app.restored = true // Nothing committed yet, the state is empty.
+		return res, nil
+	}
+	stored, err := app.loadState(res.LastBlockHeight)
+	if err != nil {
+		return nil, fmt.Errorf("could not load middleware state for block %d: %w", res.LastBlockHeight, err)
+	}
+	if !bytes.Equal(stored.AppHash, res.LastBlockAppHash) {
+		return nil, fmt.Errorf("middleware state for block %d was stored with another app hash than the wrapped application's", res.LastBlockHeight)
+	}
+	if !app.restored {
+		if err := app.restoreState(stored); err != nil {
+			return nil, err
+		}
+		app.restored = true
+	}
+	infoRes := *res
+	if infoRes.LastBlockAppHash, err = stored.combinedAppHash(); err != nil {
+		return nil, err
+	}
+	return &infoRes, nil
+}
+
+// Delete the middleware state of blocks below the retain height once the wrapped application has committed.
+func (app *AuthorisedApplication) Commit(ctx context.Context, req *abcitypes.RequestCommit) (*abcitypes.ResponseCommit, error) {
+	res, err := app.Application.Commit(ctx, req)
+	if err != nil || res.RetainHeight <= 0 {
+		return res, err
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	keys, err := app.stateStore.Keys(abciStatePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		height, err := strconv.ParseInt(strings.TrimPrefix(key, abciStatePrefix), 10, 64)
+		if err != nil || height >= res.RetainHeight {
+			continue
+		}
+		if err := app.stateStore.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Attach the middleware state at each snapshot's height to its metadata. Snapshots at heights whose state was pruned
+// are left out.
+func (app *AuthorisedApplication) ListSnapshots(ctx context.Context, req *abcitypes.RequestListSnapshots) (*abcitypes.ResponseListSnapshots, error) {
+	res, err := app.Application.ListSnapshots(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	snapshots := []*abcitypes.Snapshot{}
+	for _, snapshot := range res.Snapshots {
+		stored, err := app.loadState(int64(snapshot.Height))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		wrapped := *snapshot
+		if wrapped.Metadata, err = json.Marshal(snapshotMetadata{State: stored, Metadata: snapshot.Metadata}); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, &wrapped)
+	}
+	return &abcitypes.ResponseListSnapshots{Snapshots: snapshots}, nil
+}
+
+// Take the middleware state from a snapshot's metadata, once it matches the trusted app hash, and offer the wrapped
+// application its own metadata and app hash.
+func (app *AuthorisedApplication) OfferSnapshot(ctx context.Context, req *abcitypes.RequestOfferSnapshot) (*abcitypes.ResponseOfferSnapshot, error) {
+	if req.Snapshot == nil {
+		return app.Application.OfferSnapshot(ctx, req)
+	}
+	metadata := snapshotMetadata{}
+	if err := json.Unmarshal(req.Snapshot.Metadata, &metadata); err != nil || metadata.State.Height != int64(req.Snapshot.Height) {
+		return &abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}, nil
+	}
+	if appHash, err := metadata.State.combinedAppHash(); err != nil || !bytes.Equal(appHash, req.AppHash) {
+		return &abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}, nil
+	}
+	innerReq := *req
+	snapshot := *req.Snapshot
+	snapshot.Metadata = metadata.Metadata
+	innerReq.Snapshot, innerReq.AppHash = &snapshot, metadata.State.AppHash
+	res, err := app.Application.OfferSnapshot(ctx, &innerReq)
+	if err != nil || res.Result != abcitypes.ResponseOfferSnapshot_ACCEPT {
+		return res, err
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if err := app.saveState(metadata.State); err != nil {
+		return nil, err
+	}
+	app.restored = false // Info restores the snapshot's state once it is applied.
+	return res, nil
+}
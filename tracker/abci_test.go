@@ -0,0 +1,211 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+)
+
+// Wrapped application that accepts every transaction.
+type passThroughApp struct {
+	abcitypes.BaseApplication
+	finalized [][]byte
+	updates   []abcitypes.ValidatorUpdate // Returned by every FinalizeBlock
+	height    int64                       // Last finalized block
+}
+
+func (app *passThroughApp) FinalizeBlock(_ context.Context, req *abcitypes.RequestFinalizeBlock) (*abcitypes.ResponseFinalizeBlock, error) {
+	app.finalized = append(app.finalized, req.Txs...)
+	app.height = req.Height
+	results := make([]*abcitypes.ExecTxResult, len(req.Txs))
+	for i := range results {
+		results[i] = &abcitypes.ExecTxResult{Code: abcitypes.CodeTypeOK, Data: req.Txs[i]}
+	}
+	return &abcitypes.ResponseFinalizeBlock{TxResults: results, ValidatorUpdates: app.updates, AppHash: passThroughAppHash(req.Height)}, nil
+}
+
+func (app *passThroughApp) Info(context.Context, *abcitypes.RequestInfo) (*abcitypes.ResponseInfo, error) {
+	return &abcitypes.ResponseInfo{LastBlockHeight: app.height, LastBlockAppHash: passThroughAppHash(app.height)}, nil
+}
+
+func (app *passThroughApp) ListSnapshots(context.Context, *abcitypes.RequestListSnapshots) (*abcitypes.ResponseListSnapshots, error) {
+	return &abcitypes.ResponseListSnapshots{Snapshots: []*abcitypes.Snapshot{{Height: uint64(app.height), Format: 1, Metadata: []byte("inner")}}}, nil
+}
+
+func (app *passThroughApp) OfferSnapshot(_ context.Context, req *abcitypes.RequestOfferSnapshot) (*abcitypes.ResponseOfferSnapshot, error) {
+	if string(req.Snapshot.Metadata) != "inner" || !bytes.Equal(req.AppHash, passThroughAppHash(int64(req.Snapshot.Height))) {
+		return &abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_REJECT}, nil
+	}
+	app.height = int64(req.Snapshot.Height) // As if the chunks were applied.
+	return &abcitypes.ResponseOfferSnapshot{Result: abcitypes.ResponseOfferSnapshot_ACCEPT}, nil
+}
+
+func passThroughAppHash(height int64) []byte {
+	return []byte(fmt.Sprintf("app hash %d", height))
+}
+
+func redeemPubKey(trackerIns *Tracker, tokenId string, pubKey crypto.PubKey, blockNumber string) {
+	vRedeem := NewValidatorRedeemEvent(tokenId, "0x"+hex.EncodeToString(pubKey.Bytes()), blockNumber)
+	vRedeem.decodePayload(EncodingEd25519PubKey)
+	trackerIns.mu.Lock()
+	defer trackerIns.mu.Unlock()
+	trackerIns.ingestRedeem(*vRedeem)
+}
+
+func TestAuthorisedApplication(t *testing.T) {
+	const tokenId = "0x0000000000000000000000000000000000000000000000000000000000000001"
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, deployBlock).WithPayloadEncoding(EncodingEd25519PubKey))
+	member := ed25519.GenPrivKey().PubKey()
+	outsider := ed25519.GenPrivKey().PubKey()
+	redeemPubKey(trackerobj, tokenId, member, "0x10")
+	trackerobj.setFinalizedHeight(0x20, "")
+
+	inner := &passThroughApp{}
+	store := NewMemoryStore()
+	app := NewAuthorisedApplication(inner, trackerobj, nil).WithStateStore(store)
+	ctx := context.Background()
+
+	res, _ := app.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: EncodeJoinTx(outsider, 10)})
+	if res.Code != CodeUnauthorisedJoin {
+		t.Errorf("CheckTx accepted an unauthorised join with code %d", res.Code)
+	}
+	res, _ = app.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: EncodeJoinTx(member, 10)})
+	if res.Code != abcitypes.CodeTypeOK {
+		t.Errorf("CheckTx rejected an authorised join: %s", res.Log)
+	}
+	// A pass holder can't pick a voting power above the maximum, which could also exceed CometBFT's total and halt the chain.
+	res, _ = app.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: EncodeJoinTx(member, 1<<60)})
+	if res.Code != CodeInvalidJoin {
+		t.Errorf("CheckTx accepted an oversized join power with code %d", res.Code)
+	}
+
+	// Without an agreed Ethereum height every node rejects joins, whatever its own tracker has seen.
+	block, err := app.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 1, Txs: [][]byte{EncodeJoinTx(member, 7)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.TxResults[0].Code != CodeNoAgreedHeight || len(block.ValidatorUpdates) != 0 {
+		t.Fatalf("join executed without an agreed height: %v, %v", block.TxResults[0], block.ValidatorUpdates)
+	}
+
+	app.agreedHeight = 0x10 // As agreed through vote extensions, see TestHeightAgreementFlow.
+	memberKey, _ := cryptoenc.PubKeyToProto(member)
+	inner.updates = []abcitypes.ValidatorUpdate{{PubKey: memberKey, Power: 3}}
+	block, err = app.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 2, Txs: [][]byte{
+		[]byte("key=value"),
+		EncodeJoinTx(outsider, 10),
+		EncodeJoinTx(member, 7),
+		[]byte("join:not-base64"),
+		EncodeJoinTx(member, DefaultJoinPower+1),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCodes := []uint32{abcitypes.CodeTypeOK, CodeUnauthorisedJoin, abcitypes.CodeTypeOK, CodeInvalidJoin, CodeInvalidJoin}
+	for i, want := range wantCodes {
+		if block.TxResults[i].Code != want {
+			t.Errorf("tx %d has code %d, want %d", i, block.TxResults[i].Code, want)
+		}
+	}
+	if len(inner.finalized) != 1 || string(inner.finalized[0]) != "key=value" {
+		t.Errorf("wrapped application received %q", inner.finalized)
+	}
+	// The wrapped application's update for the same key is replaced, not duplicated.
+	if len(block.ValidatorUpdates) != 1 || block.ValidatorUpdates[0].Power != 7 || !VerifyValidatorUpdate(block.ValidatorUpdates[0], trackerobj) {
+		t.Fatalf("unexpected validator updates %v", block.ValidatorUpdates)
+	}
+	if bytes.Equal(block.AppHash, passThroughAppHash(2)) {
+		t.Error("app hash does not commit to the admitted validators")
+	}
+
+	// A node restoring the block through state sync gets the wrapper's state with the snapshot.
+	snapshots, err := app.ListSnapshots(ctx, &abcitypes.RequestListSnapshots{})
+	if err != nil || len(snapshots.Snapshots) != 1 {
+		t.Fatalf("snapshots %v, %v", snapshots, err)
+	}
+	synced := NewAuthorisedApplication(&passThroughApp{}, trackerobj, nil)
+	offer := &abcitypes.RequestOfferSnapshot{Snapshot: snapshots.Snapshots[0], AppHash: passThroughAppHash(2)}
+	if offered, _ := synced.OfferSnapshot(ctx, offer); offered.Result != abcitypes.ResponseOfferSnapshot_REJECT {
+		t.Error("snapshot accepted with another app hash")
+	}
+	offer.AppHash = block.AppHash
+	if offered, _ := synced.OfferSnapshot(ctx, offer); offered.Result != abcitypes.ResponseOfferSnapshot_ACCEPT {
+		t.Fatalf("snapshot rejected: %v", offered.Result)
+	}
+	if info, err := synced.Info(ctx, &abcitypes.RequestInfo{}); err != nil || !bytes.Equal(info.LastBlockAppHash, block.AppHash) || len(synced.admitted) != 1 {
+		t.Errorf("state synced to app hash %x with %d admitted, %v", info.GetLastBlockAppHash(), len(synced.admitted), err)
+	}
+
+	// After a restart the wrapper restores whom it admitted, so a re-redeemed pass still removes the validator.
+	inner.updates = nil
+	restarted := NewAuthorisedApplication(inner, trackerobj, nil).WithStateStore(store)
+	info, err := restarted.Info(ctx, &abcitypes.RequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastBlockHeight != 2 || !bytes.Equal(info.LastBlockAppHash, block.AppHash) || restarted.agreedHeight != 0x10 {
+		t.Fatalf("restored block %d with app hash %x and agreed height %d", info.LastBlockHeight, info.LastBlockAppHash, restarted.agreedHeight)
+	}
+	redeemPubKey(trackerobj, tokenId, outsider, "0x11")
+	restarted.agreedHeight = 0x11
+	block, err = restarted.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.ValidatorUpdates) != 1 || block.ValidatorUpdates[0].Power != 0 || !block.ValidatorUpdates[0].PubKey.Equal(memberKey) {
+		t.Fatalf("expected a power 0 update, got %v", block.ValidatorUpdates)
+	}
+
+	// A node without the wrapper's state can't report the committed app hash.
+	if _, err := NewAuthorisedApplication(inner, trackerobj, nil).Info(ctx, &abcitypes.RequestInfo{}); err == nil {
+		t.Error("Info succeeded without the stored state")
+	}
+}
+
+func TestAuthorisedApplicationWaitsForLaggingTracker(t *testing.T) {
+	const tokenId = "0x0000000000000000000000000000000000000000000000000000000000000001"
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, deployBlock).WithPayloadEncoding(EncodingEd25519PubKey))
+	member := ed25519.GenPrivKey().PubKey()
+	redeemPubKey(trackerobj, tokenId, member, "0x10")
+	trackerobj.setFinalizedHeight(0x08, "") // Still backfilling after a restart.
+
+	// A block received through block sync, whose agreed height this node's tracker has not reached.
+	app := NewAuthorisedApplication(&passThroughApp{}, trackerobj, nil)
+	app.agreedHeight = 0x10
+	ctx := context.Background()
+	finalized := make(chan *abcitypes.ResponseFinalizeBlock)
+	go func() {
+		block, err := app.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 1, Txs: [][]byte{EncodeJoinTx(member, 7)}})
+		if err != nil {
+			t.Error(err)
+		}
+		finalized <- block
+	}()
+	select {
+	case <-finalized:
+		t.Fatal("block finalized before the tracker reached the agreed height")
+	case <-time.After(200 * time.Millisecond):
+	}
+	trackerobj.setFinalizedHeight(0x10, "")
+	block := <-finalized
+	if block == nil || block.TxResults[0].Code != abcitypes.CodeTypeOK || len(block.ValidatorUpdates) != 1 {
+		t.Fatalf("join not executed once the tracker caught up: %v", block)
+	}
+
+	// Shutting down while waiting fails the block instead of deciding without the tracker.
+	app.agreedHeight = 0x20
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := app.FinalizeBlock(cancelled, &abcitypes.RequestFinalizeBlock{Height: 2}); !errors.Is(err, context.Canceled) {
+		t.Errorf("FinalizeBlock returned %v for a cancelled wait", err)
+	}
+}
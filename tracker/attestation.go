@@ -0,0 +1,162 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+// ATTESTATIONS
+
+// Domain separator for attestation signatures, so they can't be replayed as signatures over anything else.
+const attestationDomain = "nft-authorise/attestation/v2"
+
+// A node's signed statement that its tracker had a given state hash and events hash at an Ethereum height. The events
+// hash covers every event, so a snapshot matching an attestation can't carry edited history or node IDs.
+// Signers are identified by their ed25519 node key, eg. p2p.LoadNodeKey("config/node_key.json").PrivKey.
+type Attestation struct {
+	EventSignature  string `json:"eventSignature"`
+	ContractAddress string `json:"contractAddress"`
+	Height          int64  `json:"height"`
+	BlockHash       string `json:"blockHash"`
+	StateHash       string `json:"stateHash"`
+	EventsHash      string `json:"eventsHash"`
+	PubKey          []byte `json:"pubKey"` // ed25519 public key of the signer
+	Signature       []byte `json:"signature"`
+}
+
+var ErrInvalidAttestation = errors.New("invalid attestation")
+
+// The bytes covered by the signature. Hex fields are lowercased so differently cased copies verify the same.
+func (attestation *Attestation) signBytes() []byte {
+	signBytes := []byte(attestationDomain)
+	for _, field := range []string{attestation.EventSignature, attestation.ContractAddress, attestation.BlockHash, attestation.StateHash, attestation.EventsHash} {
+		signBytes = binary.BigEndian.AppendUint32(signBytes, uint32(len(field)))
+		signBytes = append(signBytes, strings.ToLower(field)...)
+	}
+	return binary.BigEndian.AppendUint64(signBytes, uint64(attestation.Height))
+}
+
+// Sign an attestation with a node key. Only ed25519 keys are supported.
+func (attestation *Attestation) Sign(privKey crypto.PrivKey) error {
+	if privKey.Type() != ed25519.KeyType {
+		return fmt.Errorf("%w: unsupported key type %s", ErrInvalidAttestation, privKey.Type())
+	}
+	signature, err := privKey.Sign(attestation.signBytes())
+	if err != nil {
+		return err
+	}
+	attestation.PubKey = privKey.PubKey().Bytes()
+	attestation.Signature = signature
+	return nil
+}
+
+// Check the attestation's signature against the public key it carries.
+func (attestation *Attestation) Verify() error {
+	if len(attestation.PubKey) != ed25519.PubKeySize {
+		return fmt.Errorf("%w: public key is %d bytes, expected %d", ErrInvalidAttestation, len(attestation.PubKey), ed25519.PubKeySize)
+	}
+	if !ed25519.PubKey(attestation.PubKey).VerifySignature(attestation.signBytes(), attestation.Signature) {
+		return fmt.Errorf("%w: bad signature from %X", ErrInvalidAttestation, attestation.PubKey)
+	}
+	return nil
+}
+
+// Returns true if the attestation is about exactly this snapshot.
+func (attestation *Attestation) matches(snapshot *Snapshot) bool {
+	return strings.EqualFold(attestation.EventSignature, snapshot.EventSignature) &&
+		strings.EqualFold(attestation.ContractAddress, snapshot.ContractAddress) &&
+		attestation.Height == snapshot.Height &&
+		strings.EqualFold(attestation.BlockHash, snapshot.BlockHash) &&
+		strings.EqualFold(attestation.StateHash, snapshot.StateHash) &&
+		strings.EqualFold(attestation.EventsHash, snapshot.EventsHash)
+}
+
+// Sign the tracker's state and events hashes at an Ethereum height, for other nodes to compare with their own.
+func (nft_tracker *Tracker) Attest(privKey crypto.PrivKey, height int64) (*Attestation, error) {
+	nft_tracker.mu.RLock()
+	if height > nft_tracker.finalizedHeight {
+		nft_tracker.mu.RUnlock()
+		return nil, ErrHeightNotFinalized
+	}
+	stateHash, err := nft_tracker.stateHashAt(height)
+	if err != nil {
+		nft_tracker.mu.RUnlock()
+		return nil, err
+	}
+	eventsHash, err := nft_tracker.eventsHashAt(height)
+	blockHash := ""
+	if height == nft_tracker.finalizedHeight {
+		blockHash = nft_tracker.finalizedBlockHash
+	}
+	nft_tracker.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	attestation := &Attestation{
+		EventSignature:  nft_tracker.trackedEvent.EventSignature,
+		ContractAddress: nft_tracker.trackedEvent.contractAddress,
+		Height:          height,
+		BlockHash:       blockHash,
+		StateHash:       hex.EncodeToString(stateHash),
+		EventsHash:      hex.EncodeToString(eventsHash),
+	}
+	return attestation, attestation.Sign(privKey)
+}
+
+// Attest to the snapshot with a node key and add the attestation to it.
+func (snapshot *Snapshot) Sign(privKey crypto.PrivKey) error {
+	attestation := Attestation{
+		EventSignature:  snapshot.EventSignature,
+		ContractAddress: snapshot.ContractAddress,
+		Height:          snapshot.Height,
+		BlockHash:       snapshot.BlockHash,
+		StateHash:       snapshot.StateHash,
+		EventsHash:      snapshot.EventsHash,
+	}
+	if err := attestation.Sign(privKey); err != nil {
+		return err
+	}
+	snapshot.Attestations = append(snapshot.Attestations, attestation)
+	return nil
+}
+
+// Count the distinct known signers with a valid attestation to exactly this snapshot.
+// Attestations from unknown keys, for other heights or hashes, or with bad signatures are ignored.
+func (snapshot *Snapshot) CountAttestations(signers []crypto.PubKey) int {
+	attested := map[string]bool{}
+	for i := range snapshot.Attestations {
+		attestation := &snapshot.Attestations[i]
+		if !attestation.matches(snapshot) || attestation.Verify() != nil {
+			continue
+		}
+		for _, signer := range signers {
+			if bytes.Equal(signer.Bytes(), attestation.PubKey) {
+				attested[string(attestation.PubKey)] = true
+			}
+		}
+	}
+	return len(attested)
+}
+
+// Import a snapshot file only if at least threshold of the known signers attested to its state and events hashes at
+// its height. The snapshot's events are then checked against both hashes as in ImportSnapshot.
+func (nft_tracker *Tracker) ImportAttestedSnapshot(path string, signers []crypto.PubKey, threshold int) error {
+	if threshold <= 0 || threshold > len(signers) {
+		return fmt.Errorf("attestation threshold %d must be between 1 and the %d known signers", threshold, len(signers))
+	}
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if attested := snapshot.CountAttestations(signers); attested < threshold {
+		return fmt.Errorf("%w: snapshot at height %d has %d of %d required attestations", ErrInvalidAttestation, snapshot.Height, attested, threshold)
+	}
+	return nft_tracker.RestoreSnapshot(snapshot)
+}
@@ -0,0 +1,115 @@
+package validatorpass_tracker
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+func TestAttestedSnapshotThreshold(t *testing.T) {
+	source := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		source.ingestRedeem(event)
+	}
+	source.setFinalizedHeight(0x20, "0xb10c")
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []crypto.PrivKey{ed25519.GenPrivKey(), ed25519.GenPrivKey(), ed25519.GenPrivKey()}
+	signers := []crypto.PubKey{keys[0].PubKey(), keys[1].PubKey(), keys[2].PubKey()}
+	if err := snapshot.Sign(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.Sign(keys[0]); err != nil { // The same signer twice counts once.
+		t.Fatal(err)
+	}
+	if err := snapshot.Sign(ed25519.GenPrivKey()); err != nil { // Unknown signers don't count.
+		t.Fatal(err)
+	}
+	// An attestation to different hashes doesn't count, even from a known signer.
+	forged, err := source.Attest(keys[1], 0x13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Attestations = append(snapshot.Attestations, *forged)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := snapshot.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTracker(rpcSource, 4, RedeemEvent)
+	if err := restored.ImportAttestedSnapshot(path, signers, 2); err == nil {
+		t.Fatal("snapshot with one valid attestation met a threshold of 2")
+	}
+
+	if err := snapshot.Sign(keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ImportAttestedSnapshot(path, signers, 2); err != nil {
+		t.Fatal(err)
+	}
+	if restored.FinalizedHeight() != 0x20 {
+		t.Errorf("restored height %d", restored.FinalizedHeight())
+	}
+}
+
+func TestAttestationRejectsTampering(t *testing.T) {
+	attestation := Attestation{EventSignature: RedeemEvent.EventSignature, ContractAddress: contractAddress, Height: 10, StateHash: "ab"}
+	if err := attestation.Sign(ed25519.GenPrivKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := attestation.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	attestation.Height = 11
+	if err := attestation.Verify(); err == nil {
+		t.Error("attestation with a changed height verified")
+	}
+}
+
+func TestAttestationCoversHistory(t *testing.T) {
+	source := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		source.ingestRedeem(event)
+	}
+	source.setFinalizedHeight(0x20, "0xb10c")
+	key := ed25519.GenPrivKey()
+	signers := []crypto.PubKey{key.PubKey()}
+
+	// Forge token 1's superseded redeem, which leaves the state hash unchanged, and re-sign the events hash the
+	// honest signer never attested to: the snapshot must not meet the threshold.
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Events[1].Data = "0x1111111111111111111111111111111111111111000000000000000000000000"
+	forged := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, log := range snapshot.Events {
+		forged.ingestRedeem(*RedeemEvent.decodeLog(log))
+	}
+	forged.setFinalizedHeight(0x20, "0xb10c")
+	forgedSnapshot, _ := forged.Snapshot()
+	if forgedSnapshot.StateHash != snapshot.StateHash {
+		t.Fatal("forged history changed the state hash")
+	}
+	snapshot.EventsHash = forgedSnapshot.EventsHash
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := snapshot.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTracker(rpcSource, 4, RedeemEvent)
+	if err := restored.ImportAttestedSnapshot(path, signers, 1); err == nil {
+		t.Error("snapshot with forged history met the attestation threshold")
+	}
+}
@@ -0,0 +1,177 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cometbft/cometbft/crypto"
+)
+
+// VALIDATOR SET CHANGES
+
+// How a change affects the tokenId -> CometBFT address bindings.
+type ChangeKind int
+
+const (
+	ChangeAdded      ChangeKind = iota // A token was redeemed for the first time, binding it to Address
+	ChangeReRedeemed                   // A token moved from PreviousAddress to Address, by a new redeem or a rollback
+	ChangeRemoved                      // A token is no longer bound, its only redeems were rolled back by a reorg
+)
+
+var changeKindNames = []string{"added", "re-redeemed", "removed"}
+
+func (kind ChangeKind) String() string {
+	if kind < 0 || int(kind) >= len(changeKindNames) {
+		return fmt.Sprintf("ChangeKind(%d)", int(kind))
+	}
+	return changeKindNames[kind]
+}
+
+func (kind ChangeKind) MarshalText() ([]byte, error) {
+	return []byte(kind.String()), nil
+}
+
+func (kind *ChangeKind) UnmarshalText(text []byte) error {
+	for i, name := range changeKindNames {
+		if string(text) == name {
+			*kind = ChangeKind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown change kind %q", text)
+}
+
+// A change to the active tokenId -> CometBFT address bindings, committed when the tracker finalized a block or
+// rolled back a reorg. Applying changes in order to a map of bindings keeps it equal to the tracker's active set.
+type ValidatorChange struct {
+	Kind            ChangeKind     `json:"kind"`
+	TokenId         string         `json:"tokenId"`
+	Address         crypto.Address `json:"address"`                   // Bound to the token after the change, or the address that lost it for ChangeRemoved
+	PreviousAddress crypto.Address `json:"previousAddress,omitempty"` // Bound to the token before a ChangeReRedeemed
+	Height          int64          `json:"height"`                    // Ethereum height the change took effect at: the redeem block, or the rollback height
+	Redeem          *RedeemJSON    `json:"redeem,omitempty"`          // The redeem that caused the change, nil for rollbacks
+}
+
+// Changes caused by the redeems above fromHeight and up to toHeight, in chain order. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) changesBetween(fromHeight int64, toHeight int64) []ValidatorChange {
+	changes := []ValidatorChange{}
+	holders := map[string]crypto.Address{} // Latest redeem of each tokenId seen so far
+	for vpass := range nft_tracker.validatorList {
+		vRedeem := nft_tracker.validatorList[vpass]
+		if vRedeem.redeemedBlockHeight > toHeight {
+			break // Ordered list, the rest is later.
+		}
+		previous, redeemed := holders[vRedeem.tokenId]
+		holders[vRedeem.tokenId] = vRedeem.cometAddress
+		if vRedeem.redeemedBlockHeight <= fromHeight {
+			continue
+		}
+		redeem := redeemJSON(vRedeem)
+		change := ValidatorChange{Kind: ChangeAdded, TokenId: vRedeem.tokenId, Address: vRedeem.cometAddress, Height: vRedeem.redeemedBlockHeight, Redeem: &redeem}
+		if redeemed {
+			change.Kind, change.PreviousAddress = ChangeReRedeemed, previous
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Changes that undo the redeems above an Ethereum height, ordered by tokenId. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) rollbackChanges(height int64) []ValidatorChange {
+	changes := []ValidatorChange{}
+	for tokenId, tokenRedeems := range nft_tracker.tokenIdMap {
+		latestEvent, exists := latestRedeemAt(tokenRedeems, nft_tracker.finalizedHeight)
+		if !exists || latestEvent.redeemedBlockHeight <= height {
+			continue // Not affected by the rollback, or never committed.
+		}
+		change := ValidatorChange{Kind: ChangeRemoved, TokenId: tokenId, Address: latestEvent.cometAddress, Height: height}
+		if restored, exists := latestRedeemAt(tokenRedeems, height); exists {
+			change = ValidatorChange{Kind: ChangeReRedeemed, TokenId: tokenId, Address: restored.cometAddress, PreviousAddress: latestEvent.cometAddress, Height: height}
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return compareTokenIds(changes[i].TokenId, changes[j].TokenId) < 0
+	})
+	return changes
+}
+
+// A subscriber's queue of committed changes. It is unbounded so a slow subscriber never blocks the tracker.
+type subscription struct {
+	mu      sync.Mutex
+	pending []ValidatorChange
+	notify  chan struct{}
+}
+
+// Queue changes for every subscriber. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) publishChanges(changes []ValidatorChange) {
+	if len(changes) == 0 {
+		return
+	}
+	for sub := range nft_tracker.subscribers {
+		sub.mu.Lock()
+		sub.pending = append(sub.pending, changes...)
+		sub.mu.Unlock()
+		select {
+		case sub.notify <- struct{}{}:
+		default: // Already notified.
+		}
+	}
+}
+
+// Register a subscription, queueing the committed changes above fromHeight for it.
+func (nft_tracker *Tracker) subscribe(fromHeight int64) *subscription {
+	sub := &subscription{notify: make(chan struct{}, 1)}
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	sub.pending = nft_tracker.changesBetween(fromHeight, nft_tracker.finalizedHeight)
+	if nft_tracker.subscribers == nil {
+		nft_tracker.subscribers = map[*subscription]struct{}{}
+	}
+	nft_tracker.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (nft_tracker *Tracker) unsubscribe(sub *subscription) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	delete(nft_tracker.subscribers, sub)
+}
+
+// Take the changes queued for the subscription.
+func (sub *subscription) take() []ValidatorChange {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	pending := sub.pending
+	sub.pending = nil
+	return pending
+}
+
+// Stream changes to the active set as they are committed, starting with the committed changes above fromHeight, eg. the
+// height of the last change a consumer processed before restarting. Pass -1 to start from the empty set.
+// Every change committed after Subscribe returns is delivered in order. The channel is closed when the context is cancelled.
+func (nft_tracker *Tracker) Subscribe(ctx context.Context, fromHeight int64) <-chan ValidatorChange {
+	sub := nft_tracker.subscribe(fromHeight)
+	changes := make(chan ValidatorChange)
+	go func() {
+		defer close(changes)
+		defer nft_tracker.unsubscribe(sub)
+		for {
+			for _, change := range sub.take() {
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-sub.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,89 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func nextChange(t *testing.T, changes <-chan ValidatorChange) ValidatorChange {
+	t.Helper()
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change delivered")
+		return ValidatorChange{}
+	}
+}
+
+// Applying every change to a map of bindings must reproduce the tracker's active set.
+func assertBindings(t *testing.T, trackerobj *Tracker, bindings map[string]string) {
+	t.Helper()
+	active, err := trackerobj.activeSetAt(trackerobj.FinalizedHeight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != len(bindings) {
+		t.Fatalf("%d bindings from changes, %d active", len(bindings), len(active))
+	}
+	for _, binding := range active {
+		if bindings[binding.tokenId] != binding.cometAddress.String() {
+			t.Errorf("token %s bound to %s, changes say %s", binding.tokenId, binding.cometAddress, bindings[binding.tokenId])
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	events := stateHashEvents()
+	trackerobj.ingestRedeem(events[0])
+	trackerobj.ingestRedeem(events[1])
+	trackerobj.setFinalizedHeight(0x12, "")
+
+	// Committed changes are replayed, then new ones follow as they are committed.
+	changes := trackerobj.Subscribe(ctx, -1)
+	bindings := map[string]string{}
+	apply := func(change ValidatorChange) ValidatorChange {
+		if change.Kind == ChangeRemoved {
+			delete(bindings, change.TokenId)
+		} else {
+			bindings[change.TokenId] = change.Address.String()
+		}
+		return change
+	}
+	for _, height := range []int64{0x10, 0x11} {
+		if change := apply(nextChange(t, changes)); change.Kind != ChangeAdded || change.Height != height || change.Redeem == nil {
+			t.Errorf("replayed %+v, want the redeem at %d added", change, height)
+		}
+	}
+	assertBindings(t, trackerobj, bindings)
+
+	trackerobj.ingestRedeem(events[2])
+	trackerobj.setFinalizedHeight(0x20, "")
+	change := apply(nextChange(t, changes))
+	if change.Kind != ChangeReRedeemed || change.PreviousAddress.String() != "61A83A39C806449DDC66FEB6C86A1994456A8C8B" || change.Height != 0x14 {
+		t.Errorf("re-redeem delivered as %+v", change)
+	}
+	assertBindings(t, trackerobj, bindings)
+
+	// Rolling back before both redeems of token 1 removes it, token 2 is unaffected.
+	trackerobj.RollbackTo(0x10)
+	change = apply(nextChange(t, changes))
+	if change.Kind != ChangeRemoved || change.Height != 0x10 || change.Redeem != nil {
+		t.Errorf("rollback delivered as %+v", change)
+	}
+	assertBindings(t, trackerobj, bindings)
+
+	// Resuming from a height only replays later changes.
+	resumed := trackerobj.Subscribe(ctx, 0x0f)
+	if change := nextChange(t, resumed); change.Height != 0x10 || change.Kind != ChangeAdded {
+		t.Errorf("resumed stream started with %+v", change)
+	}
+
+	cancel()
+	for range changes {
+	}
+}
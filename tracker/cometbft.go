@@ -0,0 +1,156 @@
+package validatorpass_tracker
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+// COMETBFT ADDRESS CONVERSION
+
+// How the bytes32 payload of a redeem event encodes the validator's CometBFT identity.
+type PayloadEncoding int
+
+const (
+	// The payload is a 20 byte CometBFT validator address, left aligned and zero padded to 32 bytes.
+	// This is what the Validator Pass contract receives when a validator redeems with their address.
+	EncodingTruncatedAddress PayloadEncoding = iota
+	// The payload is the full 32 byte ed25519 consensus public key of the validator.
+	// The CometBFT address is derived from the public key, so both can be verified.
+	EncodingEd25519PubKey
+)
+
+func (encoding PayloadEncoding) String() string {
+	switch encoding {
+	case EncodingTruncatedAddress:
+		return "truncated-address"
+	case EncodingEd25519PubKey:
+		return "ed25519-pubkey"
+	default:
+		return fmt.Sprintf("PayloadEncoding(%d)", int(encoding))
+	}
+}
+
+const payloadSize = 32
+
+// Decode the 0x-prefixed bytes32 payload of a redeem event into a CometBFT address.
+// The ed25519 public key is only returned for EncodingEd25519PubKey payloads, otherwise it is nil.
+func DecodeValidatorPayload(payload string, encoding PayloadEncoding) (crypto.Address, crypto.PubKey, error) {
+	payloadBytes, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(payload), "0x"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid validator payload %q: %w", payload, err)
+	}
+	if len(payloadBytes) < payloadSize {
+		return nil, nil, fmt.Errorf("validator payload %q is %d bytes, expected %d", payload, len(payloadBytes), payloadSize)
+	}
+	payloadBytes = payloadBytes[:payloadSize] // Any further data words are not part of the validator identity.
+	switch encoding {
+	case EncodingTruncatedAddress:
+		return crypto.Address(payloadBytes[:crypto.AddressSize]), nil, nil
+	case EncodingEd25519PubKey:
+		pubKey := ed25519.PubKey(payloadBytes)
+		return pubKey.Address(), pubKey, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown payload encoding %s", encoding)
+	}
+}
+
+// Parse a CometBFT validator address from any of the forms callers are likely to hold:
+// a 20 byte hex address (as printed by CometBFT, with or without 0x), a bech32 consensus address (eg. "cosmosvalcons1..."),
+// or a raw bytes32 redeem payload, which is decoded using the given encoding.
+func ParseCometBftAddress(input string, encoding PayloadEncoding) (crypto.Address, error) {
+	if hrp, data, err := bech32.Decode(input); err == nil {
+		return decodeBech32Address(hrp, data)
+	}
+	addressBytes, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(input), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CometBFT address %q: %w", input, err)
+	}
+	switch len(addressBytes) {
+	case crypto.AddressSize:
+		return crypto.Address(addressBytes), nil
+	case payloadSize:
+		address, _, err := DecodeValidatorPayload(input, encoding)
+		return address, err
+	default:
+		return nil, fmt.Errorf("CometBFT address %q is %d bytes, expected %d", input, len(addressBytes), crypto.AddressSize)
+	}
+}
+
+func decodeBech32Address(hrp string, data []byte) (crypto.Address, error) {
+	addressBytes, err := bech32.ConvertBits(data, 5, 8, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bech32 address with prefix %q: %w", hrp, err)
+	}
+	if len(addressBytes) != crypto.AddressSize {
+		return nil, fmt.Errorf("bech32 address with prefix %q is %d bytes, expected %d", hrp, len(addressBytes), crypto.AddressSize)
+	}
+	return crypto.Address(addressBytes), nil
+}
+
+// Encode a CometBFT validator address as a bech32 consensus address with the given human readable prefix, eg. "cosmosvalcons".
+func Bech32ConsensusAddress(address crypto.Address, hrp string) (string, error) {
+	if len(address) != crypto.AddressSize {
+		return "", fmt.Errorf("CometBFT address is %d bytes, expected %d", len(address), crypto.AddressSize)
+	}
+	data, err := bech32.ConvertBits(address, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(hrp, data)
+}
+
+// Key used for the tracker's address indexes, the uppercase hex form CometBFT prints addresses in.
+func addressKey(address crypto.Address) string {
+	return address.String()
+}
+
+// COMETBFT TYPED CALLBACKS
+
+// CometBFT callback for a validator address taken straight from CometBFT, eg. abci.Validator.Address.
+// The address is valid if it holds the latest redeem event of at least one tokenId.
+func VerifyCometBftAddress(address crypto.Address, trackerIns *Tracker) bool {
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	return trackerIns.isActiveAddress(addressKey(address))
+}
+
+// CometBFT callback for a validator's consensus public key, eg. from priv_validator_key.json.
+func VerifyPubKey(pubKey crypto.PubKey, trackerIns *Tracker) bool {
+	if pubKey == nil {
+		return false
+	}
+	return VerifyCometBftAddress(pubKey.Address(), trackerIns)
+}
+
+// CometBFT callback for a validator update, as returned from FinalizeBlock or InitChain.
+func VerifyValidatorUpdate(update abcitypes.ValidatorUpdate, trackerIns *Tracker) bool {
+	pubKey, err := cryptoenc.PubKeyFromProto(update.PubKey)
+	if err != nil {
+		return false
+	}
+	return VerifyPubKey(pubKey, trackerIns)
+}
+
+var errNoPubKey = errors.New("redeem payload does not carry a public key")
+
+// The ed25519 public key of the validator, only available for redeems tracked with EncodingEd25519PubKey.
+func (vRedeem *Validator_RedeemEvent) PubKey() (crypto.PubKey, error) {
+	if vRedeem.pubKey == nil {
+		return nil, errNoPubKey
+	}
+	return vRedeem.pubKey, nil
+}
+
+// The CometBFT validator address of this redeem event.
+func (vRedeem *Validator_RedeemEvent) CometBftAddress() crypto.Address {
+	return vRedeem.cometAddress
+}
@@ -0,0 +1,69 @@
+package validatorpass_tracker
+
+import (
+	"encoding/hex"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+func TestParseCometBftAddress(t *testing.T) {
+	const want = "61A83A39C806449DDC66FEB6C86A1994456A8C8B"
+	bech32Address, err := Bech32ConsensusAddress(mustAddress(t, want), "cosmosvalcons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := []string{
+		"0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", // Raw redeem payload
+		"61A83A39C806449DDC66FEB6C86A1994456A8C8B",                           // CometBFT hex address
+		"0x61a83a39c806449ddc66feb6c86a1994456a8c8b",
+		bech32Address,
+	}
+	for _, input := range inputs {
+		address, err := ParseCometBftAddress(input, EncodingTruncatedAddress)
+		if err != nil {
+			t.Fatalf("ParseCometBftAddress(%q): %v", input, err)
+		}
+		if address.String() != want {
+			t.Errorf("ParseCometBftAddress(%q) = %s, want %s", input, address, want)
+		}
+	}
+	if _, err := ParseCometBftAddress("0x1234", EncodingTruncatedAddress); err == nil {
+		t.Error("short address was accepted")
+	}
+}
+
+func TestEd25519PayloadEncoding(t *testing.T) {
+	pubKey := ed25519.GenPrivKey().PubKey()
+	payload := "0x" + hex.EncodeToString(pubKey.Bytes())
+
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, deployBlock).WithPayloadEncoding(EncodingEd25519PubKey))
+	vRedeem := NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", payload, "0x55bc08")
+	vRedeem.decodePayload(EncodingEd25519PubKey)
+	trackerobj.ingestRedeem(*vRedeem)
+
+	if vRedeem.CometBftAddress().String() != pubKey.Address().String() {
+		t.Fatalf("derived address %s, want %s", vRedeem.CometBftAddress(), pubKey.Address())
+	}
+	if !VerifyPubKey(pubKey, trackerobj) || !VerifyCometBftAddress(pubKey.Address(), trackerobj) {
+		t.Error("redeemed public key was not authorised")
+	}
+	if !VerifyAddress(payload, trackerobj) || !VerifyAddress(pubKey.Address().String(), trackerobj) {
+		t.Error("string callbacks did not accept the payload and address forms")
+	}
+	if !VerifyValidatorUpdate(abcitypes.Ed25519ValidatorUpdate(pubKey.Bytes(), 10), trackerobj) {
+		t.Error("validator update for the redeemed key was not authorised")
+	}
+	if VerifyPubKey(ed25519.GenPrivKey().PubKey(), trackerobj) {
+		t.Error("unknown public key was authorised")
+	}
+}
+
+func mustAddress(t *testing.T, address string) []byte {
+	addressBytes, err := hex.DecodeString(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addressBytes
+}
@@ -0,0 +1,366 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CONFIGURATION
+
+// Event emitted by the Validator Pass contract when a validator redeems a pass.
+const DefaultRedeemEvent = "Redeemed(uint256,bytes32)"
+
+// Tracker configuration, read from a JSON file with environment variable overrides by LoadConfig.
+type Config struct {
+	Endpoints      []string         `json:"endpoints"`      // JSON-RPC URLs, later ones are used when earlier ones fail
+	SearchLimit    int              `json:"searchLimit"`    // Blocks per eth_getLogs request after the first, 0 for unlimited
+	Interval       Duration         `json:"interval"`       // Time between checks for new blocks, eg. "2m"
+	Confirmations  int              `json:"confirmations"`  // Blocks to wait before a redeem is accepted
+	MaxLag         int64            `json:"maxLag"`         // Blocks behind the head, beyond the confirmations, before the tracker is not ready
+	ConflictPolicy ConflictPolicy   `json:"conflictPolicy"` // "allow" (the default), "first-wins" or "reject-both", see ConflictPolicy
+	Store          string           `json:"store"`          // Directory the tracker state is kept in, nothing is kept if empty
+	HTTPAddress    string           `json:"httpAddress"`    // Address to serve the query API on, eg. "127.0.0.1:8645", disabled if empty
+	Webhooks       []Webhook        `json:"webhooks"`       // Sent every committed change, see Notifier
+	Contracts      []ContractConfig `json:"contracts"`
+}
+
+// A Validator Pass contract to track.
+type ContractConfig struct {
+	Name            string `json:"name"` // Required to tell contracts apart when there are several
+	Address         string `json:"address"`
+	Event           string `json:"event"` // DefaultRedeemEvent if empty
+	DeployBlock     int    `json:"deployBlock"`
+	PayloadEncoding string `json:"payloadEncoding"` // "truncated-address" (the default if empty) or "ed25519-pubkey"
+	NodeIdBinding   bool   `json:"nodeIdBinding"`   // The payload's second word is the validator's p2p node ID
+}
+
+// A time.Duration written as a string in config files, eg. "90s" or "2m".
+type Duration struct {
+	time.Duration
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(duration.String())
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	text := ""
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string like \"2m\", got %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	duration.Duration = parsed
+	return nil
+}
+
+// The configuration used for settings missing from the file and environment.
+func DefaultConfig() *Config {
+	return &Config{
+		SearchLimit:   DefaultSearchLimit,
+		Interval:      Duration{DefaultInterval},
+		Confirmations: DefaultConfirmations,
+		MaxLag:        DefaultMaxLag,
+	}
+}
+
+// Load a config file, apply overrides from NFT_AUTHORISE_* environment variables and validate the result.
+// The path may be empty to configure the tracker from the environment alone.
+//
+// NFT_AUTHORISE_ENDPOINTS (comma separated), NFT_AUTHORISE_SEARCH_LIMIT, NFT_AUTHORISE_INTERVAL, NFT_AUTHORISE_CONFIRMATIONS,
+// NFT_AUTHORISE_MAX_LAG, NFT_AUTHORISE_CONFLICT_POLICY, NFT_AUTHORISE_STORE and NFT_AUTHORISE_HTTP_ADDRESS override the
+// settings of the same name.
+// NFT_AUTHORISE_CONTRACT, NFT_AUTHORISE_EVENT and NFT_AUTHORISE_DEPLOY_BLOCK override the first contract, or configure
+// it if the file has none.
+func LoadConfig(path string) (*Config, error) {
+	config, err := ReadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// Load a config file and apply environment variable overrides like LoadConfig, without validating the result,
+// so callers can apply their own overrides (eg. command-line flags) before calling Validate.
+func ReadConfig(path string) (*Config, error) {
+	return readConfig(path, os.LookupEnv)
+}
+
+func readConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		encoded, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(encoded))
+		decoder.DisallowUnknownFields() // Catch misspelled settings rather than silently using defaults.
+		if err := decoder.Decode(config); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+	}
+	if err := config.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	errs := []error{}
+	parseInt := func(name string, value string) int {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a whole number", name, value))
+		}
+		return parsed
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_ENDPOINTS"); set {
+		config.Endpoints = []string{}
+		for _, endpoint := range strings.Split(value, ",") {
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				config.Endpoints = append(config.Endpoints, endpoint)
+			}
+		}
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_SEARCH_LIMIT"); set {
+		config.SearchLimit = parseInt("NFT_AUTHORISE_SEARCH_LIMIT", value)
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_INTERVAL"); set {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("NFT_AUTHORISE_INTERVAL: %w", err))
+		}
+		config.Interval = Duration{interval}
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_CONFIRMATIONS"); set {
+		config.Confirmations = parseInt("NFT_AUTHORISE_CONFIRMATIONS", value)
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_MAX_LAG"); set {
+		config.MaxLag = int64(parseInt("NFT_AUTHORISE_MAX_LAG", value))
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_CONFLICT_POLICY"); set {
+		if err := config.ConflictPolicy.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, fmt.Errorf("NFT_AUTHORISE_CONFLICT_POLICY: %w", err))
+		}
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_STORE"); set {
+		config.Store = value
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_HTTP_ADDRESS"); set {
+		config.HTTPAddress = value
+	}
+
+	contract := ContractConfig{}
+	if len(config.Contracts) > 0 {
+		contract = config.Contracts[0]
+	}
+	contractSet := false
+	if value, set := lookupEnv("NFT_AUTHORISE_CONTRACT"); set {
+		contract.Address, contractSet = value, true
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_EVENT"); set {
+		contract.Event, contractSet = value, true
+	}
+	if value, set := lookupEnv("NFT_AUTHORISE_DEPLOY_BLOCK"); set {
+		contract.DeployBlock, contractSet = parseInt("NFT_AUTHORISE_DEPLOY_BLOCK", value), true
+	}
+	if contractSet {
+		if len(config.Contracts) == 0 {
+			config.Contracts = []ContractConfig{contract}
+		} else {
+			config.Contracts[0] = contract
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	contractAddressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	eventSignaturePattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\([A-Za-z0-9_,\[\]]*\)$`)
+)
+
+// Check the configuration, reporting every problem found rather than only the first.
+func (config *Config) Validate() error {
+	errs := []error{}
+	if len(config.Endpoints) == 0 {
+		errs = append(errs, errors.New("endpoints: at least one JSON-RPC URL is required"))
+	}
+	for i, endpoint := range config.Endpoints {
+		if !validEndpoint(endpoint) {
+			errs = append(errs, fmt.Errorf("endpoints[%d]: %q is not an http(s) or ws(s) URL", i, endpoint))
+		}
+	}
+	if config.SearchLimit < 0 {
+		errs = append(errs, fmt.Errorf("searchLimit: %d is negative, use 0 for unlimited", config.SearchLimit))
+	}
+	if config.Interval.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("interval: %s must be positive", config.Interval))
+	}
+	if config.Confirmations < 0 {
+		errs = append(errs, fmt.Errorf("confirmations: %d is negative", config.Confirmations))
+	}
+	if config.MaxLag < 0 {
+		errs = append(errs, fmt.Errorf("maxLag: %d is negative", config.MaxLag))
+	}
+	if _, err := config.ConflictPolicy.MarshalText(); err != nil {
+		errs = append(errs, fmt.Errorf("conflictPolicy: %w", err))
+	}
+	if config.HTTPAddress != "" {
+		if _, _, err := net.SplitHostPort(config.HTTPAddress); err != nil {
+			errs = append(errs, fmt.Errorf("httpAddress: %q is not a host:port address", config.HTTPAddress))
+		}
+	}
+	for i, webhook := range config.Webhooks {
+		parsed, err := url.Parse(webhook.URL)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("webhooks[%d].url: %q is not an http(s) URL", i, webhook.URL))
+		}
+		if webhook.Secret == "" {
+			errs = append(errs, fmt.Errorf("webhooks[%d].secret: required to sign deliveries", i))
+		}
+	}
+	if len(config.Contracts) == 0 {
+		errs = append(errs, errors.New("contracts: at least one contract is required"))
+	}
+	names := map[string]bool{}
+	for i, contract := range config.Contracts {
+		field := fmt.Sprintf("contracts[%d]", i)
+		if len(config.Contracts) > 1 {
+			if contract.Name == "" {
+				errs = append(errs, fmt.Errorf("%s.name: required when tracking several contracts", field))
+			} else if names[contract.Name] {
+				errs = append(errs, fmt.Errorf("%s.name: %q is used by another contract", field, contract.Name))
+			}
+			names[contract.Name] = true
+		}
+		if strings.ContainsAny(contract.Name, `/\`) {
+			errs = append(errs, fmt.Errorf("%s.name: %q can't contain path separators", field, contract.Name))
+		}
+		if !contractAddressPattern.MatchString(contract.Address) {
+			errs = append(errs, fmt.Errorf("%s.address: %q is not a 0x-prefixed 20 byte hex address", field, contract.Address))
+		}
+		if !eventSignaturePattern.MatchString(contract.event()) {
+			errs = append(errs, fmt.Errorf("%s.event: %q is not an event signature like %s", field, contract.Event, DefaultRedeemEvent))
+		}
+		if contract.DeployBlock < 0 {
+			errs = append(errs, fmt.Errorf("%s.deployBlock: %d is negative", field, contract.DeployBlock))
+		}
+		if _, err := parsePayloadEncoding(contract.PayloadEncoding); err != nil {
+			errs = append(errs, fmt.Errorf("%s.payloadEncoding: %w", field, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parsePayloadEncoding(name string) (PayloadEncoding, error) {
+	if name == "" {
+		return EncodingTruncatedAddress, nil
+	}
+	for _, encoding := range []PayloadEncoding{EncodingTruncatedAddress, EncodingEd25519PubKey} {
+		if name == encoding.String() {
+			return encoding, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not %s or %s", name, EncodingTruncatedAddress, EncodingEd25519PubKey)
+}
+
+func (contract ContractConfig) event() string {
+	if contract.Event == "" {
+		return DefaultRedeemEvent
+	}
+	return contract.Event
+}
+
+// The event a contract's tracker follows.
+func (contract ContractConfig) RedeemEvent() Rpc_RedeemEvent {
+	event := NewRedeemEvent(contract.event(), contract.Address, contract.DeployBlock)
+	if encoding, err := parsePayloadEncoding(contract.PayloadEncoding); err == nil {
+		event = event.WithPayloadEncoding(encoding)
+	}
+	if contract.NodeIdBinding {
+		event = event.WithNodeIdBinding()
+	}
+	return event
+}
+
+// The source for the configured endpoints, failing over between them in order.
+func (config *Config) Source() CodeSource {
+	return endpointsSource(config.Endpoints)
+}
+
+func endpointsSource(endpoints []string) CodeSource {
+	if len(endpoints) == 1 {
+		return NewJsonRpcSource(endpoints[0])
+	}
+	sources := make([]LogSource, len(endpoints))
+	for i, endpoint := range endpoints {
+		sources[i] = NewJsonRpcSource(endpoint)
+	}
+	return NewFailoverSource(sources...)
+}
+
+// Whether a JSON-RPC URL is usable, an http(s) or ws(s) URL with a host.
+func validEndpoint(endpoint string) bool {
+	parsed, err := url.Parse(endpoint)
+	return err == nil && parsed.Host != "" && map[string]bool{"http": true, "https": true, "ws": true, "wss": true}[parsed.Scheme]
+}
+
+// Create a tracker for every configured contract, in order, sharing one source, through New with the configured
+// options. Each tracker resumes from and saves to its contract's store when one is configured, see OpenStore.
+// Extra options, eg. WithLogger, apply to every tracker.
+func (config *Config) Trackers(opts ...Option) ([]*Tracker, error) {
+	source := config.Source()
+	trackers := make([]*Tracker, len(config.Contracts))
+	for i, contract := range config.Contracts {
+		store, err := config.OpenStore(contract)
+		if err != nil {
+			return nil, err
+		}
+		contractOpts := []Option{
+			WithEvent(contract.RedeemEvent()),
+			WithSource(source),
+			WithSearchLimit(config.SearchLimit),
+			WithConfirmations(config.Confirmations),
+			WithInterval(config.Interval.Duration),
+			WithMaxLag(config.MaxLag),
+			WithConflictPolicy(config.ConflictPolicy),
+		}
+		if store != nil {
+			contractOpts = append(contractOpts, WithStore(store))
+		}
+		if trackers[i], err = New(append(contractOpts, opts...)...); err != nil {
+			return nil, fmt.Errorf("contracts[%d]: %w", i, err)
+		}
+	}
+	return trackers, nil
+}
+
+// Open the store for a contract's tracker, nil if no store is configured.
+// With several contracts each one is kept in a subdirectory named after it.
+func (config *Config) OpenStore(contract ContractConfig) (Store, error) {
+	if config.Store == "" {
+		return nil, nil
+	}
+	if len(config.Contracts) > 1 {
+		return NewFileStore(filepath.Join(config.Store, contract.Name))
+	}
+	return NewFileStore(config.Store)
+}
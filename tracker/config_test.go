@@ -0,0 +1,142 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+)
+
+func env(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, set := values[name]
+		return value, set
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"endpoints": ["https://rpc.example"],
+		"interval": "30s",
+		"contracts": [
+			{"name": "sepolia", "address": "0x8D64aB58a17dA7d8788367549c513386f09a0A70", "deployBlock": 5618691},
+			{"name": "keys", "address": "0x0000000000000000000000000000000000000001", "payloadEncoding": "ed25519-pubkey"}
+		]
+	}`), 0o644)
+
+	config, err := readConfig(path, env(map[string]string{
+		"NFT_AUTHORISE_ENDPOINTS":       "https://a.example, https://b.example",
+		"NFT_AUTHORISE_CONFIRMATIONS":   "5",
+		"NFT_AUTHORISE_DEPLOY_BLOCK":    "5618000",
+		"NFT_AUTHORISE_HTTP_ADDRESS":    "127.0.0.1:8645",
+		"NFT_AUTHORISE_MAX_LAG":         "10",
+		"NFT_AUTHORISE_CONFLICT_POLICY": "first-wins",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Endpoints) != 2 || config.Confirmations != 5 || config.Interval.Duration != 30*time.Second || config.SearchLimit != 3000 || config.HTTPAddress != "127.0.0.1:8645" || config.MaxLag != 10 || config.ConflictPolicy != ConflictFirstWins {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.Contracts[0].DeployBlock != 5618000 || config.Contracts[1].DeployBlock != 0 {
+		t.Error("deploy block override not applied to the first contract only")
+	}
+	trackers, err := config.Trackers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trackers) != 2 || trackers[1].trackedEvent.payloadEncoding != EncodingEd25519PubKey {
+		t.Error("trackers not built from the contracts")
+	}
+	if trackers[0].trackedEvent.EventSignature != RedeemEvent.EventSignature {
+		t.Error("default redeem event not used")
+	}
+	if trackers[1].conflictPolicy != ConflictFirstWins {
+		t.Error("conflict policy not applied to the trackers")
+	}
+	// Trackers get New's defaults, eg. retrying source calls, like trackers created in code.
+	retrying, retries := trackers[0].source.(*retrySource)
+	if !retries || retrying.attempts != DefaultRetries {
+		t.Fatalf("source calls are not retried: %T", trackers[0].source)
+	}
+	if _, failover := retrying.source.(*FailoverSource); !failover {
+		t.Error("several endpoints do not fail over")
+	}
+	if trackers[0].Store() != nil {
+		t.Error("tracker has a store without one configured")
+	}
+	config.Store = t.TempDir()
+	if trackers, err = config.Trackers(); err != nil || trackers[0].Store() == nil || trackers[1].Store() == nil {
+		t.Errorf("trackers not saving to the configured store: %v", err)
+	}
+
+	// The environment alone is enough for a single contract.
+	config, err = readConfig("", env(map[string]string{"NFT_AUTHORISE_ENDPOINTS": "https://rpc.example", "NFT_AUTHORISE_CONTRACT": contractAddress}))
+	if err != nil || config.Validate() != nil || config.Contracts[0].Address != contractAddress {
+		t.Errorf("environment config %+v, %v", config, err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"endpoint": ["https://rpc.example"]}`), 0o644)
+	if _, err := readConfig(path, env(nil)); err == nil || !strings.Contains(err.Error(), `unknown field "endpoint"`) {
+		t.Errorf("misspelled setting returned %v", err)
+	}
+	if _, err := readConfig("", env(map[string]string{"NFT_AUTHORISE_CONFLICT_POLICY": "last-wins"})); err == nil || !strings.Contains(err.Error(), "NFT_AUTHORISE_CONFLICT_POLICY") {
+		t.Errorf("unknown conflict policy returned %v", err)
+	}
+	if _, err := readConfig("", env(map[string]string{"NFT_AUTHORISE_SEARCH_LIMIT": "many"})); err == nil || !strings.Contains(err.Error(), "NFT_AUTHORISE_SEARCH_LIMIT") {
+		t.Errorf("invalid environment variable returned %v", err)
+	}
+
+	config := DefaultConfig()
+	config.Endpoints = []string{"rpc.example"}
+	config.Confirmations = -1
+	config.MaxLag = -1
+	config.ConflictPolicy = ConflictPolicy(7)
+	config.HTTPAddress = "8645"
+	config.Webhooks = []Webhook{{URL: "ftp://hooks.example"}}
+	config.Contracts = []ContractConfig{{Address: "0x1234"}, {Address: contractAddress, Event: "Redeemed", PayloadEncoding: "base64"}}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+	// Every problem is reported, by setting.
+	for _, problem := range []string{"endpoints[0]", "confirmations", "maxLag", "conflictPolicy", "httpAddress", "webhooks[0].url", "webhooks[0].secret", "contracts[0].name", "contracts[1].name", "contracts[0].address", "contracts[1].event", "contracts[1].payloadEncoding"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%s not reported in %v", problem, err)
+		}
+	}
+}
+
+func TestFailoverSource(t *testing.T) {
+	failing := rpctest.NewServer(sepoliaHead)
+	defer failing.Close()
+	backup := newSepoliaServer()
+	defer backup.Close()
+	failing.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "rate limited"})
+
+	trackerobj := NewTrackerWithSource(NewFailoverSource(NewJsonRpcSource(failing.URL()), NewJsonRpcSource(backup.URL())), 0, RedeemEvent)
+	found, err := trackerobj.FindRedeems(context.Background(), deployBlock, 5618800)
+	if err != nil || found != len(sepoliaRedeems) {
+		t.Fatalf("found %d redeems, %v", found, err)
+	}
+	// The backup keeps answering after a failover.
+	if _, err := trackerobj.source.BlockNumber(context.Background()); err != nil || backup.Calls("eth_blockNumber") != 1 {
+		t.Errorf("backup not used after failover, %v", err)
+	}
+	backup.Close()
+	failing.Close()
+	if _, err := trackerobj.source.BlockNumber(context.Background()); err == nil {
+		t.Error("no error when every source fails")
+	}
+}
@@ -0,0 +1,159 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cometbft/cometbft/crypto"
+)
+
+// CONFLICTS
+
+// How the verify callbacks treat an address bound by the latest redeem of more than one tokenId, eg. two passes
+// redeemed for the same validator, which may be a mistake or a stolen pass.
+type ConflictPolicy int
+
+const (
+	ConflictAllow      ConflictPolicy = iota // The address is authorised by each of its tokens, the default
+	ConflictFirstWins                        // The address is authorised, only by the token bound to it first, see bindingStart
+	ConflictRejectBoth                       // The address is not authorised while more than one token is bound to it
+)
+
+var conflictPolicyNames = []string{"allow", "first-wins", "reject-both"}
+
+func (policy ConflictPolicy) String() string {
+	if policy < 0 || int(policy) >= len(conflictPolicyNames) {
+		return fmt.Sprintf("ConflictPolicy(%d)", int(policy))
+	}
+	return conflictPolicyNames[policy]
+}
+
+func (policy ConflictPolicy) MarshalText() ([]byte, error) {
+	if policy < 0 || int(policy) >= len(conflictPolicyNames) {
+		return nil, fmt.Errorf("unknown conflict policy %d", int(policy))
+	}
+	return []byte(policy.String()), nil
+}
+
+func (policy *ConflictPolicy) UnmarshalText(text []byte) error {
+	for i, name := range conflictPolicyNames {
+		if string(text) == name {
+			*policy = ConflictPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy %q, expected allow, first-wins or reject-both", text)
+}
+
+// A CometBFT address bound by the latest redeem of more than one tokenId.
+type Conflict struct {
+	Address crypto.Address
+	Redeems []Validator_RedeemEvent // The latest redeem of each token bound to the address, in chain order
+}
+
+// Set the policy the verify callbacks apply to conflicts. Every node must use the same policy, as it changes which
+// validators are authorised. ConflictAllow if never set.
+func (nft_tracker *Tracker) SetConflictPolicy(policy ConflictPolicy) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.conflictPolicy = policy
+}
+
+// The addresses bound by more than one token at the finalized height, ordered by address. They are reported whatever
+// the conflict policy, as copies.
+func (nft_tracker *Tracker) Conflicts() []Conflict {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	conflicts := []Conflict{}
+	for _, conflict := range nft_tracker.conflictsAt(nft_tracker.finalizedHeight) {
+		conflicts = append(conflicts, Conflict{Address: bytes.Clone(conflict.Address), Redeems: cloneRedeems(conflict.Redeems)})
+	}
+	return conflicts
+}
+
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) conflictsAt(height int64) []Conflict {
+	byAddress := map[string][]Validator_RedeemEvent{}
+	for _, binding := range nft_tracker.activeBindingsAt(height) {
+		key := addressKey(binding.cometAddress)
+		byAddress[key] = append(byAddress[key], binding)
+	}
+	conflicts := []Conflict{}
+	for _, redeems := range byAddress {
+		if len(redeems) > 1 {
+			sort.Slice(redeems, func(i, j int) bool { return redeems[j].IsAfter(redeems[i]) })
+			conflicts = append(conflicts, Conflict{Address: redeems[0].cometAddress, Redeems: redeems})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return bytes.Compare(conflicts[i].Address, conflicts[j].Address) < 0
+	})
+	return conflicts
+}
+
+// The latest redeems at a height that bind a key of an index (a CometBFT address or node ID), in chain order.
+// redeems is the key's entry in the index. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) holdingsAt(redeems []Validator_RedeemEvent, height int64) []Validator_RedeemEvent {
+	holdings := []Validator_RedeemEvent{}
+	for redeem := range redeems {
+		if redeems[redeem].redeemedBlockHeight > height {
+			break // Redeems are ordered, later ones did not exist yet.
+		}
+		// The token is bound to the key if this redeem is still its latest.
+		latestEvent, exists := latestRedeemAt(nft_tracker.tokenIdMap[redeems[redeem].tokenId], height)
+		if exists && latestEvent.LogKey() == redeems[redeem].LogKey() {
+			holdings = append(holdings, latestEvent)
+		}
+	}
+	return holdings
+}
+
+// Whether a key bound by the given tokens is authorised under the conflict policy. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) holderAuthorised(holdings []Validator_RedeemEvent) bool {
+	if nft_tracker.conflictPolicy == ConflictRejectBoth {
+		return len(holdings) == 1
+	}
+	return len(holdings) > 0
+}
+
+// Whether a token authorises the key it is bound to, given every token bound to that key, under the conflict policy.
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) bindingAuthorised(holdings []Validator_RedeemEvent, tokenId string) bool {
+	switch nft_tracker.conflictPolicy {
+	case ConflictFirstWins:
+		first := -1
+		for holding := range holdings {
+			if first < 0 || CompareRedeemEvents(nft_tracker.bindingStart(holdings[holding]), nft_tracker.bindingStart(holdings[first])) < 0 {
+				first = holding
+			}
+		}
+		return first >= 0 && holdings[first].tokenId == tokenId
+	case ConflictRejectBoth:
+		return len(holdings) == 1 && holdings[0].tokenId == tokenId
+	}
+	for _, holding := range holdings {
+		if holding.tokenId == tokenId {
+			return true
+		}
+	}
+	return false
+}
+
+// The redeem that bound a token to the address of its latest redeem: the earliest of the redeems up to latest that
+// all bound the token to that address. Re-redeeming a token for the address it is bound to keeps its place under
+// ConflictFirstWins, redeeming it elsewhere and back binds it anew. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) bindingStart(latest Validator_RedeemEvent) Validator_RedeemEvent {
+	tokenRedeems := nft_tracker.tokenIdMap[latest.tokenId]
+	start := latest
+	for redeem := len(tokenRedeems) - 1; redeem >= 0; redeem-- {
+		if tokenRedeems[redeem].IsAfter(latest) {
+			continue
+		}
+		if !bytes.Equal(tokenRedeems[redeem].cometAddress, latest.cometAddress) {
+			break
+		}
+		start = tokenRedeems[redeem]
+	}
+	return start
+}
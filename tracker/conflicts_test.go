@@ -0,0 +1,127 @@
+package validatorpass_tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConflictPolicy(t *testing.T) {
+	const (
+		shared = "61A83A39C806449DDC66FEB6C86A1994456A8C8B"
+		single = "2757295701725127590000000000000000000000"
+	)
+	events := []Validator_RedeemEvent{
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "0x10"),
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000003", "0x2757295701725127590000000000000000000000000000000000000000000000", "0x11"),
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000002", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "0x12"),
+		// Token 1 moves to another address, leaving token 2 alone on the shared one.
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", "0x2175091590317500000000000000000000000000000000000000000000000000", "0x20"),
+	}
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range events[:3] {
+		trackerobj.ingestRedeem(event)
+	}
+	trackerobj.setFinalizedHeight(0x18, "")
+
+	conflicts := trackerobj.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Address.String() != shared || len(conflicts[0].Redeems) != 2 ||
+		conflicts[0].Redeems[0].TokenId() != events[0].tokenId || conflicts[0].Redeems[1].TokenId() != events[2].tokenId {
+		t.Fatalf("conflicts: %+v", conflicts)
+	}
+
+	for _, test := range []struct {
+		policy                 ConflictPolicy
+		address, first, second bool
+	}{
+		{ConflictAllow, true, true, true},
+		{ConflictFirstWins, true, true, false},
+		{ConflictRejectBoth, false, false, false},
+	} {
+		trackerobj.SetConflictPolicy(test.policy)
+		if VerifyAddress(shared, trackerobj) != test.address {
+			t.Errorf("%s: shared address authorised %v", test.policy, !test.address)
+		}
+		if VerifyValidatorAddress(shared, events[0].tokenId, trackerobj) != test.first {
+			t.Errorf("%s: first token authorised %v", test.policy, !test.first)
+		}
+		if authorised, _ := VerifyValidatorAddressAt(shared, events[2].tokenId, 0x18, trackerobj); authorised != test.second {
+			t.Errorf("%s: second token authorised %v", test.policy, !test.second)
+		}
+		if !VerifyAddress(single, trackerobj) || !VerifyValidatorAddress(single, events[1].tokenId, trackerobj) {
+			t.Errorf("%s: address without a conflict not authorised", test.policy)
+		}
+		// Conflicts are reported whatever the policy.
+		if len(trackerobj.Conflicts()) != 1 {
+			t.Errorf("%s: conflict not reported", test.policy)
+		}
+	}
+
+	// The conflict ends once token 1 is redeemed elsewhere, and height-pinned callbacks still see it before then.
+	trackerobj.ingestRedeem(events[3])
+	trackerobj.setFinalizedHeight(0x20, "")
+	if len(trackerobj.Conflicts()) != 0 {
+		t.Errorf("resolved conflict reported: %+v", trackerobj.Conflicts())
+	}
+	if authorised, _ := VerifyAddressAt(shared, 0x20, trackerobj); !authorised {
+		t.Error("address not authorised once its conflict is resolved")
+	}
+	if authorised, _ := VerifyAddressAt(shared, 0x18, trackerobj); authorised {
+		t.Error("address authorised below the height its conflict was resolved")
+	}
+
+	server := httptest.NewServer(NewQueryHandler(trackerobj))
+	defer server.Close()
+	response := ConflictsResponse{}
+	getJSON(t, server, "/conflicts", http.StatusOK, &response)
+	if response.Height != 0x20 || response.Policy != ConflictRejectBoth || len(response.Conflicts) != 0 {
+		t.Errorf("GET /conflicts: %+v", response)
+	}
+
+	policy := ConflictPolicy(0)
+	if err := policy.UnmarshalText([]byte("first-wins")); err != nil || policy != ConflictFirstWins {
+		t.Errorf("parsed %s, %v", policy, err)
+	}
+	if err := policy.UnmarshalText([]byte("last-wins")); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestConflictFirstWinsKeepsPlaceOnReRedeem(t *testing.T) {
+	const (
+		shared  = "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"
+		other   = "0x2757295701725127590000000000000000000000000000000000000000000000"
+		tokenA  = "0x0000000000000000000000000000000000000000000000000000000000000001"
+		tokenB  = "0x0000000000000000000000000000000000000000000000000000000000000002"
+		address = "61A83A39C806449DDC66FEB6C86A1994456A8C8B"
+	)
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	trackerobj.SetConflictPolicy(ConflictFirstWins)
+	for _, event := range []*Validator_RedeemEvent{
+		NewValidatorRedeemEvent(tokenA, shared, "0x10"),
+		NewValidatorRedeemEvent(tokenB, shared, "0x12"),
+		// Token A is redeemed for the address it is already bound to, after token B.
+		NewValidatorRedeemEvent(tokenA, shared, "0x14"),
+		// Token A moves away and back: it is bound anew, after token B.
+		NewValidatorRedeemEvent(tokenA, other, "0x16"),
+		NewValidatorRedeemEvent(tokenA, shared, "0x18"),
+	} {
+		trackerobj.ingestRedeem(*event)
+	}
+	trackerobj.setFinalizedHeight(0x18, "")
+
+	for _, test := range []struct {
+		height int64
+		winner string
+	}{
+		{0x12, tokenA},
+		{0x14, tokenA},
+		{0x18, tokenB},
+	} {
+		for _, tokenId := range []string{tokenA, tokenB} {
+			if authorised, _ := VerifyValidatorAddressAt(address, tokenId, test.height, trackerobj); authorised != (tokenId == test.winner) {
+				t.Errorf("at %#x token %s authorised %t", test.height, tokenId[len(tokenId)-1:], authorised)
+			}
+		}
+	}
+}
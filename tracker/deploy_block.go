@@ -0,0 +1,70 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"fmt"
+)
+
+// DEPLOY BLOCK
+
+// A log source that can also read contract code, eg. a JSON-RPC node or a failover between several.
+type CodeSource interface {
+	LogSource
+	// The contract's code at a block, empty if it wasn't deployed yet.
+	CodeAt(ctx context.Context, contractAddress string, blockNumber uint64) (string, error)
+}
+
+// The contract's code at a block, empty if it wasn't deployed yet. Needs an archive node for old blocks.
+func (source *JsonRpcSource) CodeAt(ctx context.Context, contractAddress string, blockNumber uint64) (string, error) {
+	code := ""
+	if err := source.call(ctx, &code, "eth_getCode", contractAddress, fmt.Sprintf("0x%x", blockNumber)); err != nil {
+		return "", err
+	}
+	if code == "0x" {
+		return "", nil
+	}
+	return code, nil
+}
+
+// The contract's code at a block from the first source that answers. Sources that can't read code are skipped.
+func (source *FailoverSource) CodeAt(ctx context.Context, contractAddress string, blockNumber uint64) (code string, err error) {
+	err = source.try(func(next LogSource) error {
+		codeSource, ok := next.(CodeSource)
+		if !ok {
+			return fmt.Errorf("source %T can't read contract code", next)
+		}
+		code, err = codeSource.CodeAt(ctx, contractAddress, blockNumber)
+		return err
+	})
+	return code, err
+}
+
+// Find the block a contract was deployed in, by binary search over eth_getCode.
+// Contracts that were self-destructed and redeployed are reported at a block where code exists, not necessarily the first.
+func FindDeployBlock(ctx context.Context, source CodeSource, contractAddress string) (uint64, error) {
+	head, err := source.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	code, err := source.CodeAt(ctx, contractAddress, head)
+	if err != nil {
+		return 0, err
+	}
+	if code == "" {
+		return 0, fmt.Errorf("no contract at %s as of block %d", contractAddress, head)
+	}
+	low, high := uint64(0), head // Code is present at high and missing at every block below low.
+	for low < high {
+		middle := low + (high-low)/2
+		code, err := source.CodeAt(ctx, contractAddress, middle)
+		if err != nil {
+			return 0, err
+		}
+		if code == "" {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	return high, nil
+}
@@ -0,0 +1,43 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+)
+
+func TestFindDeployBlock(t *testing.T) {
+	server := rpctest.NewServer(sepoliaHead)
+	defer server.Close()
+	server.SetCode(contractAddress, deployBlock)
+	source := NewJsonRpcSource(server.URL())
+
+	found, err := FindDeployBlock(context.Background(), source, contractAddress)
+	if err != nil || found != deployBlock {
+		t.Fatalf("found deploy block %d, %v", found, err)
+	}
+	if calls := server.Calls("eth_getCode"); calls > 30 {
+		t.Errorf("binary search made %d eth_getCode calls", calls)
+	}
+	if _, err := FindDeployBlock(context.Background(), source, "0x0000000000000000000000000000000000000001"); err == nil {
+		t.Error("found a deploy block for an address without code")
+	}
+}
+
+func TestFindDeployBlockFailsOver(t *testing.T) {
+	server := rpctest.NewServer(sepoliaHead)
+	defer server.Close()
+	server.SetCode(contractAddress, deployBlock)
+	config := &Config{Endpoints: []string{"http://127.0.0.1:1", server.URL()}}
+
+	found, err := FindDeployBlock(context.Background(), config.Source(), contractAddress)
+	if err != nil || found != deployBlock {
+		t.Fatalf("found deploy block %d, %v", found, err)
+	}
+	// Sources that can't read code are skipped.
+	static := NewFailoverSource(NewStaticSource(sepoliaHead, nil), NewJsonRpcSource(server.URL()))
+	if code, err := static.CodeAt(context.Background(), contractAddress, sepoliaHead); err != nil || code == "" {
+		t.Errorf("failover read code %q, %v", code, err)
+	}
+}
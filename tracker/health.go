@@ -0,0 +1,149 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HEALTH
+
+// Blocks the finalized height may fall behind the chain head, beyond the confirmations, before the tracker is not ready.
+const DefaultMaxLag = 50
+
+var (
+	ErrNotTracking       = errors.New("tracking loop is not running")
+	ErrTrackingStalled   = errors.New("tracking loop has stalled")
+	ErrSourceUnreachable = errors.New("source is unreachable")
+	ErrNotSynced         = errors.New("historical search is not complete")
+	ErrLagging           = errors.New("tracker is behind the chain head")
+)
+
+// Timeout of the source request made by Health.
+const healthTimeout = 10 * time.Second
+
+// Check that the source answers and, once the tracker has searched up to the chain head, that StartTracking's loop is
+// running and making progress. An unhealthy tracker should be restarted.
+func (nft_tracker *Tracker) Health(ctx context.Context) error {
+	nft_tracker.mu.RLock()
+	tracking, interval, lastActive := nft_tracker.tracking, nft_tracker.interval, nft_tracker.lastActive
+	nft_tracker.mu.RUnlock()
+	select {
+	case <-nft_tracker.synced:
+		if !tracking {
+			return ErrNotTracking
+		}
+		// A poll can search many blocks, each searched window counts as progress.
+		if idle := nft_tracker.clock.Now().Sub(lastActive); idle > 2*interval+time.Minute {
+			return fmt.Errorf("%w: no progress for %s", ErrTrackingStalled, idle.Round(time.Second))
+		}
+	default:
+		// Still searching up to the head for the first time, the loop may not have started yet.
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	head, err := nft_tracker.source.BlockNumber(ctx)
+	if err != nil {
+		nft_tracker.recordError(err)
+		return fmt.Errorf("%w: %w", ErrSourceUnreachable, err)
+	}
+	nft_tracker.recordHead(head)
+	return nil
+}
+
+// Check that the tracker is safe to authorise validators with: it has searched up to the chain head once, and the
+// finalized height is at most the max lag behind the head, beyond the confirmations. See SetMaxLag.
+func (nft_tracker *Tracker) Ready() error {
+	select {
+	case <-nft_tracker.synced:
+	default:
+		return fmt.Errorf("%w: %.1f%% searched", ErrNotSynced, nft_tracker.Status().BackfillPercent)
+	}
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	if lag := nft_tracker.headHeight - nft_tracker.finalizedHeight - int64(nft_tracker.confirmations); lag > nft_tracker.maxLag {
+		return fmt.Errorf("%w: %d blocks behind, at most %d allowed", ErrLagging, lag, nft_tracker.maxLag)
+	}
+	return nil
+}
+
+// Block until the tracker is ready, or the context is cancelled, eg. before starting CometBFT.
+func (nft_tracker *Tracker) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		notReady := nft_tracker.Ready()
+		if notReady == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ctx.Err(), notReady)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Set the blocks the finalized height may fall behind the chain head, beyond the confirmations, before Ready fails.
+// DefaultMaxLag if never set.
+func (nft_tracker *Tracker) SetMaxLag(blocks int64) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.maxLag = blocks
+}
+
+// Record that StartTracking's loop is running, for Health and Ready.
+func (nft_tracker *Tracker) startLoop(interval time.Duration, confirmations int) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.tracking, nft_tracker.interval, nft_tracker.confirmations = true, interval, confirmations
+	nft_tracker.lastActive = nft_tracker.clock.Now()
+}
+
+func (nft_tracker *Tracker) stopLoop() {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.tracking = false
+}
+
+// Record that the tracking loop made progress, for Health.
+func (nft_tracker *Tracker) recordActive() {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.lastActive = nft_tracker.clock.Now()
+}
+
+// An http.Handler for container orchestration, answering 200 {"status": "ok"} when every tracker passes the check
+// and 503 Service Unavailable with the failures otherwise:
+//
+//	GET /healthz  see Health, a failing tracker should be restarted
+//	GET /readyz   see Ready, validators should not be authorised until it passes
+func NewHealthHandler(trackers ...*Tracker) http.Handler {
+	check := func(w http.ResponseWriter, checkTracker func(*Tracker) error) {
+		errs := []error{}
+		for _, trackerIns := range trackers {
+			if err := checkTracker(trackerIns); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", trackerIns.contractLabel(), err))
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, healthResponse{Status: "ok"})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		check(w, func(trackerIns *Tracker) error { return trackerIns.Health(r.Context()) })
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		check(w, (*Tracker).Ready)
+	})
+	return mux
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
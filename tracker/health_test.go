@@ -0,0 +1,103 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+)
+
+func TestHealth(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	trackerobj := NewTracker(server.URL(), 50, NewRedeemEvent(redeemed, contractAddress, deployBlock))
+	handler := httptest.NewServer(NewHealthHandler(trackerobj))
+	defer handler.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Before the first search the tracker is healthy while the source answers, but not ready.
+	if err := trackerobj.Health(ctx); err != nil {
+		t.Errorf("unhealthy before searching: %v", err)
+	}
+	if err := trackerobj.Ready(); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("ready before searching: %v", err)
+	}
+	getJSON(t, handler, "/readyz", http.StatusServiceUnavailable, &errorResponse{})
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer waitCancel()
+	if err := trackerobj.WaitReady(waitCtx); !errors.Is(err, ErrNotSynced) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitReady returned %v", err)
+	}
+
+	if _, err := trackerobj.Backfill(ctx, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackerobj.WaitReady(ctx); err != nil {
+		t.Errorf("not ready after searching up to the head: %v", err)
+	}
+	getJSON(t, handler, "/readyz", http.StatusOK, &healthResponse{})
+	// Once synced, the tracking loop must be running.
+	if err := trackerobj.Health(ctx); !errors.Is(err, ErrNotTracking) {
+		t.Errorf("healthy without the tracking loop: %v", err)
+	}
+	getJSON(t, handler, "/healthz", http.StatusServiceUnavailable, &errorResponse{})
+
+	go trackerobj.StartTracking(ctx, time.Hour, 20)
+	waitUntil(t, func() bool { return trackerobj.Health(ctx) == nil })
+	getJSON(t, handler, "/healthz", http.StatusOK, &healthResponse{})
+
+	server.FailNext("eth_blockNumber", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	if err := trackerobj.Health(ctx); !errors.Is(err, ErrSourceUnreachable) {
+		t.Errorf("healthy with an unreachable source: %v", err)
+	}
+
+	// The head moving on without the tracker polling leaves it behind.
+	server.Mine(DefaultMaxLag + 1)
+	if err := trackerobj.Health(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackerobj.Ready(); !errors.Is(err, ErrLagging) {
+		t.Errorf("ready %d blocks behind: %v", DefaultMaxLag+1, err)
+	}
+	trackerobj.SetMaxLag(DefaultMaxLag + 1)
+	if err := trackerobj.Ready(); err != nil {
+		t.Errorf("not ready within the max lag: %v", err)
+	}
+}
+
+func TestStartTrackingRetriesHistoricalSearch(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	trackerobj := NewTracker(server.URL(), 50, NewRedeemEvent(redeemed, contractAddress, deployBlock))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	defer func() { cancel(); <-stopped }()
+
+	// The head can't be read, then the search fails: neither hangs the loop or marks the tracker synced.
+	server.FailNext("eth_blockNumber", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	server.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	go func() {
+		defer close(stopped)
+		trackerobj.StartTracking(ctx, 200*time.Millisecond, 20)
+	}()
+	waitUntil(t, func() bool { return server.Calls("eth_getLogs") > 0 })
+	if err := trackerobj.Ready(); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("ready after a failed historical search: %v", err)
+	}
+	if trackerobj.Status().LastError == "" {
+		t.Error("failed search not reported in the status")
+	}
+
+	<-trackerobj.Synced()
+	if len(trackerobj.validatorList) != len(sepoliaRedeems) || trackerobj.FinalizedHeight() != sepoliaHead-20 {
+		t.Errorf("retried search found %d redeems up to %d", len(trackerobj.validatorList), trackerobj.FinalizedHeight())
+	}
+	if err := trackerobj.Ready(); err != nil {
+		t.Errorf("not ready after the retried search: %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP QUERY API
+
+// A redeem event as returned by the query API.
+type RedeemJSON struct {
+	TokenId          string `json:"tokenId"`
+	Payload          string `json:"payload"`          // Raw bytes32 payload emitted by the contract
+	CometBftAddress  string `json:"cometBftAddress"`  // Uppercase hex, as CometBFT prints addresses
+	PubKey           string `json:"pubKey,omitempty"` // Hex ed25519 public key, for EncodingEd25519PubKey contracts
+	NodeId           string `json:"nodeId,omitempty"` // For contracts tracked WithNodeIdBinding
+	BlockNumber      int64  `json:"blockNumber"`
+	TransactionHash  string `json:"transactionHash"`
+	TransactionIndex int64  `json:"transactionIndex"`
+	LogIndex         int64  `json:"logIndex"`
+}
+
+func redeemJSON(vRedeem Validator_RedeemEvent) RedeemJSON {
+	encoded := RedeemJSON{
+		TokenId:          vRedeem.tokenId,
+		Payload:          vRedeem.validatorAddress,
+		CometBftAddress:  vRedeem.cometAddress.String(),
+		NodeId:           vRedeem.nodeId,
+		BlockNumber:      vRedeem.redeemedBlockHeight,
+		TransactionHash:  vRedeem.txHash,
+		TransactionIndex: vRedeem.txIndex,
+		LogIndex:         vRedeem.logIndex,
+	}
+	if vRedeem.pubKey != nil {
+		encoded.PubKey = hex.EncodeToString(vRedeem.pubKey.Bytes())
+	}
+	return encoded
+}
+
+func redeemsJSON(redeems []Validator_RedeemEvent) []RedeemJSON {
+	encoded := make([]RedeemJSON, len(redeems))
+	for i := range redeems {
+		encoded[i] = redeemJSON(redeems[i])
+	}
+	return encoded
+}
+
+// Answer to GET /verify/{address}.
+type VerifyResponse struct {
+	Address    string `json:"address"`
+	TokenId    string `json:"tokenId,omitempty"`
+	Height     int64  `json:"height"`
+	Authorised bool   `json:"authorised"`
+}
+
+// Answer to GET /tokens/{tokenId}.
+type TokenResponse struct {
+	TokenId string       `json:"tokenId"`
+	Height  int64        `json:"height"`           // History is complete up to this height
+	Holder  *RedeemJSON  `json:"holder,omitempty"` // Latest redeem, nil if the token was never redeemed
+	Redeems []RedeemJSON `json:"redeems"`
+}
+
+// Answer to GET /active.
+type ActiveResponse struct {
+	Height   int64        `json:"height"`
+	Bindings []RedeemJSON `json:"bindings"` // Latest redeem of every tokenId, ordered by tokenId
+}
+
+// Answer to GET /status.
+type StatusResponse struct {
+	ContractAddress    string     `json:"contractAddress"`
+	EventSignature     string     `json:"eventSignature"`
+	DeployBlock        int        `json:"deployBlock"`
+	FinalizedHeight    int64      `json:"finalizedHeight"`
+	FinalizedBlockHash string     `json:"finalizedBlockHash,omitempty"`
+	AgreedHeight       int64      `json:"agreedHeight,omitempty"` // Only set with EnableHeightAgreement
+	Redeems            int        `json:"redeems"`
+	Tokens             int        `json:"tokens"`
+	Sync               SyncStatus `json:"sync"`
+}
+
+// Answer to GET /conflicts.
+type ConflictsResponse struct {
+	Height    int64          `json:"height"`
+	Policy    ConflictPolicy `json:"policy"`
+	Conflicts []ConflictJSON `json:"conflicts"` // Ordered by address
+}
+
+// A CometBFT address bound by more than one tokenId, see Conflict.
+type ConflictJSON struct {
+	CometBftAddress string       `json:"cometBftAddress"`
+	Redeems         []RedeemJSON `json:"redeems"` // The latest redeem of each token bound to the address, in chain order
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// An http.Handler serving the tracker's state as JSON, for sidecars, dashboards and scripts on the validator host.
+// Answers come from the same height-pinned queries CometBFT callbacks use, so they match what consensus sees.
+//
+//	GET /verify/{address}?tokenId=&height=  whether a CometBFT address is authorised, or bound to tokenId
+//	GET /tokens/{tokenId}                    every redeem of a token and its current holder
+//	GET /active?height=                      the tokenId -> address bindings at a height
+//	GET /status                              how far the tracker has searched
+//	GET /conflicts                           addresses bound by more than one tokenId, see ConflictPolicy
+//	GET /changes?from=                       server-sent events for every change to the active set, see Subscribe
+//	GET /healthz, GET /readyz                see NewHealthHandler
+//
+// height defaults to the finalized height. Heights the tracker has not reached yet get 425 Too Early, malformed
+// parameters 400 Bad Request. Errors are returned as {"error": "..."}.
+func NewQueryHandler(trackerIns *Tracker) http.Handler {
+	mux := http.NewServeMux()
+	health := NewHealthHandler(trackerIns)
+	mux.Handle("GET /healthz", health)
+	mux.Handle("GET /readyz", health)
+	mux.HandleFunc("GET /verify/{address}", func(w http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("address")
+		if _, err := ParseCometBftAddress(address, trackerIns.trackedEvent.payloadEncoding); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		height, err := queryHeight(r, trackerIns)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		response := VerifyResponse{Address: address, Height: height}
+		if tokenId := r.URL.Query().Get("tokenId"); tokenId != "" {
+			if response.TokenId, err = CanonicalTokenId(tokenId); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			response.Authorised, err = VerifyValidatorAddressAt(address, response.TokenId, height, trackerIns)
+		} else {
+			response.Authorised, err = VerifyAddressAt(address, height, trackerIns)
+		}
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		writeJSON(w, response)
+	})
+	mux.HandleFunc("GET /tokens/{tokenId}", func(w http.ResponseWriter, r *http.Request) {
+		tokenId, err := CanonicalTokenId(r.PathValue("tokenId"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		height := trackerIns.FinalizedHeight()
+		redeems := trackerIns.tokenRedeems(tokenId)
+		response := TokenResponse{TokenId: tokenId, Height: height, Redeems: redeemsJSON(redeems)}
+		if len(redeems) > 0 {
+			response.Holder = &response.Redeems[len(redeems)-1]
+		}
+		writeJSON(w, response)
+	})
+	mux.HandleFunc("GET /active", func(w http.ResponseWriter, r *http.Request) {
+		height, err := queryHeight(r, trackerIns)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		bindings, err := trackerIns.activeSetAt(height)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		writeJSON(w, ActiveResponse{Height: height, Bindings: redeemsJSON(bindings)})
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, trackerIns.statusResponse())
+	})
+	mux.HandleFunc("GET /conflicts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, trackerIns.conflictsResponse())
+	})
+	mux.HandleFunc("GET /changes", func(w http.ResponseWriter, r *http.Request) {
+		serveChanges(w, r, trackerIns)
+	})
+	return mux
+}
+
+func (nft_tracker *Tracker) statusResponse() StatusResponse {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	return StatusResponse{
+		ContractAddress:    nft_tracker.trackedEvent.contractAddress,
+		EventSignature:     nft_tracker.trackedEvent.EventSignature,
+		DeployBlock:        nft_tracker.trackedEvent.deployBlock,
+		FinalizedHeight:    nft_tracker.finalizedHeight,
+		FinalizedBlockHash: nft_tracker.finalizedBlockHash,
+		AgreedHeight:       nft_tracker.agreedHeight,
+		Redeems:            len(nft_tracker.validatorList),
+		Tokens:             len(nft_tracker.tokenIdMap),
+		Sync:               nft_tracker.status(),
+	}
+}
+
+func (nft_tracker *Tracker) conflictsResponse() ConflictsResponse {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	response := ConflictsResponse{Height: nft_tracker.finalizedHeight, Policy: nft_tracker.conflictPolicy, Conflicts: []ConflictJSON{}}
+	for _, conflict := range nft_tracker.conflictsAt(nft_tracker.finalizedHeight) {
+		response.Conflicts = append(response.Conflicts, ConflictJSON{CometBftAddress: conflict.Address.String(), Redeems: redeemsJSON(conflict.Redeems)})
+	}
+	return response
+}
+
+// Interval between comments sent on an idle change stream, so proxies don't close it.
+const keepAliveInterval = 15 * time.Second
+
+// Stream changes as server-sent events, one "change" event per ValidatorChange. The event id is the change's height
+// and its sequence number among the changes at that height, eg. "5618694-1".
+// The stream starts after the from query parameter, -1 (everything) if missing. A reconnecting client's Last-Event-ID
+// takes precedence: the stream resumes after that change, within its height. An id with only a height sends the
+// changes at that height again, which is harmless as each one sets a token's binding.
+func serveChanges(w http.ResponseWriter, r *http.Request, trackerIns *Tracker) {
+	fromHeight := int64(-1)
+	if value := r.URL.Query().Get("from"); value != "" {
+		height, err := strconv.ParseInt(value, 0, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid from height %q", value))
+			return
+		}
+		fromHeight = height
+	}
+	resumeHeight, resumeSequence := int64(-1), -1 // Changes at resumeHeight up to resumeSequence were already received
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		encodedHeight, encodedSequence, hasSequence := strings.Cut(lastEventId, "-")
+		if height, err := strconv.ParseInt(encodedHeight, 10, 64); err == nil {
+			fromHeight = height - 1
+			if sequence, err := strconv.Atoi(encodedSequence); hasSequence && err == nil {
+				resumeHeight, resumeSequence = height, sequence
+			}
+		}
+	}
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return // Streaming is not supported by this connection.
+	}
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	changes := trackerIns.Subscribe(r.Context(), fromHeight)
+	height, sequence := int64(-1), 0 // Height and sequence number of the last change
+	for {
+		select {
+		case change, open := <-changes:
+			if !open {
+				return
+			}
+			if change.Height == height {
+				sequence++
+			} else {
+				height, sequence = change.Height, 0
+			}
+			if height == resumeHeight && sequence <= resumeSequence {
+				continue // Received before reconnecting.
+			}
+			resumeHeight = -1 // Only the first changes of the stream were received before.
+			encoded, err := json.Marshal(change)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d-%d\nevent: change\ndata: %s\n\n", change.Height, sequence, encoded)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// The height query parameter, the tracker's finalized height if it is missing.
+func queryHeight(r *http.Request, trackerIns *Tracker) (int64, error) {
+	value := r.URL.Query().Get("height")
+	if value == "" {
+		return trackerIns.FinalizedHeight(), nil
+	}
+	height, err := strconv.ParseInt(value, 0, 64)
+	if err != nil || height < 0 {
+		return 0, fmt.Errorf("invalid height %q", value)
+	}
+	return height, nil
+}
+
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrHeightNotFinalized) {
+		writeError(w, http.StatusTooEarly, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Serve a handler, eg. NewQueryHandler, on a TCP address such as "127.0.0.1:8645" until the context is cancelled.
+// The API has no authentication, bind it to a loopback or otherwise private address. On shutdown the contexts of
+// running requests are cancelled, so change streams end straight away while other requests finish.
+func ListenAndServe(ctx context.Context, address string, handler http.Handler) error {
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return requestsCtx },
+	}
+	server.RegisterOnShutdown(cancelRequests)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err // Could not listen, eg. the address is in use.
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,179 @@
+package validatorpass_tracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, server *httptest.Server, path string, wantStatus int, response any) {
+	t.Helper()
+	res, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != wantStatus {
+		t.Fatalf("GET %s returned %d, want %d", path, res.StatusCode, wantStatus)
+	}
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		trackerobj.ingestRedeem(event)
+	}
+	trackerobj.setFinalizedHeight(0x20, "")
+	server := httptest.NewServer(NewQueryHandler(trackerobj))
+	defer server.Close()
+
+	verified := VerifyResponse{}
+	getJSON(t, server, "/verify/0x61a83a39c806449ddc66feb6c86a1994456a8c8b?height=0x13", http.StatusOK, &verified)
+	if !verified.Authorised || verified.Height != 0x13 {
+		t.Errorf("address holding token 1 at 0x13 not authorised: %+v", verified)
+	}
+	getJSON(t, server, "/verify/0x61a83a39c806449ddc66feb6c86a1994456a8c8b?tokenId=1", http.StatusOK, &verified)
+	if verified.Authorised || verified.Height != 0x20 {
+		t.Errorf("address re-redeemed away from token 1 still authorised: %+v", verified)
+	}
+	getJSON(t, server, "/verify/0x2757295701725127590000000000000000000000?tokenId=2", http.StatusOK, &verified)
+	if !verified.Authorised || verified.TokenId != "0x0000000000000000000000000000000000000000000000000000000000000002" {
+		t.Errorf("token 2 holder not authorised: %+v", verified)
+	}
+
+	token := TokenResponse{}
+	getJSON(t, server, "/tokens/0x1", http.StatusOK, &token)
+	if len(token.Redeems) != 2 || token.Holder == nil || token.Holder.BlockNumber != 0x14 {
+		t.Errorf("token 1 history: %+v", token)
+	}
+	unredeemed := TokenResponse{}
+	getJSON(t, server, "/tokens/3", http.StatusOK, &unredeemed)
+	if len(unredeemed.Redeems) != 0 || unredeemed.Holder != nil {
+		t.Errorf("unredeemed token has history: %+v", unredeemed)
+	}
+
+	active := ActiveResponse{}
+	getJSON(t, server, "/active?height=16", http.StatusOK, &active)
+	if len(active.Bindings) != 1 || active.Bindings[0].CometBftAddress != "2757295701725127590000000000000000000000" {
+		t.Errorf("active set at 16: %+v", active)
+	}
+	getJSON(t, server, "/active", http.StatusOK, &active)
+	if len(active.Bindings) != 2 || active.Bindings[0].BlockNumber != 0x14 {
+		t.Errorf("active set at the finalized height: %+v", active)
+	}
+
+	status := StatusResponse{}
+	getJSON(t, server, "/status", http.StatusOK, &status)
+	if status.FinalizedHeight != 0x20 || status.Redeems != 3 || status.Tokens != 2 {
+		t.Errorf("status: %+v", status)
+	}
+
+	failed := errorResponse{}
+	getJSON(t, server, "/active?height=0x21", http.StatusTooEarly, &failed)
+	getJSON(t, server, "/verify/not-an-address", http.StatusBadRequest, &failed)
+	getJSON(t, server, "/tokens/-1", http.StatusBadRequest, &failed)
+	if failed.Error == "" {
+		t.Error("error response has no message")
+	}
+}
+
+func TestChangeStream(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	events := stateHashEvents()
+	trackerobj.ingestRedeem(events[0])
+	trackerobj.ingestRedeem(events[1])
+	sameBlock := *NewValidatorRedeemEvent("0x03", "0x2757295701725127590000000000000000000000000000000000000000000000", "0x11")
+	sameBlock.logIndex = 1
+	trackerobj.ingestRedeem(sameBlock)
+	trackerobj.setFinalizedHeight(0x12, "")
+	server := httptest.NewServer(NewQueryHandler(trackerobj))
+	defer server.Close()
+
+	// A reconnecting client resumes after the last event it received, within its height.
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/changes?from=0", nil)
+	req.Header.Set("Last-Event-ID", "17-0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("content type %s", res.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(res.Body)
+	nextEvent := func() (string, ValidatorChange) {
+		t.Helper()
+		id, change := "", ValidatorChange{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				return id, change
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	if id, change := nextEvent(); id != "17-1" || change.Kind != ChangeAdded || change.TokenId != "0x0000000000000000000000000000000000000000000000000000000000000003" || change.Address.String() != "2757295701725127590000000000000000000000" {
+		t.Errorf("first event %s: %+v", id, change)
+	}
+	trackerobj.ingestRedeem(events[2])
+	trackerobj.setFinalizedHeight(0x20, "")
+	if id, change := nextEvent(); id != "20-0" || change.Kind != ChangeReRedeemed || change.Redeem.BlockNumber != 0x14 {
+		t.Errorf("live event %s: %+v", id, change)
+	}
+}
+
+func TestListenAndServeEndsStreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- ListenAndServe(ctx, address, NewQueryHandler(trackerobj)) }()
+
+	var res *http.Response
+	waitUntil(t, func() bool {
+		res, err = http.Get("http://" + address + "/changes")
+		return err == nil
+	})
+	defer res.Body.Close()
+	waitUntil(t, func() bool { return subscriberCount(trackerobj) == 1 })
+
+	// An open stream doesn't hold up shutdown until its timeout.
+	started := time.Now()
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("shutdown took %s with an open stream", took)
+	}
+	if _, err := io.ReadAll(res.Body); err != nil {
+		t.Errorf("stream not ended cleanly: %v", err)
+	}
+}
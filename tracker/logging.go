@@ -0,0 +1,40 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LOGGING
+
+// Handler that drops every record, so the tracker is silent unless it is given a logger.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool   { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error  { return nil }
+func (handler discardHandler) WithAttrs([]slog.Attr) slog.Handler { return handler }
+func (handler discardHandler) WithGroup(string) slog.Handler      { return handler }
+
+var discardLogger = slog.New(discardHandler{})
+
+// Log the tracker's activity to a structured logger, with the contract address on every record. Searches and reorgs
+// are logged at info and warn, every ingested event and polling tick at debug. Pass nil to silence the tracker again,
+// which is the default. Set the logger before starting the tracker.
+func (nft_tracker *Tracker) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		nft_tracker.logger = discardLogger
+		return
+	}
+	nft_tracker.logger = logger.With("contract", nft_tracker.contractLabel())
+}
+
+// Structured fields describing a redeem event.
+func redeemAttrs(vRedeem Validator_RedeemEvent) []any {
+	return []any{
+		"tokenId", vRedeem.tokenId,
+		"address", vRedeem.cometAddress.String(),
+		"block", vRedeem.redeemedBlockHeight,
+		"tx", vRedeem.txHash,
+		"logIndex", vRedeem.logIndex,
+	}
+}
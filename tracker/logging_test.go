@@ -0,0 +1,43 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetLogger(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	if trackerobj.logger.Enabled(context.Background(), slog.LevelError) {
+		t.Error("tracker logs by default")
+	}
+	events := stateHashEvents()
+	trackerobj.ingestRedeem(events[0])
+	trackerobj.ingestRedeem(events[1])
+	trackerobj.setFinalizedHeight(0x12, "")
+
+	output := &bytes.Buffer{}
+	trackerobj.SetLogger(slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	trackerobj.RollbackTo(0x10)
+	records := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(records) != 1 {
+		t.Fatalf("logged %q, want the rollback", output.String())
+	}
+	record := map[string]any{}
+	if err := json.Unmarshal([]byte(records[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "WARN" || record["contract"] != trackerobj.contractLabel() || record["removed"] != float64(1) {
+		t.Errorf("rollback logged as %v", record)
+	}
+
+	trackerobj.SetLogger(nil)
+	output.Reset()
+	trackerobj.RollbackTo(0x0f)
+	if output.Len() != 0 {
+		t.Errorf("logged %q after removing the logger", output.String())
+	}
+}
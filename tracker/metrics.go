@@ -0,0 +1,133 @@
+package validatorpass_tracker
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// METRICS
+
+const metricsNamespace = "nft_authorise"
+
+// Tracker metrics, labelled by the tracked contract's lowercase address. RPC metrics are labelled by JSON-RPC method
+// and endpoint, with the endpoint reduced to its scheme and host so API keys in URLs are not exported.
+var (
+	scannedHeightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "scanned_height",
+		Help:      "Ethereum height up to which all redeem events have been ingested.",
+	}, []string{"contract"})
+	headHeightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "chain_head_height",
+		Help:      "Latest Ethereum block number read from the source.",
+	}, []string{"contract"})
+	headLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "chain_head_lag_blocks",
+		Help:      "Blocks between the chain head and the scanned height, including the blocks waiting for confirmations.",
+	}, []string{"contract"})
+	rpcDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_request_duration_seconds",
+		Help:      "Duration of JSON-RPC requests, including failed ones.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+	rpcErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_errors_total",
+		Help:      "JSON-RPC requests that failed.",
+	}, []string{"method", "endpoint"})
+	eventsIngestedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_ingested_total",
+		Help:      "Redeem events read from the source and ingested, not counting duplicates.",
+	}, []string{"contract"})
+	activeValidatorsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_validators",
+		Help:      "CometBFT addresses holding the latest redeem of at least one tokenId at the scanned height.",
+	}, []string{"contract"})
+	conflictsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "conflicts",
+		Help:      "CometBFT addresses holding the latest redeem of more than one tokenId at the scanned height.",
+	}, []string{"contract"})
+	reorgsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reorgs_total",
+		Help:      "Chain reorganisations below the scanned height that were rolled back.",
+	}, []string{"contract"})
+	backfillProgressGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backfill_progress_ratio",
+		Help:      "Fraction of the blocks of the current search that have been searched, 1 when no search is running.",
+	}, []string{"contract"})
+)
+
+// The tracker metrics, to register with an application's own Prometheus registry.
+func MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		scannedHeightGauge, headHeightGauge, headLagGauge, rpcDurationHistogram, rpcErrorsCounter,
+		eventsIngestedCounter, activeValidatorsGauge, conflictsGauge, reorgsCounter, backfillProgressGauge,
+	}
+}
+
+// An http.Handler serving the tracker metrics with the Go runtime and process metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(MetricsCollectors()...)
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// The tracked contract's lowercase address, labelling its metrics and logs.
+func (nft_tracker *Tracker) contractLabel() string {
+	return strings.ToLower(nft_tracker.trackedEvent.contractAddress)
+}
+
+// Record the chain head read from the source.
+func (nft_tracker *Tracker) recordHead(head uint64) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.headHeight = int64(head)
+	nft_tracker.updateHeightMetrics()
+}
+
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) updateHeightMetrics() {
+	contract := nft_tracker.contractLabel()
+	scannedHeightGauge.WithLabelValues(contract).Set(float64(nft_tracker.finalizedHeight))
+	if nft_tracker.headHeight > 0 {
+		headHeightGauge.WithLabelValues(contract).Set(float64(nft_tracker.headHeight))
+		headLagGauge.WithLabelValues(contract).Set(float64(max(nft_tracker.headHeight-nft_tracker.finalizedHeight, 0)))
+	}
+}
+
+// Update the metrics that depend on the finalized state. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) updateStateMetrics() {
+	nft_tracker.updateHeightMetrics()
+	addresses := map[string]struct{}{}
+	for _, binding := range nft_tracker.activeBindingsAt(nft_tracker.finalizedHeight) {
+		addresses[addressKey(binding.cometAddress)] = struct{}{}
+	}
+	activeValidatorsGauge.WithLabelValues(nft_tracker.contractLabel()).Set(float64(len(addresses)))
+	conflictsGauge.WithLabelValues(nft_tracker.contractLabel()).Set(float64(len(nft_tracker.conflictsAt(nft_tracker.finalizedHeight))))
+}
+
+// The scheme and host of an RPC URL, dropping paths and queries that often carry API keys.
+func endpointLabel(rpcAddress string) string {
+	if rpcAddress == "" {
+		return "in-process"
+	}
+	parsed, err := url.Parse(rpcAddress)
+	if err != nil || parsed.Host == "" {
+		return "unknown"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
@@ -0,0 +1,89 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	// A contract of its own, so other tests don't change the tracker metrics.
+	contract := "0x00000000000000000000000000000000000000AA"
+	for _, redeem := range sepoliaRedeems {
+		server.AddLogs(redeem.block, rpctest.Log{Address: contract, Topics: []string{RedeemEvent.EventSignature, redeem.tokenId}, Data: redeem.validatorAddress})
+	}
+	label := strings.ToLower(contract)
+	trackerobj := NewTracker(server.URL(), 50, NewRedeemEvent(redeemed, contract, deployBlock))
+	endpoint := endpointLabel(server.URL())
+	getLogsErrors := testutil.ToFloat64(rpcErrorsCounter.WithLabelValues("eth_getLogs", endpoint))
+
+	server.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	if _, err := trackerobj.Backfill(context.Background(), 20); err == nil {
+		t.Fatal("RPC failure was not returned")
+	}
+	if _, err := trackerobj.Backfill(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, got := range map[string]float64{
+		"scanned height":    testutil.ToFloat64(scannedHeightGauge.WithLabelValues(label)),
+		"head lag":          testutil.ToFloat64(headLagGauge.WithLabelValues(label)),
+		"events ingested":   testutil.ToFloat64(eventsIngestedCounter.WithLabelValues(label)),
+		"active validators": testutil.ToFloat64(activeValidatorsGauge.WithLabelValues(label)),
+		"backfill progress": testutil.ToFloat64(backfillProgressGauge.WithLabelValues(label)),
+		"getLogs errors":    testutil.ToFloat64(rpcErrorsCounter.WithLabelValues("eth_getLogs", endpoint)) - getLogsErrors,
+	} {
+		want := map[string]float64{
+			"scanned height":    sepoliaHead - 20,
+			"head lag":          20,
+			"events ingested":   float64(len(sepoliaRedeems)),
+			"active validators": float64(len(sepoliaRedeems)),
+			"backfill progress": 1,
+			"getLogs errors":    1,
+		}[name]
+		if got != want {
+			t.Errorf("%s is %v, want %v", name, got, want)
+		}
+	}
+
+	trackerobj.RollbackTo(5618700)
+	if active := testutil.ToFloat64(activeValidatorsGauge.WithLabelValues(label)); active != 1 {
+		t.Errorf("%v active validators after rolling back, want 1", active)
+	}
+
+	// The handler serves the metrics in the Prometheus text format, without the RPC URL's path.
+	scrape := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(scrape.Body)
+	for _, line := range []string{
+		`nft_authorise_scanned_height{contract="` + label + `"} 5.6187e+06`,
+		`nft_authorise_rpc_request_duration_seconds_count{endpoint="` + endpoint + `",method="eth_getLogs"}`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("scrape is missing %s", line)
+		}
+	}
+	if strings.Contains(string(body), server.URL()+"/") {
+		t.Error("scrape contains the full RPC URL")
+	}
+}
+
+func TestEndpointLabel(t *testing.T) {
+	for rpcAddress, want := range map[string]string{
+		"https://eth-sepolia.g.alchemy.com/v2/secret-key": "https://eth-sepolia.g.alchemy.com",
+		"wss://node.example:8546/?token=secret":           "wss://node.example:8546",
+		"":                                                "in-process",
+		"not a url":                                       "unknown",
+	} {
+		if got := endpointLabel(rpcAddress); got != want {
+			t.Errorf("endpointLabel(%q) = %q, want %q", rpcAddress, got, want)
+		}
+	}
+}
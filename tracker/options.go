@@ -0,0 +1,207 @@
+package validatorpass_tracker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// OPTIONS
+
+// Settings New uses when no option sets them.
+const (
+	DefaultSearchLimit   = 3000
+	DefaultConfirmations = 20
+	DefaultInterval      = 2 * time.Minute
+	DefaultRetries       = 3 // Attempts of each source call, including the first
+	DefaultRetryBackoff  = time.Second
+)
+
+// Where the tracker reads the time and waits, so tests can control it.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Configures a tracker created with New.
+type Option func(*trackerOptions)
+
+type trackerOptions struct {
+	endpoints     []string
+	source        LogSource
+	event         *Rpc_RedeemEvent
+	searchLimit   int
+	confirmations int
+	interval      time.Duration
+	retries       int
+	retryBackoff  time.Duration
+	maxLag        int64
+	conflicts     ConflictPolicy
+	store         Store
+	logger        *slog.Logger
+	clock         Clock
+	progress      func(SyncStatus)
+}
+
+// The redeem event to track, required.
+func WithEvent(event Rpc_RedeemEvent) Option {
+	return func(options *trackerOptions) { options.event = &event }
+}
+
+// JSON-RPC URLs to read from, later ones are used when earlier ones fail. Either endpoints or a source is required.
+func WithEndpoints(endpoints ...string) Option {
+	return func(options *trackerOptions) { options.endpoints = endpoints }
+}
+
+// Read from any log source instead of JSON-RPC endpoints, eg. a static export for air-gapped validators.
+func WithSource(source LogSource) Option {
+	return func(options *trackerOptions) { options.source = source }
+}
+
+// Blocks per eth_getLogs request after the first, 0 for unlimited. DefaultSearchLimit if not set.
+func WithSearchLimit(blocks int) Option {
+	return func(options *trackerOptions) { options.searchLimit = blocks }
+}
+
+// Blocks behind the chain head that are considered final, used by Run and Ready. DefaultConfirmations if not set.
+func WithConfirmations(blocks int) Option {
+	return func(options *trackerOptions) { options.confirmations = blocks }
+}
+
+// Time between checks for new blocks in Run. DefaultInterval if not set.
+func WithInterval(interval time.Duration) Option {
+	return func(options *trackerOptions) { options.interval = interval }
+}
+
+// Attempts of each source call, including the first, waiting backoff after the first failure and doubling it after
+// each one. Set 1 attempt to fail straight away. DefaultRetries and DefaultRetryBackoff if not set.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(options *trackerOptions) { options.retries, options.retryBackoff = attempts, backoff }
+}
+
+// See SetMaxLag. DefaultMaxLag if not set.
+func WithMaxLag(blocks int64) Option {
+	return func(options *trackerOptions) { options.maxLag = blocks }
+}
+
+// See SetConflictPolicy. ConflictAllow if not set.
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(options *trackerOptions) { options.conflicts = policy }
+}
+
+// Resume from the snapshot in a store, and save a snapshot to it after every search.
+func WithStore(store Store) Option {
+	return func(options *trackerOptions) { options.store = store }
+}
+
+// See SetLogger. The tracker is silent if not set.
+func WithLogger(logger *slog.Logger) Option {
+	return func(options *trackerOptions) { options.logger = logger }
+}
+
+// The system clock if not set.
+func WithClock(clock Clock) Option {
+	return func(options *trackerOptions) { options.clock = clock }
+}
+
+// See SetProgressFunc.
+func WithProgressFunc(progress func(SyncStatus)) Option {
+	return func(options *trackerOptions) { options.progress = progress }
+}
+
+// Create a tracker, eg.
+//
+//	New(WithEvent(NewRedeemEvent(DefaultRedeemEvent, address, deployBlock)), WithEndpoints(rpcURL), WithStore(store))
+//
+// Every invalid option is reported rather than only the first. With a store, the tracker resumes from its snapshot.
+func New(opts ...Option) (*Tracker, error) {
+	options := trackerOptions{
+		searchLimit:   DefaultSearchLimit,
+		confirmations: DefaultConfirmations,
+		interval:      DefaultInterval,
+		retries:       DefaultRetries,
+		retryBackoff:  DefaultRetryBackoff,
+		maxLag:        DefaultMaxLag,
+		clock:         systemClock{},
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	source := options.source
+	if source == nil {
+		source = endpointsSource(options.endpoints)
+	}
+	if options.retries > 1 {
+		source = &retrySource{source: source, attempts: options.retries, backoff: options.retryBackoff, clock: options.clock}
+	}
+	trackerIns := NewTrackerWithSource(source, options.searchLimit, *options.event)
+	trackerIns.confirmations = options.confirmations
+	trackerIns.interval = options.interval
+	trackerIns.maxLag = options.maxLag
+	trackerIns.conflictPolicy = options.conflicts
+	trackerIns.clock = options.clock
+	trackerIns.progress = options.progress
+	trackerIns.SetLogger(options.logger)
+	if options.store != nil {
+		if err := trackerIns.LoadSnapshot(options.store); err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("could not resume from store: %w", err)
+		}
+		trackerIns.store = options.store
+	}
+	return trackerIns, nil
+}
+
+func (options *trackerOptions) validate() error {
+	errs := []error{}
+	if options.event == nil {
+		errs = append(errs, errors.New("event: required, see WithEvent"))
+	} else if !contractAddressPattern.MatchString(options.event.contractAddress) {
+		errs = append(errs, fmt.Errorf("event: contract %q is not a 0x-prefixed 20 byte hex address", options.event.contractAddress))
+	}
+	switch {
+	case options.source == nil && len(options.endpoints) == 0:
+		errs = append(errs, errors.New("endpoints: at least one JSON-RPC URL or a source is required"))
+	case options.source != nil && len(options.endpoints) > 0:
+		errs = append(errs, errors.New("endpoints: can't be used with a source"))
+	}
+	for i, endpoint := range options.endpoints {
+		if !validEndpoint(endpoint) {
+			errs = append(errs, fmt.Errorf("endpoints[%d]: %q is not an http(s) or ws(s) URL", i, endpoint))
+		}
+	}
+	if options.searchLimit < 0 {
+		errs = append(errs, fmt.Errorf("searchLimit: %d is negative, use 0 for unlimited", options.searchLimit))
+	}
+	if options.confirmations < 0 {
+		errs = append(errs, fmt.Errorf("confirmations: %d is negative", options.confirmations))
+	}
+	if options.interval <= 0 {
+		errs = append(errs, fmt.Errorf("interval: %s must be positive", options.interval))
+	}
+	if options.retries < 1 {
+		errs = append(errs, fmt.Errorf("retries: %d attempts, at least 1 is required", options.retries))
+	}
+	if options.retryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("retries: backoff %s is negative", options.retryBackoff))
+	}
+	if options.maxLag < 0 {
+		errs = append(errs, fmt.Errorf("maxLag: %d is negative", options.maxLag))
+	}
+	if _, err := options.conflicts.MarshalText(); err != nil {
+		errs = append(errs, fmt.Errorf("conflictPolicy: %w", err))
+	}
+	if options.clock == nil {
+		errs = append(errs, errors.New("clock: can't be nil"))
+	}
+	return errors.Join(errs...)
+}
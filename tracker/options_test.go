@@ -0,0 +1,78 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+)
+
+func TestNew(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	store := NewMemoryStore()
+	event := NewRedeemEvent(redeemed, contractAddress, deployBlock)
+	trackerobj, err := New(WithEvent(event), WithEndpoints(server.URL()), WithSearchLimit(50), WithRetries(3, time.Millisecond), WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trackerobj.confirmations != DefaultConfirmations || trackerobj.interval != DefaultInterval || trackerobj.maxLag != DefaultMaxLag {
+		t.Errorf("defaults not applied: %d confirmations, %s interval, %d max lag", trackerobj.confirmations, trackerobj.interval, trackerobj.maxLag)
+	}
+	if trackerobj.Event().EventSignature != RedeemEvent.EventSignature || trackerobj.Status().Endpoint != endpointLabel(server.URL()) {
+		t.Errorf("tracker follows %+v from %s", trackerobj.Event(), trackerobj.Status().Endpoint)
+	}
+
+	// Failed calls are retried, and the state is saved to the store after the search.
+	server.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "upstream unavailable"}, &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	if _, err := trackerobj.Backfill(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := New(WithEvent(event), WithEndpoints(server.URL()), WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.FinalizedHeight() != sepoliaHead-20 || len(resumed.validatorList) != len(sepoliaRedeems) {
+		t.Errorf("resumed at %d with %d redeems", resumed.FinalizedHeight(), len(resumed.validatorList))
+	}
+
+	// Without retries the first failure is returned.
+	once, err := New(WithEvent(event), WithEndpoints(server.URL()), WithRetries(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("eth_blockNumber", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	if _, err := once.Backfill(context.Background(), 20); err == nil {
+		t.Error("failure was retried with a single attempt")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(); err == nil || !strings.Contains(err.Error(), "event") || !strings.Contains(err.Error(), "endpoints") {
+		t.Errorf("New without options returned %v", err)
+	}
+	_, err := New(
+		WithEvent(NewRedeemEvent(redeemed, "0x1234", deployBlock)),
+		WithEndpoints("rpc.example"),
+		WithSearchLimit(-1),
+		WithConfirmations(-1),
+		WithInterval(0),
+		WithRetries(0, -time.Second),
+		WithMaxLag(-1),
+		WithClock(nil),
+	)
+	if err == nil {
+		t.Fatal("invalid options accepted")
+	}
+	// Every problem is reported, by setting.
+	for _, problem := range []string{"event", "endpoints[0]", "searchLimit", "confirmations", "interval", "retries: 0", "backoff", "maxLag", "clock"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%s not reported in %v", problem, err)
+		}
+	}
+	if _, err := New(WithEvent(RedeemEvent), WithEndpoints(rpcSource), WithSource(NewStaticSource(0, nil))); err == nil {
+		t.Error("endpoints and a source accepted together")
+	}
+}
@@ -0,0 +1,98 @@
+package validatorpass_tracker
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+)
+
+// P2P NODE ID BINDING
+
+// CometBFT queries the application with this path prefix when filter_peers is enabled, followed by the peer's node ID.
+const P2PFilterIdPath = "/p2p/filter/id/"
+
+// ABCI response code used to reject a peer that is not bound to an active validator pass.
+const CodeUnauthorisedPeer uint32 = 1
+
+// Returns a copy of the event whose redeem payload also binds a p2p node ID.
+// The event data is then expected to hold two bytes32 words: the validator payload followed by
+// the 20 byte CometBFT node ID, left aligned and zero padded.
+func (event Rpc_RedeemEvent) WithNodeIdBinding() Rpc_RedeemEvent {
+	event.bindsNodeId = true
+	return event
+}
+
+// Decode the node ID from the second bytes32 word of a redeem payload, in the lowercase hex form CometBFT uses for p2p.ID.
+func DecodeNodeIdPayload(payload string) (string, error) {
+	payloadBytes, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(payload), "0x"))
+	if err != nil {
+		return "", fmt.Errorf("invalid node ID payload %q: %w", payload, err)
+	}
+	if len(payloadBytes) < 2*payloadSize {
+		return "", fmt.Errorf("redeem payload is %d bytes, expected %d to bind a node ID", len(payloadBytes), 2*payloadSize)
+	}
+	return hex.EncodeToString(payloadBytes[payloadSize : payloadSize+crypto.AddressSize]), nil
+}
+
+// Decode the node ID bound by this redeem event, if any.
+func (vRedeem *Validator_RedeemEvent) decodeNodeId() {
+	nodeId, err := DecodeNodeIdPayload(vRedeem.validatorAddress)
+	vRedeem.setDecodeErr(err)
+	vRedeem.nodeId = nodeId
+}
+
+// The p2p node ID bound by this redeem event, empty if the tracked event does not bind node IDs.
+func (vRedeem *Validator_RedeemEvent) NodeId() string {
+	return vRedeem.nodeId
+}
+
+// Normalise a node ID as given by CometBFT or an operator, accepting "id" and "id@host:port" forms.
+func normaliseNodeId(nodeId string) string {
+	nodeId, _, _ = strings.Cut(nodeId, "@")
+	return strings.TrimPrefix(strings.ToLower(nodeId), "0x")
+}
+
+// CometBFT callback for p2p admission: a node ID is valid if it is bound by the latest redeem event of at least one tokenId.
+// A node ID bound by several tokens is treated like a conflicting address, see ConflictPolicy.
+func VerifyNodeId(nodeId string, trackerIns *Tracker) bool {
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	key := normaliseNodeId(nodeId)
+	if key == "" {
+		return false
+	}
+	return trackerIns.holderAuthorised(trackerIns.holdingsAt(trackerIns.nodeIdMap[key], math.MaxInt64))
+}
+
+// Redeem events for each node ID are kept in on-chain order, events without a node ID are not indexed.
+func (nft_tracker *Tracker) AddToNodeIdMap(validatorRedeem Validator_RedeemEvent) {
+	if validatorRedeem.nodeId == "" {
+		return
+	}
+	currentRedeem := nft_tracker.nodeIdMap[validatorRedeem.nodeId]
+	nft_tracker.nodeIdMap[validatorRedeem.nodeId] = insertOrdered(currentRedeem, validatorRedeem)
+}
+
+// ABCI query handler for CometBFT's peer filter, answering "/p2p/filter/id/<id>" from tracker state.
+// Returns nil for any other path so it can be chained in front of an application's own Query handler:
+//
+//	if res := vpauth.P2PFilterQuery(req, tracker); res != nil {
+//		return res, nil
+//	}
+func P2PFilterQuery(req *abcitypes.RequestQuery, trackerIns *Tracker) *abcitypes.ResponseQuery {
+	if !strings.HasPrefix(req.Path, P2PFilterIdPath) {
+		return nil
+	}
+	nodeId := strings.TrimPrefix(req.Path, P2PFilterIdPath)
+	if !VerifyNodeId(nodeId, trackerIns) {
+		return &abcitypes.ResponseQuery{
+			Code: CodeUnauthorisedPeer,
+			Log:  fmt.Sprintf("node %s is not bound to an active validator pass", nodeId),
+		}
+	}
+	return &abcitypes.ResponseQuery{Code: abcitypes.CodeTypeOK}
+}
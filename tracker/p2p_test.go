@@ -0,0 +1,38 @@
+package validatorpass_tracker
+
+import (
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+func TestP2PFilterQuery(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, deployBlock).WithNodeIdBinding())
+	const tokenId = "0x0000000000000000000000000000000000000000000000000000000000000001"
+	const validatorWord = "61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"
+	const firstNode = "1e9b6f3a2c0d4e5f60718293a4b5c6d7e8f90a1b"
+	const secondNode = "2f0c7a4b3d1e5f6071829304b5c6d7e8f90a1b2c"
+	for i, nodeId := range []string{firstNode, secondNode} {
+		vRedeem := NewValidatorRedeemEventFromLog(RedeemEventRpc{
+			Topics:      []string{RedeemEvent.EventSignature, tokenId},
+			Data:        "0x" + validatorWord + nodeId + "000000000000000000000000",
+			BlockNumber: "0x55bc08",
+			LogIndex:    []string{"0x1", "0x2"}[i],
+		})
+		vRedeem.decodeNodeId()
+		trackerobj.ingestRedeem(*vRedeem)
+	}
+
+	if res := P2PFilterQuery(&abcitypes.RequestQuery{Path: P2PFilterIdPath + secondNode}, trackerobj); res == nil || res.Code != abcitypes.CodeTypeOK {
+		t.Errorf("node bound by the latest redeem was rejected: %v", res)
+	}
+	if res := P2PFilterQuery(&abcitypes.RequestQuery{Path: P2PFilterIdPath + firstNode}, trackerobj); res == nil || res.Code != CodeUnauthorisedPeer {
+		t.Errorf("node bound by a replaced redeem was accepted: %v", res)
+	}
+	if !VerifyNodeId(secondNode+"@127.0.0.1:26656", trackerobj) {
+		t.Error("node ID with a dial address was not normalised")
+	}
+	if res := P2PFilterQuery(&abcitypes.RequestQuery{Path: "/p2p/filter/addr/127.0.0.1:26656"}, trackerobj); res != nil {
+		t.Errorf("address filter query was answered: %v", res)
+	}
+}
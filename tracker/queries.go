@@ -0,0 +1,103 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/cometbft/cometbft/crypto"
+)
+
+// HISTORY QUERIES
+
+// Queries answer from the redeem events up to the finalized height and return copies, so callers can keep or modify
+// the results without affecting the tracker. TokenIds may be given in decimal or hex, see CanonicalTokenId.
+
+// Every redeem of a token, oldest first. Empty if the token was never redeemed.
+func (nft_tracker *Tracker) TokenHistory(tokenId string) ([]Validator_RedeemEvent, error) {
+	canonical, err := CanonicalTokenId(tokenId)
+	if err != nil {
+		return nil, err
+	}
+	return cloneRedeems(nft_tracker.tokenRedeems(canonical)), nil
+}
+
+// The CometBFT address holding a token: the address of its latest redeem. False if the token was never redeemed.
+func (nft_tracker *Tracker) CurrentHolder(tokenId string) (crypto.Address, bool, error) {
+	canonical, err := CanonicalTokenId(tokenId)
+	if err != nil {
+		return nil, false, err
+	}
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	latest, exists := latestRedeemAt(nft_tracker.tokenIdMap[canonical], nft_tracker.finalizedHeight)
+	if !exists {
+		return nil, false, nil
+	}
+	return bytes.Clone(latest.cometAddress), true, nil
+}
+
+// Every tokenId ever redeemed for a CometBFT address, including tokens since redeemed for another address, in the
+// order they were first redeemed for it. The address is parsed like the verify callbacks do.
+func (nft_tracker *Tracker) TokensForAddress(cometBftAddress string) ([]string, error) {
+	address, err := ParseCometBftAddress(cometBftAddress, nft_tracker.trackedEvent.payloadEncoding)
+	if err != nil {
+		return nil, err
+	}
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	tokenIds := []string{}
+	seen := map[string]bool{}
+	for _, redeem := range nft_tracker.addressMap[addressKey(address)] {
+		if redeem.redeemedBlockHeight > nft_tracker.finalizedHeight {
+			break // Ordered list, the rest has not been finalized.
+		}
+		if !seen[redeem.tokenId] {
+			seen[redeem.tokenId] = true
+			tokenIds = append(tokenIds, redeem.tokenId)
+		}
+	}
+	return tokenIds, nil
+}
+
+// A page of active bindings, see ActiveBindings.
+type BindingsPage struct {
+	Height   int64                   // Finalized height the bindings were read at
+	Bindings []Validator_RedeemEvent // Latest redeem of each tokenId, ordered by tokenId
+	Next     string                  // Pass as after to read the next page, empty on the last page
+}
+
+// The tokenId -> CometBFT address bindings at the finalized height, ordered by tokenId: at most limit bindings with
+// tokenIds after the given one, or from the first tokenId if after is empty. A limit of 0 returns every remaining
+// binding. Pages are read at the finalized height of each call, so a binding that changes between calls is
+// returned as it is when its page is read.
+func (nft_tracker *Tracker) ActiveBindings(after string, limit int) (BindingsPage, error) {
+	if limit < 0 {
+		return BindingsPage{}, fmt.Errorf("limit %d is negative", limit)
+	}
+	if after != "" {
+		canonical, err := CanonicalTokenId(after)
+		if err != nil {
+			return BindingsPage{}, err
+		}
+		after = canonical
+	}
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	bindings := nft_tracker.activeBindingsAt(nft_tracker.finalizedHeight)
+	start := 0
+	if after != "" {
+		start = sort.Search(len(bindings), func(i int) bool {
+			return compareTokenIds(bindings[i].tokenId, after) > 0
+		})
+	}
+	end := len(bindings)
+	if limit > 0 {
+		end = min(start+limit, len(bindings))
+	}
+	page := BindingsPage{Height: nft_tracker.finalizedHeight, Bindings: cloneRedeems(bindings[start:end])}
+	if end < len(bindings) {
+		page.Next = bindings[end-1].tokenId
+	}
+	return page, nil
+}
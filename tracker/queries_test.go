@@ -0,0 +1,71 @@
+package validatorpass_tracker
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHistoryQueries(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	events := append(stateHashEvents(),
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000003", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "0x15"),
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000004", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "0x30"),
+	)
+	for _, event := range events {
+		trackerobj.ingestRedeem(event)
+	}
+	trackerobj.setFinalizedHeight(0x20, "")
+
+	history, err := trackerobj.TokenHistory("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].BlockNumber() != 0x11 || history[1].BlockNumber() != 0x14 || history[1].TokenId() != events[2].tokenId {
+		t.Fatalf("token 1 history: %v", history)
+	}
+	// Results are copies, changing them leaves the tracker as it was.
+	history[1].CometBftAddress()[0] = 0xff
+	holder, found, err := trackerobj.CurrentHolder("0x01")
+	if err != nil || !found || holder.String() != "2175091590317500000000000000000000000000" {
+		t.Errorf("token 1 held by %s, %v, %v", holder, found, err)
+	}
+	if _, found, _ := trackerobj.CurrentHolder("4"); found {
+		t.Error("token redeemed past the finalized height has a holder")
+	}
+	if _, err := trackerobj.TokenHistory("token"); err == nil {
+		t.Error("invalid tokenId accepted")
+	}
+
+	tokenIds, err := trackerobj.TokensForAddress("61A83A39C806449DDC66FEB6C86A1994456A8C8B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tokenIds, []string{events[1].tokenId, events[3].tokenId}) {
+		t.Errorf("tokens for address: %v", tokenIds)
+	}
+
+	// Paging through the bindings returns each active tokenId once, in order.
+	tokenIds = nil
+	after := ""
+	for pages := 0; ; pages++ {
+		page, err := trackerobj.ActiveBindings(after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Height != 0x20 || pages > 1 {
+			t.Fatalf("page %d: %+v", pages, page)
+		}
+		for _, binding := range page.Bindings {
+			tokenIds = append(tokenIds, binding.TokenId())
+		}
+		if after = page.Next; after == "" {
+			break
+		}
+	}
+	if !slices.Equal(tokenIds, []string{events[1].tokenId, events[0].tokenId, events[3].tokenId}) {
+		t.Errorf("paged bindings: %v", tokenIds)
+	}
+	if page, _ := trackerobj.ActiveBindings("", 0); len(page.Bindings) != 3 || page.Next != "" {
+		t.Errorf("unlimited page: %+v", page)
+	}
+}
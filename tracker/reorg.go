@@ -0,0 +1,138 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// REORG HANDLING
+
+// Waiting for confirmations makes reorgs of searched blocks unlikely but not impossible: the confirmation count is
+// configurable down to 0, chains can reorg deeper than it, and providers behind a load balancer can answer from nodes
+// on different forks. Without rollback a redeem from an abandoned fork would stay in the tracker, authorising a
+// validator the canonical chain never bound. So the tracker keeps the hashes of the blocks it searched up to, and
+// rolls back to the latest one still on the source's chain before searching again.
+
+// Number of scanned block hashes kept to find where a reorged chain forked from the one the tracker scanned.
+const maxCheckpoints = 128
+
+// The hash of a block the tracker scanned up to.
+type checkpoint struct {
+	height    int64
+	blockHash string
+}
+
+var ErrReorg = errors.New("chain reorganised below the finalized height")
+
+// Record a scanned block hash, keeping the most recent maxCheckpoints. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) addCheckpoint(height int64, blockHash string) {
+	if blockHash == "" {
+		return // The source doesn't know block hashes, reorgs can't be detected.
+	}
+	if last := len(nft_tracker.checkpoints) - 1; last >= 0 && nft_tracker.checkpoints[last].height == height {
+		nft_tracker.checkpoints[last].blockHash = blockHash
+		return
+	}
+	nft_tracker.checkpoints = append(nft_tracker.checkpoints, checkpoint{height: height, blockHash: blockHash})
+	if len(nft_tracker.checkpoints) > maxCheckpoints {
+		nft_tracker.checkpoints = nft_tracker.checkpoints[len(nft_tracker.checkpoints)-maxCheckpoints:]
+	}
+}
+
+// Returns ErrReorg if the last scanned block is no longer on the source's chain.
+func (nft_tracker *Tracker) checkFinalizedBlock(ctx context.Context) error {
+	nft_tracker.mu.RLock()
+	if len(nft_tracker.checkpoints) == 0 {
+		nft_tracker.mu.RUnlock()
+		return nil
+	}
+	last := nft_tracker.checkpoints[len(nft_tracker.checkpoints)-1]
+	nft_tracker.mu.RUnlock()
+	blockHash, err := nft_tracker.source.BlockHash(ctx, int(last.height))
+	if err != nil {
+		return err
+	}
+	if blockHash != "" && !strings.EqualFold(blockHash, last.blockHash) {
+		return fmt.Errorf("%w: block %d is now %s", ErrReorg, last.height, blockHash)
+	}
+	return nil
+}
+
+// Check the finalized block is still on the source's chain. If it isn't, find the latest checkpoint that is and
+// roll the tracker back to it. Returns true if the tracker was rolled back, StartTracking then rescans from the fork.
+func (nft_tracker *Tracker) handleReorg(ctx context.Context) (bool, error) {
+	nft_tracker.mu.RLock()
+	checkpoints := append([]checkpoint{}, nft_tracker.checkpoints...)
+	nft_tracker.mu.RUnlock()
+	if len(checkpoints) == 0 {
+		return false, nil
+	}
+
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		blockHash, err := nft_tracker.source.BlockHash(ctx, int(checkpoints[i].height))
+		if err != nil {
+			return false, err
+		}
+		if blockHash == "" {
+			return false, nil // The source doesn't know this block's hash, eg. a static export.
+		}
+		if strings.EqualFold(blockHash, checkpoints[i].blockHash) {
+			if i == len(checkpoints)-1 {
+				return false, nil // No reorg.
+			}
+			nft_tracker.RollbackTo(checkpoints[i].height)
+			reorgsCounter.WithLabelValues(nft_tracker.contractLabel()).Inc()
+			return true, nil
+		}
+	}
+	// Reorged deeper than the checkpoints kept, rescan everything.
+	nft_tracker.RollbackTo(int64(nft_tracker.trackedEvent.deployBlock) - 1)
+	reorgsCounter.WithLabelValues(nft_tracker.contractLabel()).Inc()
+	return true, nil
+}
+
+// Discard all redeem events after an Ethereum height and set the finalized height back to it, eg. after a reorg.
+// Rolling forward is not possible, heights at or above the finalized height are ignored.
+func (nft_tracker *Tracker) RollbackTo(height int64) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	if height >= nft_tracker.finalizedHeight {
+		return
+	}
+	nft_tracker.publishChanges(nft_tracker.rollbackChanges(height))
+	kept := []Validator_RedeemEvent{}
+	for vpass := range nft_tracker.validatorList {
+		if nft_tracker.validatorList[vpass].redeemedBlockHeight > height {
+			break // Ordered list, the rest is past the rollback height.
+		}
+		kept = append(kept, nft_tracker.validatorList[vpass])
+	}
+	if removed := len(nft_tracker.validatorList) - len(kept); removed > 0 {
+		nft_tracker.logger.Warn("Rolled back redeem events after a reorg", "removed", removed, "height", height)
+	}
+
+	nft_tracker.validatorList = []Validator_RedeemEvent{}
+	nft_tracker.tokenIdMap = map[string][]Validator_RedeemEvent{}
+	nft_tracker.addressMap = map[string][]Validator_RedeemEvent{}
+	nft_tracker.nodeIdMap = map[string][]Validator_RedeemEvent{}
+	nft_tracker.seenLogs = map[string]struct{}{}
+	for vpass := range kept {
+		nft_tracker.ingestRedeem(kept[vpass])
+	}
+
+	nft_tracker.finalizedHeight = height
+	nft_tracker.finalizedBlockHash = ""
+	for len(nft_tracker.checkpoints) > 0 {
+		last := nft_tracker.checkpoints[len(nft_tracker.checkpoints)-1]
+		if last.height <= height {
+			if last.height == height {
+				nft_tracker.finalizedBlockHash = last.blockHash
+			}
+			break
+		}
+		nft_tracker.checkpoints = nft_tracker.checkpoints[:len(nft_tracker.checkpoints)-1]
+	}
+	nft_tracker.updateStateMetrics()
+}
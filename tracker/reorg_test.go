@@ -0,0 +1,96 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+)
+
+func TestReorgRollsBackToForkPoint(t *testing.T) {
+	const (
+		addressA = "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"
+		addressC = "0x2175091590317500000000000000000000000000000000000000000000000000"
+	)
+	// A contract of its own, so other tests don't change the reorg metric.
+	contract := "0x00000000000000000000000000000000000000BB"
+	redeemLog := func(cometAddress string) []rpctest.Log {
+		return []rpctest.Log{{Address: contract, Topics: []string{RedeemEvent.EventSignature, sepoliaRedeems[0].tokenId}, Data: cometAddress}}
+	}
+	server := rpctest.NewServer(100)
+	defer server.Close()
+	trackerobj := NewTracker(server.URL(), 0, NewRedeemEvent(redeemed, contract, 90))
+	if _, err := trackerobj.FindRedeems(context.Background(), trackerobj.resumeBlock(), 100); err != nil {
+		t.Fatal(err)
+	}
+	server.MineBlock(redeemLog(addressA)...)
+	if _, err := trackerobj.FindRedeems(context.Background(), trackerobj.resumeBlock(), int(server.Mine(2))); err != nil {
+		t.Fatal(err)
+	}
+	if !VerifyAddress(addressA, trackerobj) {
+		t.Fatal("redeem not found before the reorg")
+	}
+
+	// Replace blocks 101 to 103: token 1 is redeemed for address C instead, and the new chain is one block longer.
+	head := server.Reorg(3, redeemLog(addressC), nil, nil, nil)
+	if err := trackerobj.checkFinalizedBlock(context.Background()); !errors.Is(err, ErrReorg) {
+		t.Fatalf("reorg check returned %v", err)
+	}
+	// The scanned chain is not extended with blocks from another chain.
+	if _, err := trackerobj.FindRedeems(context.Background(), trackerobj.resumeBlock(), int(head)); !errors.Is(err, ErrReorg) || trackerobj.FinalizedHeight() != 103 {
+		t.Fatalf("search across the reorg returned %v at height %d", err, trackerobj.FinalizedHeight())
+	}
+
+	// Block 100 is the latest checkpoint still on the chain.
+	if reorged, err := trackerobj.handleReorg(context.Background()); err != nil || !reorged {
+		t.Fatalf("reorg handled %t, %v", reorged, err)
+	}
+	if trackerobj.FinalizedHeight() != 100 || len(trackerobj.validatorList) != 0 {
+		t.Fatalf("rolled back to %d keeping %d redeems, want 100 and none", trackerobj.FinalizedHeight(), len(trackerobj.validatorList))
+	}
+	if _, err := trackerobj.FindRedeems(context.Background(), trackerobj.resumeBlock(), int(head)); err != nil {
+		t.Fatal(err)
+	}
+	if VerifyAddress(addressA, trackerobj) || !VerifyAddress(addressC, trackerobj) {
+		t.Error("rescan after the reorg did not replace the redeem")
+	}
+	if reorged, err := trackerobj.handleReorg(context.Background()); err != nil || reorged {
+		t.Errorf("reorg handled %t, %v on an unchanged chain", reorged, err)
+	}
+
+	// A reorg below every checkpoint rolls back to before the deploy block, everything is searched again.
+	server.Reorg(10, make([][]rpctest.Log, 10)...)
+	if reorged, err := trackerobj.handleReorg(context.Background()); err != nil || !reorged {
+		t.Fatalf("deep reorg handled %t, %v", reorged, err)
+	}
+	if trackerobj.FinalizedHeight() != 89 || len(trackerobj.validatorList) != 0 {
+		t.Errorf("deep reorg rolled back to %d keeping %d redeems", trackerobj.FinalizedHeight(), len(trackerobj.validatorList))
+	}
+}
+
+func TestRollbackTo(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		trackerobj.ingestRedeem(event)
+	}
+	trackerobj.setFinalizedHeight(0x14, "0xb10c")
+	trackerobj.RollbackTo(0x20) // Rolling forward does nothing.
+	if trackerobj.FinalizedHeight() != 0x14 || len(trackerobj.validatorList) != 3 {
+		t.Fatal("rollback past the finalized height changed the tracker")
+	}
+
+	trackerobj.RollbackTo(0x11)
+	if trackerobj.FinalizedHeight() != 0x11 || len(trackerobj.validatorList) != 2 {
+		t.Fatalf("rolled back to %d keeping %d redeems", trackerobj.FinalizedHeight(), len(trackerobj.validatorList))
+	}
+	// Token 1 is bound to its address before the rolled back re-redeem again.
+	if !VerifyAddress("0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", trackerobj) ||
+		VerifyAddress("0x2175091590317500000000000000000000000000000000000000000000000000", trackerobj) {
+		t.Error("rollback did not restore the earlier binding")
+	}
+	// Rolled back logs can be ingested again once the chain includes them.
+	if !trackerobj.ingestRedeem(stateHashEvents()[2]) {
+		t.Error("rolled back redeem is still marked as seen")
+	}
+}
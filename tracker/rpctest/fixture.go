@@ -0,0 +1,232 @@
+package rpctest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// RPC FIXTURES
+
+// One JSON-RPC request and the response it got, as raw bytes.
+type Interaction struct {
+	Request  string `json:"request"`
+	Status   int    `json:"status"`
+	Response string `json:"response"`
+}
+
+// RPC traffic recorded against a provider, in the order it was sent.
+type Fixture struct {
+	URL          string        `json:"url"` // Provider the traffic was recorded against, for reference only
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Read a fixture file.
+func LoadFixture(path string) (*Fixture, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixture := &Fixture{}
+	if err := json.Unmarshal(encoded, fixture); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %w", path, err)
+	}
+	return fixture, nil
+}
+
+// Write the fixture to a file.
+func (fixture *Fixture) Save(path string) error {
+	encoded, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(encoded, '\n'), 0o644)
+}
+
+// An http.RoundTripper that passes requests to a provider and records the traffic.
+// Pass it to the tracker's JSON-RPC source with an http.Client, see NewJsonRpcSourceWithHTTPClient.
+type Recorder struct {
+	transport http.RoundTripper
+	mu        sync.Mutex
+	fixture   Fixture
+}
+
+// Record traffic sent through a transport, http.DefaultTransport if nil.
+func NewRecorder(url string, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{transport: transport, fixture: Fixture{URL: url, Interactions: []Interaction{}}}
+}
+
+func (recorder *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := recorder.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err // Transport errors are not recorded, there is no response to replay.
+	}
+	resBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.fixture.Interactions = append(recorder.fixture.Interactions, Interaction{
+		Request:  string(body),
+		Status:   res.StatusCode,
+		Response: string(resBody),
+	})
+	return res, nil
+}
+
+// A copy of the traffic recorded so far.
+func (recorder *Recorder) Fixture() *Fixture {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return &Fixture{URL: recorder.fixture.URL, Interactions: append([]Interaction{}, recorder.fixture.Interactions...)}
+}
+
+// Write the traffic recorded so far to a fixture file.
+func (recorder *Recorder) Save(path string) error {
+	return recorder.Fixture().Save(path)
+}
+
+// An http.RoundTripper that answers requests from a fixture without contacting the provider.
+//
+// Requests are matched by method and params, ignoring the JSON-RPC id, and each recorded interaction is
+// replayed once, in recorded order. Responses are replayed byte for byte, except that the id is rewritten
+// if the client numbered its requests differently from the recording. Requests without a recorded
+// response get a JSON-RPC error and are listed by Unmatched.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+	unmatched    []string
+}
+
+func NewReplayer(fixture *Fixture) *Replayer {
+	return &Replayer{interactions: fixture.Interactions, used: make([]bool, len(fixture.Interactions))}
+}
+
+// Load a fixture file for replay.
+func LoadReplayer(path string) (*Replayer, error) {
+	fixture, err := LoadFixture(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReplayer(fixture), nil
+}
+
+func (replayer *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	key, id := callKey(body)
+
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+	for i, interaction := range replayer.interactions {
+		recordedKey, recordedId := callKey([]byte(interaction.Request))
+		if replayer.used[i] || recordedKey != key {
+			continue
+		}
+		replayer.used[i] = true
+		response := []byte(interaction.Response)
+		if !bytes.Equal(id, recordedId) {
+			response = withId(response, id)
+		}
+		return httpResponse(req, interaction.Status, response), nil
+	}
+	replayer.unmatched = append(replayer.unmatched, string(body))
+	unmatched, _ := json.Marshal(response{JsonRpc: "2.0", Id: id, Error: &Error{Code: -32603, Message: "no recorded response for " + key}})
+	return httpResponse(req, http.StatusOK, unmatched), nil
+}
+
+// Requests that had no recorded response.
+func (replayer *Replayer) Unmatched() []string {
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+	return append([]string{}, replayer.unmatched...)
+}
+
+// Recorded interactions that haven't been replayed.
+func (replayer *Replayer) Remaining() int {
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+	remaining := 0
+	for _, used := range replayer.used {
+		if !used {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Identify a call by its method and params, and return its id. Batches and unparseable bodies are matched as a whole.
+func callKey(body []byte) (string, json.RawMessage) {
+	call := struct {
+		Id     json.RawMessage `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}{}
+	if json.Unmarshal(body, &call) != nil || call.Method == "" {
+		return string(body), nil
+	}
+	params := bytes.Buffer{}
+	if json.Compact(&params, call.Params) != nil {
+		params.Write(call.Params)
+	}
+	return call.Method + params.String(), call.Id
+}
+
+// Replace the id of a single JSON-RPC response.
+func withId(response []byte, id json.RawMessage) []byte {
+	fields := map[string]json.RawMessage{}
+	if id == nil || json.Unmarshal(response, &fields) != nil {
+		return response
+	}
+	fields["id"] = id
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return response
+	}
+	return append(encoded, '\n')
+}
+
+func httpResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
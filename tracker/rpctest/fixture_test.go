@@ -0,0 +1,65 @@
+package rpctest
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := NewServer(100)
+	server.MineBlock(Log{Address: "0x8d64ab58a17da7d8788367549c513386f09a0a70", Topics: []string{testSignature, "0x01"}, Data: "0xaa"})
+	server.FailNext("eth_getLogs", ErrRangeTooWide)
+
+	recorder := NewRecorder(server.URL(), nil)
+	client, err := rpc.DialOptions(context.Background(), server.URL(), rpc.WithHTTPClient(&http.Client{Transport: recorder}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var head string
+	client.Call(&head, "eth_blockNumber")
+	if _, err := getLogs(client, "0x64", "0x65"); err == nil {
+		t.Fatal("injected error was not returned")
+	}
+	recorded, _ := getLogs(client, "0x64", "0x65")
+	client.Close()
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	if err := recorder.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	// The provider is gone, a new client numbering its requests from 1 again gets the recorded answers.
+	replayer, err := LoadReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = rpc.DialOptions(context.Background(), "http://replay.invalid", rpc.WithHTTPClient(&http.Client{Transport: replayer}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := getLogs(client, "0x64", "0x65"); err == nil {
+		t.Error("recorded error was not replayed first")
+	}
+	logs, err := getLogs(client, "0x64", "0x65")
+	if err != nil || len(logs) != 1 || len(recorded) != 1 || logs[0].LogIndex != recorded[0].LogIndex {
+		t.Fatalf("replayed logs %+v, %v", logs, err)
+	}
+	var replayedHead string
+	if err := client.Call(&replayedHead, "eth_blockNumber"); err != nil || replayedHead != head {
+		t.Errorf("replayed head %s, %v, recorded %s", replayedHead, err, head)
+	}
+	if replayer.Remaining() != 0 || len(replayer.Unmatched()) != 0 {
+		t.Fatal("replay did not use the fixture exactly")
+	}
+	if err := client.Call(&replayedHead, "eth_blockNumber"); err == nil {
+		t.Error("call without a recorded response succeeded")
+	}
+	if len(replayer.Unmatched()) != 1 {
+		t.Error("unmatched call was not reported")
+	}
+}
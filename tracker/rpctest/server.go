@@ -0,0 +1,483 @@
+// Package rpctest provides an in-process Ethereum JSON-RPC server for testing the tracker offline.
+//
+// The server answers eth_blockNumber, eth_getLogs, eth_getBlockByNumber, eth_getBlockByHash, eth_getCode,
+// eth_chainId and net_version from scripted chain data. Tests can mine blocks with logs, inject errors, enforce eth_getLogs
+// range limits like public providers do, and reorganise the chain.
+package rpctest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// A log emitted on the scripted chain.
+// Block number, transaction hash and indexes are assigned by MineBlock when left empty.
+type Log struct {
+	Address          string
+	Topics           []string
+	Data             string
+	BlockNumber      uint64
+	TransactionHash  string
+	TransactionIndex uint64
+	LogIndex         uint64
+}
+
+// A JSON-RPC error returned to the client.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", err.Code, err.Message)
+}
+
+// Error returned for eth_getLogs requests wider than the range limit, worded like public providers.
+var ErrRangeTooWide = &Error{Code: -32005, Message: "block range is too wide"}
+
+// A scripted Ethereum chain served over JSON-RPC.
+type Server struct {
+	httpServer *httptest.Server
+	mu         sync.Mutex
+	chainId    uint64
+	head       uint64
+	logs       map[uint64][]Log  // Logs by block number
+	forks      map[uint64]uint64 // Number of times a block number was replaced by a reorg, changes its hash
+	rangeLimit uint64            // Maximum blocks per eth_getLogs request, 0 for unlimited
+	failures   map[string][]*Error
+	calls      map[string]int
+	codes      map[string]uint64 // Deploy block of contracts with code, by lowercase address
+}
+
+// Start a server with a chain whose head is at the given block. Blocks up to the head are empty.
+// The server must be stopped with Close.
+func NewServer(head uint64) *Server {
+	server := &Server{
+		chainId:  11155111, // Sepolia
+		head:     head,
+		logs:     map[uint64][]Log{},
+		forks:    map[uint64]uint64{},
+		failures: map[string][]*Error{},
+		calls:    map[string]int{},
+		codes:    map[string]uint64{},
+	}
+	server.httpServer = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	return server
+}
+
+// The URL to pass to the tracker as its RPC address.
+func (server *Server) URL() string {
+	return server.httpServer.URL
+}
+
+func (server *Server) Close() {
+	server.httpServer.Close()
+}
+
+// Set the chain ID returned by eth_chainId and net_version.
+func (server *Server) SetChainId(chainId uint64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.chainId = chainId
+}
+
+// Limit eth_getLogs to ranges of at most this many blocks, 0 removes the limit.
+func (server *Server) SetRangeLimit(blocks uint64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.rangeLimit = blocks
+}
+
+// Deploy a contract at an address in a block, eth_getCode returns code for it from that block on.
+func (server *Server) SetCode(address string, deployBlock uint64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.codes[strings.ToLower(address)] = deployBlock
+}
+
+// Make the next calls of a method fail with the given errors, in order.
+func (server *Server) FailNext(method string, errs ...*Error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.failures[method] = append(server.failures[method], errs...)
+}
+
+// The number of times a method has been called.
+func (server *Server) Calls(method string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.calls[method]
+}
+
+// The current head block number.
+func (server *Server) Head() uint64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.head
+}
+
+// Mine empty blocks and return the new head.
+func (server *Server) Mine(blocks uint64) uint64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.head += blocks
+	return server.head
+}
+
+// Mine a block containing the logs and return its number.
+func (server *Server) MineBlock(logs ...Log) uint64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.head++
+	server.addLogs(server.head, logs)
+	return server.head
+}
+
+// Add logs to an existing block, eg. to script historical events below the head.
+func (server *Server) AddLogs(blockNumber uint64, logs ...Log) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if blockNumber > server.head {
+		server.head = blockNumber
+	}
+	server.addLogs(blockNumber, logs)
+}
+
+// Fill in the position of each log in the block. The caller must hold the server lock.
+func (server *Server) addLogs(blockNumber uint64, logs []Log) {
+	for _, log := range logs {
+		log.BlockNumber = blockNumber
+		log.LogIndex = uint64(len(server.logs[blockNumber]))
+		if log.TransactionHash == "" {
+			log.TransactionIndex = log.LogIndex
+			log.TransactionHash = hashOf("tx", blockNumber, server.forks[blockNumber], log.LogIndex)
+		}
+		server.logs[blockNumber] = append(server.logs[blockNumber], log)
+	}
+}
+
+// Reorganise the chain: drop the last depth blocks and mine replacement blocks, one per entry in blocks.
+// Replaced block numbers get new hashes, so trackers can detect the reorg by comparing block hashes.
+func (server *Server) Reorg(depth uint64, blocks ...[]Log) uint64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	forkPoint := server.head - depth
+	for blockNumber := forkPoint + 1; blockNumber <= server.head; blockNumber++ {
+		delete(server.logs, blockNumber)
+		server.forks[blockNumber]++
+	}
+	server.head = forkPoint
+	for _, logs := range blocks {
+		server.head++
+		server.addLogs(server.head, logs)
+	}
+	return server.head
+}
+
+// The hash of a block on the current chain.
+func (server *Server) BlockHash(blockNumber uint64) string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.blockHash(blockNumber)
+}
+
+func (server *Server) blockHash(blockNumber uint64) string {
+	return hashOf("block", blockNumber, server.forks[blockNumber], 0)
+}
+
+// Deterministic hash for scripted chain objects.
+func hashOf(kind string, blockNumber uint64, fork uint64, index uint64) string {
+	preimage := binary.BigEndian.AppendUint64([]byte(kind), blockNumber)
+	preimage = binary.BigEndian.AppendUint64(preimage, fork)
+	preimage = binary.BigEndian.AppendUint64(preimage, index)
+	return fmt.Sprintf("0x%x", crypto.Keccak256(preimage))
+}
+
+// JSON-RPC HANDLING
+
+type request struct {
+	JsonRpc string            `json:"jsonrpc"`
+	Id      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		requests := []request{}
+		if err := json.Unmarshal(body, &requests); err != nil {
+			json.NewEncoder(w).Encode(response{JsonRpc: "2.0", Error: &Error{Code: -32700, Message: err.Error()}})
+			return
+		}
+		responses := make([]response, len(requests))
+		for i := range requests {
+			responses[i] = server.handle(requests[i])
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+	req := request{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		json.NewEncoder(w).Encode(response{JsonRpc: "2.0", Error: &Error{Code: -32700, Message: err.Error()}})
+		return
+	}
+	json.NewEncoder(w).Encode(server.handle(req))
+}
+
+func (server *Server) handle(req request) response {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	res := response{JsonRpc: "2.0", Id: req.Id}
+	server.calls[req.Method]++
+	if failures := server.failures[req.Method]; len(failures) > 0 {
+		res.Error = failures[0]
+		server.failures[req.Method] = failures[1:]
+		return res
+	}
+	var result interface{}
+	var err *Error
+	switch req.Method {
+	case "eth_blockNumber":
+		result = hexUint(server.head)
+	case "eth_chainId":
+		result = hexUint(server.chainId)
+	case "net_version":
+		result = strconv.FormatUint(server.chainId, 10)
+	case "eth_getBlockByNumber":
+		result, err = server.getBlockByNumber(req.Params)
+	case "eth_getBlockByHash":
+		result, err = server.getBlockByHash(req.Params)
+	case "eth_getLogs":
+		result, err = server.getLogs(req.Params)
+	case "eth_getCode":
+		result, err = server.getCode(req.Params)
+	default:
+		err = &Error{Code: -32601, Message: fmt.Sprintf("the method %s does not exist/is not available", req.Method)}
+	}
+	if err != nil {
+		res.Error = err
+		return res
+	}
+	// A null result is still a result, it is encoded as "result": null rather than omitted.
+	res.Result, _ = json.Marshal(result)
+	return res
+}
+
+func hexUint(value uint64) string {
+	return fmt.Sprintf("0x%x", value)
+}
+
+// Parse a block tag or hex number. The caller must hold the server lock.
+func (server *Server) parseBlock(raw json.RawMessage) (uint64, *Error) {
+	tag := ""
+	if err := json.Unmarshal(raw, &tag); err != nil {
+		return 0, &Error{Code: -32602, Message: "invalid block number"}
+	}
+	switch tag {
+	case "", "latest", "safe", "finalized", "pending":
+		return server.head, nil
+	case "earliest":
+		return 0, nil
+	}
+	blockNumber, err := strconv.ParseUint(tag, 0, 64)
+	if err != nil {
+		return 0, &Error{Code: -32602, Message: fmt.Sprintf("invalid block number %q", tag)}
+	}
+	return blockNumber, nil
+}
+
+// Partial block object, enough for trackers that read block numbers and hashes.
+func (server *Server) block(blockNumber uint64) map[string]interface{} {
+	parentHash := "0x0000000000000000000000000000000000000000000000000000000000000000"
+	if blockNumber > 0 {
+		parentHash = server.blockHash(blockNumber - 1)
+	}
+	return map[string]interface{}{
+		"number":       hexUint(blockNumber),
+		"hash":         server.blockHash(blockNumber),
+		"parentHash":   parentHash,
+		"timestamp":    hexUint(1700000000 + 12*blockNumber),
+		"transactions": []string{},
+	}
+}
+
+func (server *Server) getBlockByNumber(params []json.RawMessage) (interface{}, *Error) {
+	if len(params) == 0 {
+		return nil, &Error{Code: -32602, Message: "missing block number"}
+	}
+	blockNumber, err := server.parseBlock(params[0])
+	if err != nil {
+		return nil, err
+	}
+	if blockNumber > server.head {
+		return nil, nil // Unknown blocks are null, as on a real node.
+	}
+	return server.block(blockNumber), nil
+}
+
+func (server *Server) getBlockByHash(params []json.RawMessage) (interface{}, *Error) {
+	hash := ""
+	if len(params) == 0 || json.Unmarshal(params[0], &hash) != nil {
+		return nil, &Error{Code: -32602, Message: "missing block hash"}
+	}
+	for blockNumber := server.head; ; blockNumber-- {
+		if strings.EqualFold(server.blockHash(blockNumber), hash) {
+			return server.block(blockNumber), nil
+		}
+		if blockNumber == 0 {
+			return nil, nil
+		}
+	}
+}
+
+func (server *Server) getCode(params []json.RawMessage) (interface{}, *Error) {
+	address := ""
+	if len(params) < 2 || json.Unmarshal(params[0], &address) != nil {
+		return nil, &Error{Code: -32602, Message: "missing address or block"}
+	}
+	blockNumber, err := server.parseBlock(params[1])
+	if err != nil {
+		return nil, err
+	}
+	if blockNumber > server.head {
+		return nil, &Error{Code: -32000, Message: "header not found"}
+	}
+	if deployBlock, exists := server.codes[strings.ToLower(address)]; exists && blockNumber >= deployBlock {
+		return "0x6080604052", nil
+	}
+	return "0x", nil
+}
+
+type logFilter struct {
+	FromBlock json.RawMessage `json:"fromBlock"`
+	ToBlock   json.RawMessage `json:"toBlock"`
+	Address   json.RawMessage `json:"address"`
+	Topics    []json.RawMessage
+	BlockHash string `json:"blockHash"`
+}
+
+// Decode a filter field that may be a single string, a list of strings or null.
+func stringOrList(raw json.RawMessage) []string {
+	single := ""
+	if json.Unmarshal(raw, &single) == nil {
+		if single == "" {
+			return nil
+		}
+		return []string{single}
+	}
+	list := []string{}
+	json.Unmarshal(raw, &list)
+	return list
+}
+
+func matchesAny(value string, options []string) bool {
+	if len(options) == 0 {
+		return true
+	}
+	for _, option := range options {
+		if strings.EqualFold(value, option) {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) getLogs(params []json.RawMessage) (interface{}, *Error) {
+	filter := logFilter{}
+	if len(params) == 0 || json.Unmarshal(params[0], &filter) != nil {
+		return nil, &Error{Code: -32602, Message: "invalid filter"}
+	}
+	var fromBlock, toBlock uint64
+	var err *Error
+	if filter.BlockHash != "" {
+		block, _ := server.getBlockByHash([]json.RawMessage{json.RawMessage(strconv.Quote(filter.BlockHash))})
+		if block == nil {
+			return nil, &Error{Code: -32000, Message: "unknown block"}
+		}
+		fromBlock, _ = strconv.ParseUint(block.(map[string]interface{})["number"].(string), 0, 64)
+		toBlock = fromBlock
+	} else {
+		if fromBlock, err = server.parseBlock(filter.FromBlock); err != nil {
+			return nil, err
+		}
+		if toBlock, err = server.parseBlock(filter.ToBlock); err != nil {
+			return nil, err
+		}
+	}
+	if fromBlock > toBlock {
+		return nil, &Error{Code: -32000, Message: "invalid block range params"}
+	}
+	if server.rangeLimit > 0 && toBlock-fromBlock+1 > server.rangeLimit {
+		return nil, ErrRangeTooWide
+	}
+	toBlock = min(toBlock, server.head)
+
+	addresses := stringOrList(filter.Address)
+	topics := make([][]string, len(filter.Topics))
+	for i := range filter.Topics {
+		topics[i] = stringOrList(filter.Topics[i])
+	}
+	blockNumbers := []uint64{}
+	for blockNumber := range server.logs {
+		if blockNumber >= fromBlock && blockNumber <= toBlock {
+			blockNumbers = append(blockNumbers, blockNumber)
+		}
+	}
+	sort.Slice(blockNumbers, func(i, j int) bool { return blockNumbers[i] < blockNumbers[j] })
+
+	result := []map[string]interface{}{}
+	for _, blockNumber := range blockNumbers {
+		for _, log := range server.logs[blockNumber] {
+			if !matchesAny(log.Address, addresses) || !matchesTopics(log.Topics, topics) {
+				continue
+			}
+			result = append(result, map[string]interface{}{
+				"address":          log.Address,
+				"topics":           log.Topics,
+				"data":             log.Data,
+				"blockNumber":      hexUint(log.BlockNumber),
+				"blockHash":        server.blockHash(log.BlockNumber),
+				"transactionHash":  log.TransactionHash,
+				"transactionIndex": hexUint(log.TransactionIndex),
+				"logIndex":         hexUint(log.LogIndex),
+				"removed":          false,
+			})
+		}
+	}
+	return result, nil
+}
+
+func matchesTopics(logTopics []string, filterTopics [][]string) bool {
+	for i, options := range filterTopics {
+		if len(options) == 0 {
+			continue // null matches anything
+		}
+		if i >= len(logTopics) || !matchesAny(logTopics[i], options) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const testSignature = "0xb48e53b8a2bd8f09d38ed2cec2ad3b2bfafa6ac2b9c52ae3d5e6d8a0f7e3c5d0"
+
+func dial(t *testing.T, server *Server) *rpc.Client {
+	client, err := rpc.Dial(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+type testLog struct {
+	BlockNumber string   `json:"blockNumber"`
+	Topics      []string `json:"topics"`
+	LogIndex    string   `json:"logIndex"`
+}
+
+func getLogs(client *rpc.Client, fromBlock string, toBlock string) ([]testLog, error) {
+	logs := []testLog{}
+	err := client.CallContext(context.Background(), &logs, "eth_getLogs", map[string]interface{}{
+		"fromBlock": fromBlock,
+		"toBlock":   toBlock,
+		"address":   "0x8D64aB58a17dA7d8788367549c513386f09a0A70",
+		"topics":    []string{testSignature},
+	})
+	return logs, err
+}
+
+func TestServerScriptedChain(t *testing.T) {
+	server := NewServer(100)
+	defer server.Close()
+	client := dial(t, server)
+
+	redeem := Log{Address: "0x8d64ab58a17da7d8788367549c513386f09a0a70", Topics: []string{testSignature, "0x01"}, Data: "0xaa"}
+	other := Log{Address: "0x0000000000000000000000000000000000000001", Topics: []string{testSignature, "0x02"}, Data: "0xbb"}
+	block := server.MineBlock(redeem, other, redeem)
+
+	var head string
+	if err := client.Call(&head, "eth_blockNumber"); err != nil || head != "0x65" {
+		t.Fatalf("eth_blockNumber = %s, %v", head, err)
+	}
+	logs, err := getLogs(client, "0x64", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].BlockNumber != "0x65" || logs[1].LogIndex != "0x2" {
+		t.Fatalf("unexpected logs %+v", logs)
+	}
+
+	var missing map[string]interface{}
+	if err := client.Call(&missing, "eth_getBlockByNumber", "0x66", false); err != nil || missing != nil {
+		t.Errorf("block past the head returned %v, %v", missing, err)
+	}
+	var found struct {
+		Hash string `json:"hash"`
+	}
+	if err := client.Call(&found, "eth_getBlockByNumber", "0x65", false); err != nil || found.Hash != server.BlockHash(block) {
+		t.Errorf("block hash %s, want %s (%v)", found.Hash, server.BlockHash(block), err)
+	}
+}
+
+func TestServerFailuresAndLimits(t *testing.T) {
+	server := NewServer(100)
+	defer server.Close()
+	client := dial(t, server)
+
+	server.SetRangeLimit(5)
+	if _, err := getLogs(client, "0x1", "0x5"); err != nil {
+		t.Errorf("range at the limit failed: %v", err)
+	}
+	_, err := getLogs(client, "0x1", "0x6")
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) || rpcErr.ErrorCode() != ErrRangeTooWide.Code {
+		t.Errorf("range past the limit returned %v", err)
+	}
+
+	server.FailNext("eth_blockNumber", &Error{Code: -32000, Message: "header not found"})
+	var head string
+	if err := client.Call(&head, "eth_blockNumber"); err == nil {
+		t.Error("injected failure was not returned")
+	}
+	if err := client.Call(&head, "eth_blockNumber"); err != nil {
+		t.Errorf("failure was injected more than once: %v", err)
+	}
+	if server.Calls("eth_blockNumber") != 2 {
+		t.Errorf("counted %d eth_blockNumber calls", server.Calls("eth_blockNumber"))
+	}
+}
+
+func TestServerReorg(t *testing.T) {
+	server := NewServer(100)
+	defer server.Close()
+	client := dial(t, server)
+
+	redeem := Log{Address: "0x8d64ab58a17da7d8788367549c513386f09a0a70", Topics: []string{testSignature, "0x01"}, Data: "0xaa"}
+	server.MineBlock(redeem)
+	server.Mine(2)
+	replacedHash := server.BlockHash(101)
+	unchangedHash := server.BlockHash(100)
+
+	// Replace blocks 101-103 with two blocks, the redeem moves to block 102.
+	if head := server.Reorg(3, nil, []Log{redeem}); head != 102 {
+		t.Fatalf("head after reorg %d", head)
+	}
+	if server.BlockHash(101) == replacedHash || server.BlockHash(100) != unchangedHash {
+		t.Error("reorg did not replace exactly the dropped block hashes")
+	}
+	logs, err := getLogs(client, "0x64", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].BlockNumber != "0x66" {
+		t.Fatalf("logs after reorg %+v", logs)
+	}
+}
@@ -0,0 +1,279 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Creation code of a mock Validator Pass contract. Any call with calldata tokenId||payload emits
+// Redeemed(uint256 indexed tokenId, bytes32 payload), the event the real contract emits on redeem.
+func mockValidatorPassCode() []byte {
+	runtime := []byte{
+		0x60, 0x20, 0x35, // PUSH1 0x20 CALLDATALOAD: payload
+		0x60, 0x00, 0x52, // PUSH1 0x00 MSTORE
+		0x60, 0x00, 0x35, // PUSH1 0x00 CALLDATALOAD: tokenId topic
+		0x7f, // PUSH32 event signature topic
+	}
+	runtime = append(runtime, crypto.Keccak256([]byte(redeemed))...)
+	runtime = append(runtime,
+		0x60, 0x20, // PUSH1 0x20: data size
+		0x60, 0x00, // PUSH1 0x00: data offset
+		0xa2, // LOG2
+		0x00, // STOP
+	)
+	creation := []byte{
+		0x60, byte(len(runtime)), // PUSH1 runtime size
+		0x80,       // DUP1
+		0x60, 0x0b, // PUSH1 runtime offset, the length of this creation prefix
+		0x60, 0x00, // PUSH1 0x00
+		0x39,       // CODECOPY
+		0x60, 0x00, // PUSH1 0x00
+		0xf3, // RETURN
+	}
+	return append(creation, runtime...)
+}
+
+// A simulated chain with a deployed mock Validator Pass contract.
+type simulatedChain struct {
+	t        *testing.T
+	backend  *simulated.Backend
+	key      *ecdsa.PrivateKey
+	nonce    uint64
+	tip      int64 // Raised with every transaction, so transactions from reorged out blocks are replaced
+	contract common.Address
+	deployed int64  // Block the contract was deployed in
+	rpcURL   string // HTTP JSON-RPC endpoint of the node, read by the tracker as it would read a real node
+}
+
+// Serve a node's JSON-RPC API over HTTP by forwarding each call to an RPC client connected to it.
+func rpcProxy(client *rpc.Client) http.Handler {
+	type request struct {
+		Id     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	type rpcError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	type response struct {
+		Version string          `json:"jsonrpc"`
+		Id      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result,omitempty"`
+		Error   *rpcError       `json:"error,omitempty"`
+	}
+	call := func(ctx context.Context, req request) response {
+		params := make([]any, len(req.Params))
+		for i := range req.Params {
+			params[i] = req.Params[i]
+		}
+		res := response{Version: "2.0", Id: req.Id}
+		if err := client.CallContext(ctx, &res.Result, req.Method, params...); err != nil {
+			res.Error = &rpcError{Code: -32000, Message: err.Error()}
+		}
+		if res.Error == nil && res.Result == nil {
+			res.Result = json.RawMessage("null")
+		}
+		return res
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := json.RawMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		batch := []request{}
+		if json.Unmarshal(body, &batch) == nil {
+			responses := []response{}
+			for _, req := range batch {
+				responses = append(responses, call(r.Context(), req))
+			}
+			json.NewEncoder(w).Encode(responses)
+			return
+		}
+		req := request{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(call(r.Context(), req))
+	})
+}
+
+func newSimulatedChain(t *testing.T) *simulatedChain {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	// The node's own HTTP server would need a free port picked up front, which races with other tests. It listens on a
+	// socket in the test's directory instead, served over HTTP on a listener httptest owns.
+	ipcPath := filepath.Join(t.TempDir(), "node.ipc")
+	backend := simulated.NewBackend(types.GenesisAlloc{from: {Balance: big.NewInt(1e18)}}, func(nodeConf *node.Config, ethConf *ethconfig.Config) {
+		nodeConf.IPCPath = ipcPath
+	})
+	t.Cleanup(func() { backend.Close() })
+	client, err := rpc.Dial(ipcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	server := httptest.NewServer(rpcProxy(client))
+	t.Cleanup(server.Close)
+	chain := &simulatedChain{t: t, backend: backend, key: key, contract: crypto.CreateAddress(from, 0), rpcURL: server.URL}
+	chain.send(nil, mockValidatorPassCode())
+	chain.deployed = chain.commit()
+	return chain
+}
+
+func (chain *simulatedChain) send(to *common.Address, data []byte) {
+	chain.tip++
+	tx, err := types.SignNewTx(chain.key, types.LatestSignerForChainID(big.NewInt(1337)), &types.DynamicFeeTx{
+		ChainID:   big.NewInt(1337),
+		Nonce:     chain.nonce,
+		GasTipCap: big.NewInt(chain.tip * 1e9),
+		GasFeeCap: big.NewInt(chain.tip*1e9 + 1e11),
+		Gas:       200000,
+		To:        to,
+		Data:      data,
+	})
+	if err != nil {
+		chain.t.Fatal(err)
+	}
+	if err := chain.backend.Client().SendTransaction(context.Background(), tx); err != nil {
+		chain.t.Fatal(err)
+	}
+	chain.nonce++
+}
+
+// Redeem a token for a CometBFT address in the next block.
+func (chain *simulatedChain) redeem(tokenId int64, cometAddress string) {
+	calldata := common.BigToHash(big.NewInt(tokenId)).Bytes()
+	calldata = append(calldata, common.RightPadBytes(common.FromHex(cometAddress), payloadSize)...)
+	chain.send(&chain.contract, calldata)
+}
+
+// Mine a block and return its number.
+func (chain *simulatedChain) commit() int64 {
+	chain.backend.Commit()
+	head, err := chain.backend.Client().BlockNumber(context.Background())
+	if err != nil {
+		chain.t.Fatal(err)
+	}
+	return int64(head)
+}
+
+// Replace the chain from a block onwards, the next commit builds on its parent.
+func (chain *simulatedChain) reorgFrom(blockNumber int64) {
+	parent, err := chain.backend.Client().HeaderByNumber(context.Background(), big.NewInt(blockNumber-1))
+	if err != nil {
+		chain.t.Fatal(err)
+	}
+	if err := chain.backend.Fork(parent.Hash()); err != nil {
+		chain.t.Fatal(err)
+	}
+	nonce, err := chain.backend.Client().NonceAt(context.Background(), crypto.PubkeyToAddress(chain.key.PublicKey), parent.Number)
+	if err != nil {
+		chain.t.Fatal(err)
+	}
+	chain.nonce = nonce
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the tracker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Check the verify callbacks' answer for every address at every height from the deploy block to the finalized height.
+// active maps an address to the heights it should be authorised at.
+func assertActiveAt(t *testing.T, trackerobj *Tracker, fromHeight int64, active map[string]func(height int64) bool) {
+	t.Helper()
+	for height := fromHeight; height <= trackerobj.FinalizedHeight(); height++ {
+		for address, isActive := range active {
+			authorised, err := VerifyAddressAt(address, height, trackerobj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authorised != isActive(height) {
+				t.Errorf("VerifyAddressAt(%s, %d) = %t", address, height, authorised)
+			}
+		}
+	}
+}
+
+func TestSimulatedChain(t *testing.T) {
+	const addressA = "61A83A39C806449DDC66FEB6C86A1994456A8C8B"
+	const addressB = "2757295701725127590000000000000000000001"
+	const addressC = "2175091590317500000000000000000000000002"
+
+	chain := newSimulatedChain(t)
+	deployBlock := chain.deployed
+	chain.redeem(1, addressA)
+	redeemA := chain.commit()
+	chain.redeem(2, addressB)
+	redeemB := chain.commit()
+	chain.commit()
+
+	trackerobj := NewTracker(chain.rpcURL, 0, NewRedeemEvent(redeemed, chain.contract.Hex(), int(deployBlock)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trackerobj.StartTracking(ctx, 10*time.Millisecond, 0)
+	<-trackerobj.Synced()
+	if len(trackerobj.validatorList) != 2 {
+		t.Fatalf("historical search found %d redeems, want 2", len(trackerobj.validatorList))
+	}
+
+	// Re-redeeming token 1 moves it from address A to address C.
+	chain.redeem(1, addressC)
+	reRedeem := chain.commit()
+	head := chain.commit()
+	waitUntil(t, func() bool { return trackerobj.FinalizedHeight() == head })
+	assertActiveAt(t, trackerobj, deployBlock, map[string]func(int64) bool{
+		addressA: func(height int64) bool { return height >= redeemA && height < reRedeem },
+		addressB: func(height int64) bool { return height >= redeemB },
+		addressC: func(height int64) bool { return height >= reRedeem },
+	})
+	if valid := VerifyValidatorAddress(addressA, common.BigToHash(big.NewInt(1)).Hex(), trackerobj); valid {
+		t.Error("address A is still bound to token 1 after the re-redeem")
+	}
+
+	// Reorg out the re-redeem. On the new, longer chain token 2 is re-redeemed to address C instead.
+	chain.reorgFrom(reRedeem)
+	chain.redeem(2, addressC)
+	reorgRedeem := chain.commit()
+	chain.commit()
+	head = chain.commit()
+	headHash, _ := chain.backend.Client().HeaderByNumber(context.Background(), big.NewInt(head))
+	waitUntil(t, func() bool {
+		trackerobj.mu.RLock()
+		defer trackerobj.mu.RUnlock()
+		return trackerobj.finalizedBlockHash == headHash.Hash().Hex()
+	})
+	assertActiveAt(t, trackerobj, deployBlock, map[string]func(int64) bool{
+		addressA: func(height int64) bool { return height >= redeemA },
+		addressB: func(height int64) bool { return height >= redeemB && height < reorgRedeem },
+		addressC: func(height int64) bool { return height >= reorgRedeem },
+	})
+	if len(trackerobj.validatorList) != 3 {
+		t.Errorf("tracker holds %d redeems after the reorg, want 3", len(trackerobj.validatorList))
+	}
+}
@@ -0,0 +1,190 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SNAPSHOTS
+
+// Version of the snapshot format written by ExportSnapshot.
+const SnapshotVersion = 2
+
+// A point-in-time copy of the tracker, so new nodes can start from it instead of rescanning from the deploy block.
+// Events are stored in the eth_getLogs form and decoded again on import.
+type Snapshot struct {
+	Version         int              `json:"version"`
+	EventSignature  string           `json:"eventSignature"`
+	ContractAddress string           `json:"contractAddress"`
+	DeployBlock     int              `json:"deployBlock"`
+	Height          int64            `json:"height"`     // Last scanned block, all events up to it are included
+	BlockHash       string           `json:"blockHash"`  // Hash of the block at Height
+	StateHash       string           `json:"stateHash"`  // Hex encoded StateHashAt(Height)
+	EventsHash      string           `json:"eventsHash"` // Hex encoded EventsHashAt(Height), covers every event
+	Events          []RedeemEventRpc `json:"events"`
+	Attestations    []Attestation    `json:"attestations,omitempty"` // Signatures from nodes that reached the same state hash
+}
+
+var ErrSnapshotMismatch = errors.New("snapshot does not match tracker")
+
+var ErrSnapshotOutdated = errors.New("snapshot is older than the tracker's state")
+
+// Take a snapshot of all events up to the tracker's finalized height.
+func (nft_tracker *Tracker) Snapshot() (*Snapshot, error) {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	stateHash, err := nft_tracker.stateHashAt(nft_tracker.finalizedHeight)
+	if err != nil {
+		return nil, err
+	}
+	eventsHash, err := nft_tracker.eventsHashAt(nft_tracker.finalizedHeight)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{
+		Version:         SnapshotVersion,
+		EventSignature:  nft_tracker.trackedEvent.EventSignature,
+		ContractAddress: nft_tracker.trackedEvent.contractAddress,
+		DeployBlock:     nft_tracker.trackedEvent.deployBlock,
+		Height:          nft_tracker.finalizedHeight,
+		BlockHash:       nft_tracker.finalizedBlockHash,
+		StateHash:       hex.EncodeToString(stateHash),
+		EventsHash:      hex.EncodeToString(eventsHash),
+		Events:          []RedeemEventRpc{},
+	}
+	for vpass := range nft_tracker.validatorList {
+		if nft_tracker.validatorList[vpass].redeemedBlockHeight > nft_tracker.finalizedHeight {
+			break // Ordered list, the rest is past the snapshot height.
+		}
+		snapshot.Events = append(snapshot.Events, nft_tracker.validatorList[vpass].toLog(nft_tracker.trackedEvent))
+	}
+	return snapshot, nil
+}
+
+// Export a snapshot of the tracker to a JSON file. The file is replaced atomically.
+func (nft_tracker *Tracker) ExportSnapshot(path string) error {
+	snapshot, err := nft_tracker.Snapshot()
+	if err != nil {
+		return err
+	}
+	return snapshot.WriteFile(path)
+}
+
+// Write the snapshot to a JSON file, eg. after adding attestations. The file is replaced atomically.
+func (snapshot *Snapshot) WriteFile(path string) error {
+	encoded, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, encoded)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed.
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Read a snapshot from a JSON file without importing it.
+func ReadSnapshot(path string) (*Snapshot, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(encoded, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// Import a snapshot file into the tracker. StartTracking then continues from the snapshot height.
+func (nft_tracker *Tracker) ImportSnapshot(path string) error {
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	return nft_tracker.RestoreSnapshot(snapshot)
+}
+
+// Replace the tracker's state with a snapshot, after checking it is for the tracked event and deploy block, that none
+// of its events are past its height and that they produce the recorded events and state hashes. A snapshot older than
+// the tracker's finalized height is rejected with ErrSnapshotOutdated, rather than rewinding the tracker and its
+// published changes. The tracker is left unchanged if the snapshot is rejected.
+func (nft_tracker *Tracker) RestoreSnapshot(snapshot *Snapshot) error {
+	if snapshot.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d, expected %d", snapshot.Version, SnapshotVersion)
+	}
+	if !strings.EqualFold(snapshot.EventSignature, nft_tracker.trackedEvent.EventSignature) ||
+		!strings.EqualFold(snapshot.ContractAddress, nft_tracker.trackedEvent.contractAddress) {
+		return fmt.Errorf("%w: snapshot tracks %s on %s", ErrSnapshotMismatch, snapshot.EventSignature, snapshot.ContractAddress)
+	}
+	if snapshot.DeployBlock != nft_tracker.trackedEvent.deployBlock {
+		return fmt.Errorf("%w: snapshot starts at deploy block %d, not %d", ErrSnapshotMismatch, snapshot.DeployBlock, nft_tracker.trackedEvent.deployBlock)
+	}
+
+	restored := NewTrackerWithSource(nft_tracker.source, nft_tracker.rpcSearchLimit, nft_tracker.trackedEvent)
+	for _, log := range snapshot.Events {
+		if len(log.Topics) < 2 {
+			return fmt.Errorf("snapshot event in transaction %s has no tokenId topic", log.TransactionHash)
+		}
+		vRedeem := nft_tracker.trackedEvent.decodeLog(log)
+		if vRedeem.decodeErr != nil {
+			nft_tracker.logger.Warn("Could not decode snapshot event", append(redeemAttrs(*vRedeem), "err", vRedeem.decodeErr)...)
+		}
+		if vRedeem.redeemedBlockHeight > snapshot.Height {
+			return fmt.Errorf("snapshot event at block %d is past the snapshot height %d", vRedeem.redeemedBlockHeight, snapshot.Height)
+		}
+		if !restored.ingestRedeem(*vRedeem) {
+			return fmt.Errorf("snapshot event %s is included more than once", vRedeem.LogKey())
+		}
+	}
+	eventsHash, err := restored.eventsHashAt(snapshot.Height)
+	if err != nil {
+		return err
+	}
+	if recorded, err := hex.DecodeString(snapshot.EventsHash); err != nil || !bytes.Equal(recorded, eventsHash) {
+		return fmt.Errorf("snapshot events hash %s does not match its events (%x)", snapshot.EventsHash, eventsHash)
+	}
+	stateHash, err := restored.stateHashAt(snapshot.Height)
+	if err != nil {
+		return err
+	}
+	if recorded, err := hex.DecodeString(snapshot.StateHash); err != nil || !bytes.Equal(recorded, stateHash) {
+		return fmt.Errorf("snapshot state hash %s does not match its events (%x)", snapshot.StateHash, stateHash)
+	}
+
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	if snapshot.Height < nft_tracker.finalizedHeight {
+		return fmt.Errorf("%w: snapshot at block %d, tracker at block %d", ErrSnapshotOutdated, snapshot.Height, nft_tracker.finalizedHeight)
+	}
+	nft_tracker.validatorList = restored.validatorList
+	nft_tracker.tokenIdMap = restored.tokenIdMap
+	nft_tracker.addressMap = restored.addressMap
+	nft_tracker.nodeIdMap = restored.nodeIdMap
+	nft_tracker.seenLogs = restored.seenLogs
+	nft_tracker.publishChanges(nft_tracker.changesBetween(nft_tracker.finalizedHeight, snapshot.Height))
+	nft_tracker.finalizedHeight = snapshot.Height
+	nft_tracker.finalizedBlockHash = snapshot.BlockHash
+	nft_tracker.checkpoints = nil
+	nft_tracker.addCheckpoint(snapshot.Height, snapshot.BlockHash)
+	nft_tracker.updateStateMetrics()
+	return nil
+}
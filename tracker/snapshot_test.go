@@ -0,0 +1,130 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	trackedEvent := NewRedeemEvent(redeemed, contractAddress, 0)
+	source := NewTracker(rpcSource, 4, trackedEvent)
+	for i, event := range stateHashEvents() {
+		event.txHash = "0xfeed"
+		event.logIndex = int64(i)
+		source.ingestRedeem(event)
+	}
+	// An event past the finalized height is not part of the snapshot.
+	source.ingestRedeem(*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000003", "0x2757295701725127590000000000000000000000000000000000000000000000", "0x30"))
+	source.setFinalizedHeight(0x20, "0xb10c")
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := source.ExportSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewTracker(rpcSource, 4, trackedEvent)
+	if err := restored.ImportSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if restored.FinalizedHeight() != 0x20 || restored.resumeBlock() != 0x21 {
+		t.Errorf("restored tracker resumes from %d", restored.resumeBlock())
+	}
+	if len(restored.validatorList) != 3 {
+		t.Errorf("restored %d events, want 3", len(restored.validatorList))
+	}
+	sourceHash, _ := source.StateHashAt(0x20)
+	restoredHash, _, _ := restored.StateHash()
+	if !bytes.Equal(sourceHash, restoredHash) {
+		t.Error("restored state hash differs from the source")
+	}
+	if !VerifyAddress("0x2175091590317500000000000000000000000000000000000000000000000000", restored) {
+		t.Error("restored tracker lost the latest redeem")
+	}
+}
+
+func TestSnapshotRejectsTampering(t *testing.T) {
+	source := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		source.ingestRedeem(event)
+	}
+	source.setFinalizedHeight(0x20, "0xb10c")
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Events[0].Data = "0x1111111111111111111111111111111111111111000000000000000000000000"
+	encoded, _ := json.Marshal(snapshot)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, encoded, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewTracker(rpcSource, 4, RedeemEvent)
+	if err := restored.ImportSnapshot(path); err == nil {
+		t.Fatal("tampered snapshot was imported")
+	}
+	if len(restored.validatorList) != 0 || restored.FinalizedHeight() != 0 {
+		t.Error("rejected snapshot changed the tracker")
+	}
+
+	// Token 1's first redeem is superseded, so editing it leaves the state hash unchanged but not the events hash.
+	for name, tamper := range map[string]func(*Snapshot){
+		"historical payload": func(s *Snapshot) {
+			s.Events[1].Data = "0x1111111111111111111111111111111111111111000000000000000000000000"
+		},
+		"historical position":  func(s *Snapshot) { s.Events[1].LogIndex = "0x5" },
+		"duplicated event":     func(s *Snapshot) { s.Events = append(s.Events, s.Events[1]) },
+		"event past height":    func(s *Snapshot) { s.Height = 0x12 },
+		"missing events hash":  func(s *Snapshot) { s.EventsHash = "" },
+		"older format version": func(s *Snapshot) { s.Version = 1 },
+	} {
+		tampered, _ := source.Snapshot()
+		tamper(tampered)
+		if err := restored.RestoreSnapshot(tampered); err == nil {
+			t.Errorf("snapshot with a tampered %s was imported", name)
+		}
+	}
+	if len(restored.validatorList) != 0 || restored.FinalizedHeight() != 0 {
+		t.Error("rejected snapshot changed the tracker")
+	}
+
+	other := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, "0x0000000000000000000000000000000000000001", deployBlock))
+	if err := other.RestoreSnapshot(snapshot); err == nil {
+		t.Error("snapshot for another contract was imported")
+	}
+	// A snapshot searched from another deploy block may be missing earlier redeems.
+	otherDeploy := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, RedeemEvent.contractAddress, RedeemEvent.deployBlock+1))
+	if err := otherDeploy.RestoreSnapshot(snapshot); !errors.Is(err, ErrSnapshotMismatch) {
+		t.Errorf("snapshot for another deploy block restored with %v", err)
+	}
+}
+
+func TestSnapshotRejectsOlderState(t *testing.T) {
+	older := NewTracker(rpcSource, 4, RedeemEvent)
+	older.ingestRedeem(stateHashEvents()[0])
+	older.setFinalizedHeight(0x10, "0xb10c")
+	snapshot, err := older.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		running.ingestRedeem(event)
+	}
+	running.setFinalizedHeight(0x20, "0xb10d")
+	if err := running.RestoreSnapshot(snapshot); !errors.Is(err, ErrSnapshotOutdated) {
+		t.Fatalf("older snapshot restored with %v", err)
+	}
+	if running.FinalizedHeight() != 0x20 || len(running.validatorList) != 3 {
+		t.Error("rejected snapshot rewound the tracker")
+	}
+	// Restoring the state the tracker already has is allowed.
+	current, _ := running.Snapshot()
+	if err := running.RestoreSnapshot(current); err != nil {
+		t.Errorf("snapshot at the tracker's height rejected: %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// LOG SOURCES
+
+// Where the tracker reads redeem logs and chain heads from.
+// The JSON-RPC source talks to an Ethereum node, other sources let the tracker run from an indexer,
+// a vetted log export on an air-gapped validator, or scripted data in tests.
+type LogSource interface {
+	// The latest block number known to the source.
+	BlockNumber(ctx context.Context) (uint64, error)
+	// All logs of the tracked event emitted by its contract between fromBlock and toBlock, inclusive.
+	FetchLogs(ctx context.Context, event Rpc_RedeemEvent, fromBlock int, toBlock int) ([]RedeemEventRpc, error)
+	// The hash of a block, or an empty string if the source doesn't know block hashes.
+	BlockHash(ctx context.Context, blockNumber int) (string, error)
+}
+
+// JSON-RPC source, reading from an Ethereum node with eth_blockNumber, eth_getLogs and eth_getBlockByNumber.
+type JsonRpcSource struct {
+	rpcAddress string
+	httpClient *http.Client // Custom HTTP client for rpcAddress, eg. to record or replay traffic
+	mu         sync.Mutex
+	client     *rpc.Client
+}
+
+// Create a JSON-RPC source for an RPC URL. The connection is made on first use.
+func NewJsonRpcSource(rpcAddress string) *JsonRpcSource {
+	return &JsonRpcSource{rpcAddress: rpcAddress}
+}
+
+// Create a JSON-RPC source that sends HTTP requests with the given client, eg. one with a recording or
+// replaying transport from the rpctest package.
+func NewJsonRpcSourceWithHTTPClient(rpcAddress string, httpClient *http.Client) *JsonRpcSource {
+	return &JsonRpcSource{rpcAddress: rpcAddress, httpClient: httpClient}
+}
+
+// Create a JSON-RPC source on an existing client, eg. an in-process client attached to a node.
+func NewJsonRpcSourceFromClient(client *rpc.Client) *JsonRpcSource {
+	return &JsonRpcSource{client: client}
+}
+
+func (source *JsonRpcSource) rpcClient(ctx context.Context) (*rpc.Client, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if source.client == nil {
+		options := []rpc.ClientOption{}
+		if source.httpClient != nil {
+			options = append(options, rpc.WithHTTPClient(source.httpClient))
+		}
+		client, err := rpc.DialOptions(ctx, source.rpcAddress, options...)
+		if err != nil {
+			return nil, err
+		}
+		source.client = client
+	}
+	return source.client, nil
+}
+
+// Call a JSON-RPC method, recording its duration and errors in the RPC metrics.
+func (source *JsonRpcSource) call(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	endpoint := endpointLabel(source.rpcAddress)
+	start := time.Now()
+	err := func() error {
+		client, err := source.rpcClient(ctx)
+		if err != nil {
+			return err
+		}
+		return client.CallContext(ctx, result, method, args...)
+	}()
+	rpcDurationHistogram.WithLabelValues(method, endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrorsCounter.WithLabelValues(method, endpoint).Inc()
+	}
+	return err
+}
+
+// The RPC URL's scheme and host, see SyncStatus.
+func (source *JsonRpcSource) Endpoint() string {
+	return endpointLabel(source.rpcAddress)
+}
+
+// Close the connection to the RPC. The source reconnects if it is used again.
+func (source *JsonRpcSource) Close() {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if source.client != nil && source.rpcAddress != "" {
+		source.client.Close()
+		source.client = nil
+	}
+}
+
+func (source *JsonRpcSource) BlockNumber(ctx context.Context) (uint64, error) {
+	var blockNumber string
+	if err := source.call(ctx, &blockNumber, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(blockNumber, 0, 64)
+}
+
+func (source *JsonRpcSource) FetchLogs(ctx context.Context, event Rpc_RedeemEvent, fromBlock int, toBlock int) ([]RedeemEventRpc, error) {
+	// Build the RPC arguments for eth_getLogs
+	RpcArguments := map[string]interface{}{
+		"fromBlock": fmt.Sprintf("0x%x", fromBlock),
+		"toBlock":   fmt.Sprintf("0x%x", toBlock),
+		"address":   event.contractAddress,
+		"topics": []string{
+			event.EventSignature,
+		},
+	}
+	response := []RedeemEventRpc{}
+	if err := source.call(ctx, &response, "eth_getLogs", RpcArguments); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Only the hash is read from the response so this works with any RPC that returns partial block objects.
+func (source *JsonRpcSource) BlockHash(ctx context.Context, blockNumber int) (string, error) {
+	var block *struct {
+		Hash string `json:"hash"`
+	}
+	if err := source.call(ctx, &block, "eth_getBlockByNumber", fmt.Sprintf("0x%x", blockNumber), false); err != nil {
+		return "", err
+	}
+	if block == nil || block.Hash == "" {
+		return "", fmt.Errorf("block %d not found", blockNumber)
+	}
+	return block.Hash, nil
+}
+
+// Static source, serving logs from a vetted export file instead of a live chain.
+type StaticSource struct {
+	head      uint64
+	blockHash string
+	logs      []RedeemEventRpc
+}
+
+// Format of a log export file: the eth_getLogs entries and the block the export was taken at.
+type LogExport struct {
+	Head      uint64           `json:"head"`
+	BlockHash string           `json:"blockHash,omitempty"` // Hash of the head block, if known
+	Logs      []RedeemEventRpc `json:"logs"`
+}
+
+// Create a static source from logs held in memory, with the chain head at the given block.
+func NewStaticSource(head uint64, logs []RedeemEventRpc) *StaticSource {
+	return &StaticSource{head: head, logs: logs}
+}
+
+// Load a static source from a log export file. A plain JSON array of eth_getLogs entries is accepted as well,
+// in which case the head is the block of the last log.
+func LoadStaticSource(path string) (*StaticSource, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	export := LogExport{}
+	if strings.HasPrefix(strings.TrimSpace(string(encoded)), "[") {
+		err = json.Unmarshal(encoded, &export.Logs)
+	} else {
+		err = json.Unmarshal(encoded, &export)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid log export %s: %w", path, err)
+	}
+	for _, log := range export.Logs {
+		blockNumber, err := strconv.ParseUint(log.BlockNumber, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block number %q in log export %s", log.BlockNumber, path)
+		}
+		export.Head = max(export.Head, blockNumber)
+	}
+	return &StaticSource{head: export.Head, blockHash: export.BlockHash, logs: export.Logs}, nil
+}
+
+func (source *StaticSource) BlockNumber(ctx context.Context) (uint64, error) {
+	return source.head, nil
+}
+
+func (source *StaticSource) FetchLogs(ctx context.Context, event Rpc_RedeemEvent, fromBlock int, toBlock int) ([]RedeemEventRpc, error) {
+	return filterLogs(source.logs, event, fromBlock, toBlock), nil
+}
+
+func (source *StaticSource) BlockHash(ctx context.Context, blockNumber int) (string, error) {
+	if uint64(blockNumber) == source.head {
+		return source.blockHash, nil
+	}
+	return "", nil
+}
+
+// Select the logs of an event in a block range, as eth_getLogs would.
+func filterLogs(logs []RedeemEventRpc, event Rpc_RedeemEvent, fromBlock int, toBlock int) []RedeemEventRpc {
+	selected := []RedeemEventRpc{}
+	for _, log := range logs {
+		if log.Removed || len(log.Topics) == 0 || !strings.EqualFold(log.Topics[0], event.EventSignature) {
+			continue
+		}
+		if event.contractAddress != "" && !strings.EqualFold(log.Address, event.contractAddress) {
+			continue
+		}
+		blockNumber, err := strconv.ParseInt(log.BlockNumber, 0, 64)
+		if err != nil || blockNumber < int64(fromBlock) || blockNumber > int64(toBlock) {
+			continue
+		}
+		selected = append(selected, log)
+	}
+	return selected
+}
+
+// Replay source, revealing the blocks of another source gradually as if they were being produced live.
+// Every call to BlockNumber advances the head by a fixed number of blocks until the underlying head is reached.
+// Logs and hashes past the replayed head are hidden, so live tracking can be exercised against recorded data.
+type ReplaySource struct {
+	source LogSource
+	mu     sync.Mutex
+	head   uint64 // Last head returned by BlockNumber
+	next   uint64 // Head returned by the next BlockNumber call
+	step   uint64
+}
+
+// Replay a source starting with the head at startHead and advancing by step blocks per BlockNumber call.
+func NewReplaySource(source LogSource, startHead uint64, step uint64) *ReplaySource {
+	return &ReplaySource{source: source, head: startHead, next: startHead, step: step}
+}
+
+func (source *ReplaySource) BlockNumber(ctx context.Context) (uint64, error) {
+	underlyingHead, err := source.source.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	source.head = min(source.next, underlyingHead)
+	source.next = source.head + source.step
+	return source.head, nil
+}
+
+func (source *ReplaySource) replayedHead() int {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	return int(source.head)
+}
+
+func (source *ReplaySource) FetchLogs(ctx context.Context, event Rpc_RedeemEvent, fromBlock int, toBlock int) ([]RedeemEventRpc, error) {
+	toBlock = min(toBlock, source.replayedHead())
+	if toBlock < fromBlock {
+		return []RedeemEventRpc{}, nil
+	}
+	return source.source.FetchLogs(ctx, event, fromBlock, toBlock)
+}
+
+func (source *ReplaySource) BlockHash(ctx context.Context, blockNumber int) (string, error) {
+	if blockNumber > source.replayedHead() {
+		return "", fmt.Errorf("block %d not found", blockNumber)
+	}
+	return source.source.BlockHash(ctx, blockNumber)
+}
+
+// Failover source, reading from the first of several sources that answers, eg. JSON-RPC endpoints of different providers.
+// A source that fails is skipped until the sources after it fail too.
+type FailoverSource struct {
+	sources []LogSource
+	mu      sync.Mutex
+	current int // Index of the source that answered last
+}
+
+func NewFailoverSource(sources ...LogSource) *FailoverSource {
+	return &FailoverSource{sources: sources}
+}
+
+// Call each source in turn, starting with the one that answered last, until one succeeds.
+func (source *FailoverSource) try(call func(LogSource) error) error {
+	source.mu.Lock()
+	start := source.current
+	source.mu.Unlock()
+	errs := []error{}
+	for i := range source.sources {
+		index := (start + i) % len(source.sources)
+		err := call(source.sources[index])
+		if err == nil {
+			source.mu.Lock()
+			source.current = index
+			source.mu.Unlock()
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no sources to fail over between")
+	}
+	return fmt.Errorf("all %d sources failed: %w", len(source.sources), errors.Join(errs...))
+}
+
+// The endpoint of the source that answered last, empty if it isn't a remote source.
+func (source *FailoverSource) Endpoint() string {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if len(source.sources) == 0 {
+		return ""
+	}
+	if current, ok := source.sources[source.current].(endpointSource); ok {
+		return current.Endpoint()
+	}
+	return ""
+}
+
+func (source *FailoverSource) BlockNumber(ctx context.Context) (blockNumber uint64, err error) {
+	err = source.try(func(next LogSource) error {
+		blockNumber, err = next.BlockNumber(ctx)
+		return err
+	})
+	return blockNumber, err
+}
+
+func (source *FailoverSource) FetchLogs(ctx context.Context, event Rpc_RedeemEvent, fromBlock int, toBlock int) (logs []RedeemEventRpc, err error) {
+	err = source.try(func(next LogSource) error {
+		logs, err = next.FetchLogs(ctx, event, fromBlock, toBlock)
+		return err
+	})
+	return logs, err
+}
+
+func (source *FailoverSource) BlockHash(ctx context.Context, blockNumber int) (blockHash string, err error) {
+	err = source.try(func(next LogSource) error {
+		blockHash, err = next.BlockHash(ctx, blockNumber)
+		return err
+	})
+	return blockHash, err
+}
+
+// Retrying source, calling another source again when it fails, see WithRetries.
+type retrySource struct {
+	source   LogSource
+	attempts int           // Including the first
+	backoff  time.Duration // Wait after the first failure, doubled after each one
+	clock    Clock
+}
+
+func (source *retrySource) retry(ctx context.Context, call func() error) error {
+	backoff := source.backoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= source.attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-source.clock.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (source *retrySource) Endpoint() string {
+	if inner, ok := source.source.(endpointSource); ok {
+		return inner.Endpoint()
+	}
+	return ""
+}
+
+func (source *retrySource) BlockNumber(ctx context.Context) (blockNumber uint64, err error) {
+	err = source.retry(ctx, func() error {
+		blockNumber, err = source.source.BlockNumber(ctx)
+		return err
+	})
+	return blockNumber, err
+}
+
+func (source *retrySource) FetchLogs(ctx context.Context, event Rpc_RedeemEvent, fromBlock int, toBlock int) (logs []RedeemEventRpc, err error) {
+	err = source.retry(ctx, func() error {
+		logs, err = source.source.FetchLogs(ctx, event, fromBlock, toBlock)
+		return err
+	})
+	return logs, err
+}
+
+func (source *retrySource) BlockHash(ctx context.Context, blockNumber int) (blockHash string, err error) {
+	err = source.retry(ctx, func() error {
+		blockHash, err = source.source.BlockHash(ctx, blockNumber)
+		return err
+	})
+	return blockHash, err
+}
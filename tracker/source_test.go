@@ -0,0 +1,87 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sourceTestLogs() []RedeemEventRpc {
+	logs := []RedeemEventRpc{}
+	for i, payload := range []string{
+		"0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000",
+		"0x2757295701725127590000000000000000000000000000000000000000000000",
+		"0x2175091590317500000000000000000000000000000000000000000000000000",
+	} {
+		logs = append(logs, RedeemEventRpc{
+			Address:         contractAddress,
+			Topics:          []string{RedeemEvent.EventSignature, "0x000000000000000000000000000000000000000000000000000000000000000" + string(rune('1'+i))},
+			Data:            payload,
+			BlockNumber:     []string{"0xa", "0x14", "0x1e"}[i], // Blocks 10, 20 and 30
+			TransactionHash: "0x0" + string(rune('1'+i)),
+		})
+	}
+	// A log from another contract must be filtered out.
+	logs = append(logs, RedeemEventRpc{Address: "0x0000000000000000000000000000000000000001", Topics: logs[0].Topics, Data: logs[0].Data, BlockNumber: "0xb"})
+	return logs
+}
+
+func TestStaticSource(t *testing.T) {
+	dir := t.TempDir()
+	plain, _ := json.Marshal(sourceTestLogs())
+	export, _ := json.Marshal(LogExport{Head: 40, BlockHash: "0xb10c", Logs: sourceTestLogs()})
+	os.WriteFile(filepath.Join(dir, "plain.json"), plain, 0o644)
+	os.WriteFile(filepath.Join(dir, "export.json"), export, 0o644)
+
+	for name, wantHead := range map[string]uint64{"plain.json": 30, "export.json": 40} {
+		source, err := LoadStaticSource(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head, _ := source.BlockNumber(context.Background()); head != wantHead {
+			t.Errorf("%s: head %d, want %d", name, head, wantHead)
+		}
+		trackerobj := NewTrackerWithSource(source, 4, NewRedeemEvent(redeemed, contractAddress, 0))
+		found, err := trackerobj.FindRedeems(context.Background(), 0, int(wantHead))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != 3 {
+			t.Errorf("%s: found %d redeems, want 3", name, found)
+		}
+	}
+}
+
+func TestReplaySourceDrivesLiveTracking(t *testing.T) {
+	replay := NewReplaySource(NewStaticSource(30, sourceTestLogs()), 15, 10)
+	trackerobj := NewTrackerWithSource(replay, 4, NewRedeemEvent(redeemed, contractAddress, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		trackerobj.StartTracking(ctx, 10*time.Millisecond, 0)
+		close(done)
+	}()
+	<-trackerobj.Synced()
+
+	// Only the first redeem is revealed before the historical search finishes.
+	if !VerifyValidatorAddress(sourceTestLogs()[0].Data, sourceTestLogs()[0].Topics[1], trackerobj) {
+		t.Error("first redeem was not found in the historical search")
+	}
+	deadline := time.After(5 * time.Second)
+	for trackerobj.FinalizedHeight() < 30 {
+		select {
+		case <-deadline:
+			t.Fatalf("live tracking stopped at block %d", trackerobj.FinalizedHeight())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if !VerifyValidatorAddress(sourceTestLogs()[2].Data, sourceTestLogs()[2].Topics[1], trackerobj) {
+		t.Error("redeem revealed during live tracking was not found")
+	}
+	cancel()
+	<-done
+}
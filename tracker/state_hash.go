@@ -0,0 +1,145 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/cometbft/cometbft/crypto/merkle"
+)
+
+// AUTHORISED SET STATE HASH
+
+// Canonical 32 byte form of a tokenId, so "0x1" and "0x00..01" hash the same.
+func tokenIdBytes(tokenId string) ([]byte, error) {
+	tokenIdNumerical, ok := new(big.Int).SetString(tokenId, 0)
+	if !ok || tokenIdNumerical.Sign() < 0 || tokenIdNumerical.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid tokenId %q", tokenId)
+	}
+	return tokenIdNumerical.FillBytes(make([]byte, payloadSize)), nil
+}
+
+// Canonical form of a tokenId as it appears in redeem event topics, eg. "0x1" becomes "0x00..01".
+func CanonicalTokenId(tokenId string) (string, error) {
+	canonical, err := tokenIdBytes(tokenId)
+	if err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(canonical), nil
+}
+
+// The latest redeem event of every tokenId at an Ethereum height, ordered by tokenId. The caller must hold the tracker lock.
+func (nft_tracker *Tracker) activeBindingsAt(height int64) []Validator_RedeemEvent {
+	bindings := make([]Validator_RedeemEvent, 0, len(nft_tracker.tokenIdMap))
+	for _, tokenRedeems := range nft_tracker.tokenIdMap {
+		if latestEvent, exists := latestRedeemAt(tokenRedeems, height); exists {
+			bindings = append(bindings, latestEvent)
+		}
+	}
+	sort.Slice(bindings, func(i, j int) bool {
+		return compareTokenIds(bindings[i].tokenId, bindings[j].tokenId) < 0
+	})
+	return bindings
+}
+
+func compareTokenIds(a string, b string) int {
+	aBytes, aErr := tokenIdBytes(a)
+	bBytes, bErr := tokenIdBytes(b)
+	if aErr != nil || bErr != nil {
+		return bytes.Compare([]byte(a), []byte(b)) // Invalid tokenIds still need a stable order.
+	}
+	return bytes.Compare(aBytes, bBytes)
+}
+
+// Merkle leaf of a tokenId -> CometBFT address binding: the 32 byte tokenId followed by the 20 byte address.
+func bindingLeaf(binding Validator_RedeemEvent) ([]byte, error) {
+	leaf, err := tokenIdBytes(binding.tokenId)
+	if err != nil {
+		return nil, err
+	}
+	return append(leaf, binding.cometAddress...), nil
+}
+
+// Compute the Merkle root (RFC 6962, as used by CometBFT) of the active tokenId -> CometBFT address set at an Ethereum height.
+// The hash only depends on the bindings, not on the order events were ingested in, so two trackers that have
+// scanned past the height return the same hash. It is suitable for inclusion in the application's app hash.
+func (nft_tracker *Tracker) StateHashAt(height int64) ([]byte, error) {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	if height > nft_tracker.finalizedHeight {
+		return nil, ErrHeightNotFinalized
+	}
+	return nft_tracker.stateHashAt(height)
+}
+
+// Compute the state hash at the tracker's finalized height.
+func (nft_tracker *Tracker) StateHash() (hash []byte, height int64, err error) {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	hash, err = nft_tracker.stateHashAt(nft_tracker.finalizedHeight)
+	return hash, nft_tracker.finalizedHeight, err
+}
+
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) stateHashAt(height int64) ([]byte, error) {
+	bindings := nft_tracker.activeBindingsAt(height)
+	leaves := make([][]byte, len(bindings))
+	for i := range bindings {
+		leaf, err := bindingLeaf(bindings[i])
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	return merkle.HashFromByteSlices(leaves), nil
+}
+
+// Merkle leaf of a redeem event: its block, transaction index and log index as big endian uint64s, the 32 byte
+// tokenId, then the lowercase transaction hash and raw payload, each prefixed with its length.
+func eventLeaf(vRedeem Validator_RedeemEvent) ([]byte, error) {
+	tokenId, err := tokenIdBytes(vRedeem.tokenId)
+	if err != nil {
+		return nil, err
+	}
+	leaf := binary.BigEndian.AppendUint64(nil, uint64(vRedeem.redeemedBlockHeight))
+	leaf = binary.BigEndian.AppendUint64(leaf, uint64(vRedeem.txIndex))
+	leaf = binary.BigEndian.AppendUint64(leaf, uint64(vRedeem.logIndex))
+	leaf = append(leaf, tokenId...)
+	for _, field := range []string{strings.ToLower(vRedeem.txHash), strings.ToLower(vRedeem.validatorAddress)} {
+		leaf = binary.BigEndian.AppendUint32(leaf, uint32(len(field)))
+		leaf = append(leaf, field...)
+	}
+	return leaf, nil
+}
+
+// Compute the Merkle root of every redeem event up to an Ethereum height, in chain order. Unlike the state hash it
+// covers the full history: superseded redeems, positions, transaction hashes and raw payloads, and so the node IDs
+// decoded from them. Snapshots and attestations commit to it so none of their events can be changed.
+func (nft_tracker *Tracker) EventsHashAt(height int64) ([]byte, error) {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	if height > nft_tracker.finalizedHeight {
+		return nil, ErrHeightNotFinalized
+	}
+	return nft_tracker.eventsHashAt(height)
+}
+
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) eventsHashAt(height int64) ([]byte, error) {
+	leaves := [][]byte{}
+	for vpass := range nft_tracker.validatorList {
+		if nft_tracker.validatorList[vpass].redeemedBlockHeight > height {
+			break // Ordered list, the rest is past the height.
+		}
+		leaf, err := eventLeaf(nft_tracker.validatorList[vpass])
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, leaf)
+	}
+	return merkle.HashFromByteSlices(leaves), nil
+}
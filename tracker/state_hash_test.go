@@ -0,0 +1,107 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func stateHashEvents() []Validator_RedeemEvent {
+	return []Validator_RedeemEvent{
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000002", "0x2757295701725127590000000000000000000000000000000000000000000000", "0x10"),
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "0x11"),
+		*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", "0x2175091590317500000000000000000000000000000000000000000000000000", "0x14"),
+	}
+}
+
+func TestStateHashIsOrderIndependent(t *testing.T) {
+	events := stateHashEvents()
+	forward := NewTracker(rpcSource, 4, RedeemEvent)
+	backward := NewTracker(rpcSource, 4, RedeemEvent)
+	for i := range events {
+		forward.ingestRedeem(events[i])
+		backward.ingestRedeem(events[len(events)-1-i])
+	}
+	forward.setFinalizedHeight(0x20, "")
+	backward.setFinalizedHeight(0x20, "")
+
+	for _, height := range []int64{0x0f, 0x10, 0x11, 0x14, 0x20} {
+		forwardHash, err := forward.StateHashAt(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backwardHash, _ := backward.StateHashAt(height)
+		if !bytes.Equal(forwardHash, backwardHash) {
+			t.Errorf("state hash at %d depends on ingestion order", height)
+		}
+	}
+	if _, err := forward.StateHashAt(0x21); err != ErrHeightNotFinalized {
+		t.Errorf("state hash past the finalized height returned %v", err)
+	}
+}
+
+func TestEventsHashCoversHistory(t *testing.T) {
+	events := stateHashEvents()
+	forward := NewTracker(rpcSource, 4, RedeemEvent)
+	backward := NewTracker(rpcSource, 4, RedeemEvent)
+	for i := range events {
+		forward.ingestRedeem(events[i])
+		backward.ingestRedeem(events[len(events)-1-i])
+	}
+	forward.setFinalizedHeight(0x20, "")
+	backward.setFinalizedHeight(0x20, "")
+	forwardHash, err := forward.EventsHashAt(0x20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backwardHash, _ := backward.EventsHashAt(0x20); !bytes.Equal(forwardHash, backwardHash) {
+		t.Error("events hash depends on ingestion order")
+	}
+	if _, err := forward.EventsHashAt(0x21); err != ErrHeightNotFinalized {
+		t.Errorf("events hash past the finalized height returned %v", err)
+	}
+
+	// Changing a superseded redeem leaves the active set, and its state hash, as it was but not the events hash.
+	for _, change := range []func(*Validator_RedeemEvent){
+		func(vRedeem *Validator_RedeemEvent) {
+			vRedeem.validatorAddress = "0x2757295701725127590000000000000000000000000000000000000000000000"
+		},
+		func(vRedeem *Validator_RedeemEvent) { vRedeem.txHash = "0xfeed" },
+		func(vRedeem *Validator_RedeemEvent) { vRedeem.logIndex = 1 },
+	} {
+		changed := stateHashEvents()
+		change(&changed[1])
+		tampered := NewTracker(rpcSource, 4, RedeemEvent)
+		for _, event := range changed {
+			tampered.ingestRedeem(event)
+		}
+		tampered.setFinalizedHeight(0x20, "")
+		forwardState, _ := forward.StateHashAt(0x20)
+		tamperedState, _ := tampered.StateHashAt(0x20)
+		tamperedEvents, _ := tampered.EventsHashAt(0x20)
+		if !bytes.Equal(forwardState, tamperedState) || bytes.Equal(forwardHash, tamperedEvents) {
+			t.Errorf("changed superseded redeem %+v not covered by the events hash", changed[1])
+		}
+	}
+}
+
+func TestStateHashTracksActiveSet(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	for _, event := range stateHashEvents() {
+		trackerobj.ingestRedeem(event)
+	}
+	trackerobj.setFinalizedHeight(0x20, "")
+	beforeReRedeem, _ := trackerobj.StateHashAt(0x13)
+	afterReRedeem, _ := trackerobj.StateHashAt(0x14)
+	if bytes.Equal(beforeReRedeem, afterReRedeem) {
+		t.Error("re-redeem did not change the state hash")
+	}
+	// Token 1 moved back to the same address it held at 0x13 gives the same set as at 0x13.
+	trackerobj.ingestRedeem(*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "0x15"))
+	current, height, err := trackerobj.StateHash()
+	if err != nil || height != 0x20 {
+		t.Fatal(height, err)
+	}
+	if !bytes.Equal(current, beforeReRedeem) {
+		t.Error("state hash is not a function of the active set alone")
+	}
+}
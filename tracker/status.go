@@ -0,0 +1,113 @@
+package validatorpass_tracker
+
+import (
+	"time"
+)
+
+// SYNC STATUS
+
+// How far the tracker has synced with the chain, see Status.
+type SyncStatus struct {
+	DeployBlock     int64      `json:"deployBlock"`
+	ScannedHeight   int64      `json:"scannedHeight"` // Last block searched, ahead of FinalizedHeight while a search runs
+	ChainHead       int64      `json:"chainHead"`     // Latest block number read from the source, 0 before the first read
+	FinalizedHeight int64      `json:"finalizedHeight"`
+	Searching       bool       `json:"searching"`
+	BackfillPercent float64    `json:"backfillPercent"` // Of the running search, 100 when no search is running
+	ETA             Duration   `json:"eta"`             // Estimated time left in the running search
+	Endpoint        string     `json:"endpoint,omitempty"`
+	LastError       string     `json:"lastError,omitempty"` // Last error reading from the source, it is kept after later reads succeed
+	LastErrorAt     *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// A block search in progress.
+type search struct {
+	fromBlock int
+	toBlock   int
+	started   time.Time
+}
+
+// Sources that read from a remote endpoint, so the status can report which one is in use.
+type endpointSource interface {
+	// The endpoint's scheme and host, without paths and queries that often carry API keys.
+	Endpoint() string
+}
+
+// The tracker's sync status.
+func (nft_tracker *Tracker) Status() SyncStatus {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	return nft_tracker.status()
+}
+
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) status() SyncStatus {
+	status := SyncStatus{
+		DeployBlock:     int64(nft_tracker.trackedEvent.deployBlock),
+		ScannedHeight:   nft_tracker.finalizedHeight,
+		ChainHead:       nft_tracker.headHeight,
+		FinalizedHeight: nft_tracker.finalizedHeight,
+		BackfillPercent: 100,
+	}
+	if source, ok := nft_tracker.source.(endpointSource); ok {
+		status.Endpoint = source.Endpoint()
+	}
+	if nft_tracker.lastErr != nil {
+		status.LastError = nft_tracker.lastErr.Error()
+		lastErrAt := nft_tracker.lastErrAt
+		status.LastErrorAt = &lastErrAt
+	}
+	if current := nft_tracker.search; current != nil {
+		status.Searching = true
+		status.ScannedHeight = max(nft_tracker.scannedHeight, nft_tracker.finalizedHeight)
+		searched := float64(status.ScannedHeight-int64(current.fromBlock)+1) / float64(current.toBlock-current.fromBlock+1)
+		searched = min(max(searched, 0), 1)
+		status.BackfillPercent = searched * 100
+		if searched > 0 {
+			elapsed := nft_tracker.clock.Now().Sub(current.started)
+			status.ETA.Duration = time.Duration(float64(elapsed) * (1 - searched) / searched).Round(time.Second)
+		}
+	}
+	return status
+}
+
+// Call a function with the tracker's status as every window of a search is ingested and when the search ends,
+// eg. to show backfill progress. The function is called from the searching goroutine and must not block.
+// Pass nil to stop reporting progress.
+func (nft_tracker *Tracker) SetProgressFunc(progress func(SyncStatus)) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.progress = progress
+}
+
+// Record the progress of the running search, nil once it ends, and report it.
+func (nft_tracker *Tracker) recordSearch(current *search, scannedHeight int) {
+	nft_tracker.mu.Lock()
+	nft_tracker.search = current
+	nft_tracker.scannedHeight = int64(scannedHeight)
+	nft_tracker.lastActive = nft_tracker.clock.Now()
+	status, progress := nft_tracker.status(), nft_tracker.progress
+	nft_tracker.mu.Unlock()
+	backfillProgressGauge.WithLabelValues(nft_tracker.contractLabel()).Set(status.BackfillPercent / 100)
+	if progress != nil {
+		progress(status)
+	}
+}
+
+// Record an error reading from the source, for the status.
+func (nft_tracker *Tracker) recordError(err error) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	nft_tracker.lastErr = err
+	nft_tracker.lastErrAt = nft_tracker.clock.Now()
+}
+
+// A channel that is closed once the tracker has searched up to the chain head, by StartTracking's historical
+// search or by Backfill.
+func (nft_tracker *Tracker) Synced() <-chan struct{} {
+	return nft_tracker.synced
+}
+
+func (nft_tracker *Tracker) markSynced() {
+	nft_tracker.syncedOnce.Do(func() { close(nft_tracker.synced) })
+}
@@ -0,0 +1,59 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
+)
+
+func TestStatus(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	trackerobj := NewTracker(server.URL(), 50, NewRedeemEvent(redeemed, contractAddress, deployBlock))
+	reported := []SyncStatus{}
+	trackerobj.SetProgressFunc(func(status SyncStatus) {
+		reported = append(reported, status)
+	})
+
+	server.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	if _, err := trackerobj.Backfill(context.Background(), 20); err == nil {
+		t.Fatal("RPC failure was not returned")
+	}
+	status := trackerobj.Status()
+	if status.LastError == "" || status.LastErrorAt == nil || status.Searching || status.FinalizedHeight != 0 {
+		t.Errorf("status after a failed search: %+v", status)
+	}
+
+	reported = reported[:0]
+	if _, err := trackerobj.Backfill(context.Background(), 20); err != nil {
+		t.Fatal(err)
+	}
+	// The search starts at 0%, reports each window of 51 blocks, then reports that it ended.
+	toBlock := int64(sepoliaHead - 20)
+	if windows := int((toBlock - deployBlock + 51) / 51); len(reported) != windows+2 {
+		t.Fatalf("%d progress reports, want %d", len(reported), windows+2)
+	}
+	first, last := reported[0], reported[len(reported)-1]
+	if !first.Searching || first.BackfillPercent != 0 || first.ScannedHeight != deployBlock-1 {
+		t.Errorf("search started with %+v", first)
+	}
+	for i := 1; i < len(reported)-1; i++ {
+		if reported[i].BackfillPercent <= reported[i-1].BackfillPercent || reported[i].ScannedHeight <= reported[i-1].ScannedHeight {
+			t.Errorf("progress went from %+v to %+v", reported[i-1], reported[i])
+		}
+	}
+	if reported[len(reported)-2].BackfillPercent != 100 || reported[len(reported)-2].ScannedHeight != toBlock {
+		t.Errorf("last window reported as %+v", reported[len(reported)-2])
+	}
+	if last.Searching || last.FinalizedHeight != toBlock || last.ChainHead != sepoliaHead || last.BackfillPercent != 100 || last.ETA.Duration != 0 {
+		t.Errorf("search ended with %+v", last)
+	}
+	if last.DeployBlock != deployBlock || last.Endpoint != endpointLabel(server.URL()) {
+		t.Errorf("status: %+v", last)
+	}
+	// The last error is kept after searches succeed.
+	if last.LastError != status.LastError {
+		t.Errorf("last error %q, want %q", last.LastError, status.LastError)
+	}
+}
@@ -0,0 +1,165 @@
+package validatorpass_tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// STORES
+
+// Key the tracker's snapshot is saved under by SaveSnapshot.
+const snapshotKey = "snapshot"
+
+var ErrNotFound = errors.New("not found")
+
+// Key-value storage for tracker state that has to survive restarts.
+type Store interface {
+	// The value stored under a key, or ErrNotFound.
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	// Deleting a missing key is not an error.
+	Delete(key string) error
+	// All keys with the prefix, in sorted order.
+	Keys(prefix string) ([]string, error)
+}
+
+// Store kept in memory, for tests and nodes that rescan on every start.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	values map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string][]byte{}}
+}
+
+func (store *MemoryStore) Get(key string) ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	value, exists := store.values[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (store *MemoryStore) Put(key string, value []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (store *MemoryStore) Delete(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.values, key)
+	return nil
+}
+
+func (store *MemoryStore) Keys(prefix string) ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	keys := []string{}
+	for key := range store.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Store keeping one file per key in a directory. Values are replaced atomically.
+type FileStore struct {
+	dir string
+}
+
+// Open a file store in a directory, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Keys are escaped so any key maps to a single file in the store directory.
+func (store *FileStore) path(key string) string {
+	return filepath.Join(store.dir, url.PathEscape(key))
+}
+
+func (store *FileStore) Get(key string) ([]byte, error) {
+	value, err := os.ReadFile(store.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (store *FileStore) Put(key string, value []byte) error {
+	return writeFileAtomic(store.path(key), value)
+}
+
+func (store *FileStore) Delete(key string) error {
+	if err := os.Remove(store.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (store *FileStore) Keys(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil || entry.IsDir() || isTempFile(entry.Name()) {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Files left behind by an interrupted writeFileAtomic.
+func isTempFile(name string) bool {
+	matched, _ := filepath.Match("*.tmp*", name)
+	return matched
+}
+
+// Save a snapshot of the tracker to a store, so it can resume from it with LoadSnapshot instead of rescanning.
+func (nft_tracker *Tracker) SaveSnapshot(store Store) error {
+	snapshot, err := nft_tracker.Snapshot()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return store.Put(snapshotKey, encoded)
+}
+
+// Restore the tracker from the snapshot in a store. Returns ErrNotFound if the store has no snapshot.
+func (nft_tracker *Tracker) LoadSnapshot(store Store) error {
+	encoded, err := store.Get(snapshotKey)
+	if err != nil {
+		return err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(encoded, snapshot); err != nil {
+		return err
+	}
+	return nft_tracker.RestoreSnapshot(snapshot)
+}
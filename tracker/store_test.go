@@ -0,0 +1,64 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": fileStore} {
+		if _, err := store.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: missing key returned %v", name, err)
+		}
+		store.Put("webhook/a b", []byte("1"))
+		store.Put("webhook/c", []byte("2"))
+		store.Put("snapshot", []byte("3"))
+		if value, err := store.Get("webhook/a b"); err != nil || string(value) != "1" {
+			t.Errorf("%s: got %q, %v", name, value, err)
+		}
+		if keys, _ := store.Keys("webhook/"); !reflect.DeepEqual(keys, []string{"webhook/a b", "webhook/c"}) {
+			t.Errorf("%s: keys %v", name, keys)
+		}
+		if err := store.Delete("webhook/c"); err != nil {
+			t.Error(err)
+		}
+		if err := store.Delete("webhook/c"); err != nil {
+			t.Errorf("%s: deleting a missing key failed: %v", name, err)
+		}
+		if keys, _ := store.Keys(""); len(keys) != 2 {
+			t.Errorf("%s: keys %v after delete", name, keys)
+		}
+	}
+}
+
+func TestSaveLoadSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	trackerobj := NewTracker(rpcSource, 0, RedeemEvent)
+	if err := trackerobj.LoadSnapshot(store); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("empty store returned %v", err)
+	}
+	if _, err := trackerobj.FindRedeems(context.Background(), deployBlock, 5618800); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackerobj.SaveSnapshot(store); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := NewTracker(rpcSource, 0, RedeemEvent)
+	if err := resumed.LoadSnapshot(store); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.FinalizedHeight() != 5618800 || len(resumed.validatorList) != len(sepoliaRedeems) {
+		t.Fatalf("resumed at %d with %d redeems", resumed.FinalizedHeight(), len(resumed.validatorList))
+	}
+	// Backfilling continues after the snapshot instead of rescanning from the deploy block.
+	if found, err := resumed.Backfill(context.Background(), 20); err != nil || found != 0 || resumed.FinalizedHeight() != sepoliaHead-20 {
+		t.Errorf("backfill found %d redeems up to %d, %v", found, resumed.FinalizedHeight(), err)
+	}
+}
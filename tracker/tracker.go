@@ -2,259 +2,562 @@ package validatorpass_tracker
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/cometbft/cometbft/crypto"
 )
 
 // COMETBFT CALLBACKS
 
 // CometBFT callback without requiring tokenId, to determine validity of cometbft address in terms of existence of an on-chain redeem event.
 // This function should be called before the validator tries to initiate a join transaction to the network.
+// The address may be in any form accepted by ParseCometBftAddress.
 func VerifyMembershipOfAddress(cometBftAddress string, trackerIns *Tracker) (determination bool) {
-	for pass := range trackerIns.ValidatorList {
-		if trackerIns.ValidatorList[pass].validatorAddress == cometBftAddress {
-			return true
-		}
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	key, ok := trackerIns.normaliseAddress(cometBftAddress)
+	if !ok {
+		return false
 	}
-	return false
+	return len(trackerIns.addressMap[key]) > 0
 }
 
 // Mapped search for cometBFT callback to account for re-redeems.
+// An address is only valid if it holds the latest redeem event of at least one tokenId, see ConflictPolicy for
+// addresses holding several.
+// The address may be in any form accepted by ParseCometBftAddress.
 func VerifyAddress(cometBftAddress string, trackerIns *Tracker) bool {
-	for address, redeems := range trackerIns.addressMap {
-		fmt.Println(address) // Debug
-
-		// To-Do: Add logic for re-redeems
-		if address == cometBftAddress {
-			var searchHeight int64 = 0
-			for redeem := range redeems {
-				if redeems[redeem].redeemedBlockHeight > searchHeight {
-					searchHeight = redeems[redeem].redeemedBlockHeight
-				}
-			}
-
-			return true
-		}
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	key, ok := trackerIns.normaliseAddress(cometBftAddress)
+	if !ok {
+		return false
 	}
-	return false
+	return trackerIns.isActiveAddress(key)
 }
 
 // CometBFT callback to determine validity of cometbft address in terms of existence of an on-chain redeem event.
-
+// The address must match the latest redeem event for the tokenId, ordered by (block, txIndex, logIndex), and the
+// token must authorise it under the conflict policy if other tokens are bound to the address too.
+// The tokenId may be given in decimal or hex, see CanonicalTokenId.
 func VerifyValidatorAddress(cometBftAddress string, tokenId string, trackerIns *Tracker) (determination bool) {
-	EventsForTokenId := []Validator_RedeemEvent{}
-	for pass := range trackerIns.ValidatorList {
-		if trackerIns.ValidatorList[pass].tokenId == tokenId {
-			if trackerIns.ValidatorList[pass].validatorAddress == cometBftAddress {
-				EventsForTokenId = append(EventsForTokenId, trackerIns.ValidatorList[pass]) // Get all events for this tokenId
-			}
+	canonical, err := CanonicalTokenId(tokenId)
+	if err != nil {
+		return false
+	}
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	key, ok := trackerIns.normaliseAddress(cometBftAddress)
+	if !ok {
+		return false
+	}
+	return trackerIns.bindingAuthorised(trackerIns.holdingsAt(trackerIns.addressMap[key], math.MaxInt64), canonical)
+}
+
+// Convert a callback address into the key of the address index. The caller must hold the tracker lock.
+func (trackerIns *Tracker) normaliseAddress(cometBftAddress string) (string, bool) {
+	address, err := ParseCometBftAddress(cometBftAddress, trackerIns.trackedEvent.payloadEncoding)
+	if err != nil {
+		return "", false
+	}
+	return addressKey(address), true
+}
+
+// Returns true if the address holds the latest redeem event of at least one tokenId. The caller must hold the tracker lock.
+func (trackerIns *Tracker) isActiveAddress(key string) bool {
+	return trackerIns.isActiveAddressAt(key, math.MaxInt64)
+}
+
+// Returns true if the address held the latest redeem event of at least one tokenId at the given Ethereum height,
+// and is authorised under the conflict policy. The caller must hold the tracker lock.
+func (trackerIns *Tracker) isActiveAddressAt(key string, height int64) bool {
+	return trackerIns.holderAuthorised(trackerIns.holdingsAt(trackerIns.addressMap[key], height))
+}
+
+// Find the latest redeem event at or below an Ethereum height in an ordered list of redeems.
+func latestRedeemAt(redeemList []Validator_RedeemEvent, height int64) (Validator_RedeemEvent, bool) {
+	position := sort.Search(len(redeemList), func(i int) bool {
+		return redeemList[i].redeemedBlockHeight > height
+	})
+	if position == 0 {
+		return Validator_RedeemEvent{}, false
+	}
+	return redeemList[position-1], true
+}
+
+// HEIGHT-PINNED CALLBACKS
+
+// ErrHeightNotFinalized is returned when a height-pinned query asks about a block the tracker has not scanned yet.
+var ErrHeightNotFinalized = errors.New("ethereum height not finalized by tracker")
+
+// Height-pinned CometBFT callback: determines validity of a cometbft address using only redeem events at or below an Ethereum height.
+// Every tracker that has scanned past the height gives the same answer, so this is safe to call from consensus code.
+func VerifyAddressAt(cometBftAddress string, height int64, trackerIns *Tracker) (bool, error) {
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	if height > trackerIns.finalizedHeight {
+		return false, ErrHeightNotFinalized
+	}
+	key, ok := trackerIns.normaliseAddress(cometBftAddress)
+	if !ok {
+		return false, nil
+	}
+	return trackerIns.isActiveAddressAt(key, height), nil
+}
+
+// Height-pinned CometBFT callback for a validator's consensus public key.
+func VerifyPubKeyAt(pubKey crypto.PubKey, height int64, trackerIns *Tracker) (bool, error) {
+	if pubKey == nil {
+		return false, nil
+	}
+	return VerifyAddressAt(pubKey.Address().String(), height, trackerIns)
+}
+
+// Height-pinned CometBFT callback: the address must match the latest redeem event for the tokenId at or below the Ethereum height,
+// and the token must authorise it under the conflict policy.
+func VerifyValidatorAddressAt(cometBftAddress string, tokenId string, height int64, trackerIns *Tracker) (bool, error) {
+	canonical, err := CanonicalTokenId(tokenId)
+	if err != nil {
+		return false, nil
+	}
+	trackerIns.mu.RLock()
+	defer trackerIns.mu.RUnlock()
+	if height > trackerIns.finalizedHeight {
+		return false, ErrHeightNotFinalized
+	}
+	key, ok := trackerIns.normaliseAddress(cometBftAddress)
+	if !ok {
+		return false, nil
+	}
+	return trackerIns.bindingAuthorised(trackerIns.holdingsAt(trackerIns.addressMap[key], height), canonical), nil
+}
+
+// The store the tracker resumes from and saves to, set with WithStore; nil if there is none.
+func (nft_tracker *Tracker) Store() Store {
+	return nft_tracker.store
+}
+
+// The redeem event the tracker follows.
+func (nft_tracker *Tracker) Event() Rpc_RedeemEvent {
+	return nft_tracker.trackedEvent
+}
+
+// The highest Ethereum block up to which all redeem events have been ingested.
+func (nft_tracker *Tracker) FinalizedHeight() int64 {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	return nft_tracker.finalizedHeight
+}
+
+// Copies of the redeem events between two Ethereum heights, inclusive, in chain order.
+func (nft_tracker *Tracker) RedeemsBetween(fromHeight int64, toHeight int64) []Validator_RedeemEvent {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	redeems := []Validator_RedeemEvent{}
+	for vpass := range nft_tracker.validatorList {
+		height := nft_tracker.validatorList[vpass].redeemedBlockHeight
+		if height > toHeight {
+			break // Ordered list, the rest is later.
+		}
+		if height >= fromHeight {
+			redeems = append(redeems, nft_tracker.validatorList[vpass])
 		}
 	}
-	var searchHeight int64 = 0
-	latestEvent := Validator_RedeemEvent{}
-	for pass := range EventsForTokenId {
-		if EventsForTokenId[pass].redeemedBlockHeight > searchHeight {
-			latestEvent = EventsForTokenId[pass]
-			searchHeight = EventsForTokenId[pass].redeemedBlockHeight // Find the latest event
+	return redeems
+}
+
+// Copies of every redeem event of a tokenId up to the finalized height, in chain order.
+func (nft_tracker *Tracker) tokenRedeems(tokenId string) []Validator_RedeemEvent {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	redeems := []Validator_RedeemEvent{}
+	for _, redeem := range nft_tracker.tokenIdMap[tokenId] {
+		if redeem.redeemedBlockHeight > nft_tracker.finalizedHeight {
+			break // Ordered list, the rest has not been finalized.
 		}
+		redeems = append(redeems, redeem)
 	}
-	if latestEvent.validatorAddress == cometBftAddress {
-		return true
-	} else {
-		return false
+	return redeems
+}
+
+// Copies of the latest redeem event of every tokenId at an Ethereum height, ordered by tokenId.
+func (nft_tracker *Tracker) activeSetAt(height int64) ([]Validator_RedeemEvent, error) {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	if height > nft_tracker.finalizedHeight {
+		return nil, ErrHeightNotFinalized
+	}
+	return nft_tracker.activeBindingsAt(height), nil
+}
+
+func (nft_tracker *Tracker) setFinalizedHeight(height int, blockHash string) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	if int64(height) >= nft_tracker.finalizedHeight {
+		nft_tracker.publishChanges(nft_tracker.changesBetween(nft_tracker.finalizedHeight, int64(height)))
+		nft_tracker.finalizedHeight = int64(height)
+		nft_tracker.finalizedBlockHash = blockHash
+		nft_tracker.addCheckpoint(int64(height), blockHash)
+		nft_tracker.updateStateMetrics()
+	}
+}
+
+// The first block that still has to be searched: the deploy block, or the block after an imported snapshot.
+func (nft_tracker *Tracker) resumeBlock() int {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	if nft_tracker.finalizedHeight >= int64(nft_tracker.trackedEvent.deployBlock) {
+		return int(nft_tracker.finalizedHeight) + 1
+	}
+	return nft_tracker.trackedEvent.deployBlock
+}
+
+// Block until the tracker has scanned up to the Ethereum height, or the context is cancelled.
+func (nft_tracker *Tracker) WaitForHeight(ctx context.Context, height int64) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for nft_tracker.FinalizedHeight() < height {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// The Ethereum height agreed by consensus, 0 if no height has been agreed yet.
+func (nft_tracker *Tracker) AgreedHeight() int64 {
+	nft_tracker.mu.RLock()
+	defer nft_tracker.mu.RUnlock()
+	return nft_tracker.agreedHeight
+}
+
+// Record the Ethereum height agreed by consensus. The agreed height never moves backwards.
+func (nft_tracker *Tracker) SetAgreedHeight(height int64) {
+	nft_tracker.mu.Lock()
+	defer nft_tracker.mu.Unlock()
+	if height > nft_tracker.agreedHeight {
+		nft_tracker.agreedHeight = height
 	}
 }
 
 // The tracker will keep a list of validator pass redeem events.
 type Tracker struct {
-	RpcAddress        string
-	rpcSearchLimit    int
-	TrackedEvent      Rpc_RedeemEvent
-	ValidatorList     []Validator_RedeemEvent
-	LastTrackerHeight int
-	tokenIdMap        map[string][]Validator_RedeemEvent
-	addressMap        map[string][]Validator_RedeemEvent
-	Startsig          chan string
+	source             LogSource // Where redeem logs are read from
+	rpcSearchLimit     int
+	trackedEvent       Rpc_RedeemEvent
+	validatorList      []Validator_RedeemEvent
+	finalizedHeight    int64  // All redeem events up to and including this block have been ingested
+	finalizedBlockHash string // Hash of the block at finalizedHeight
+	agreedHeight       int64  // Ethereum height agreed by consensus, see EnableHeightAgreement
+	tokenIdMap         map[string][]Validator_RedeemEvent
+	addressMap         map[string][]Validator_RedeemEvent // Keyed by CometBFT address in uppercase hex
+	nodeIdMap          map[string][]Validator_RedeemEvent // Keyed by p2p node ID in lowercase hex
+	seenLogs           map[string]struct{}                // Logs already ingested, keyed by (txHash, logIndex)
+	checkpoints        []checkpoint                       // Recently scanned block hashes, to find the fork point of a reorg
+	subscribers        map[*subscription]struct{}         // Change streams opened with Subscribe
+	headHeight         int64                              // Latest block number read from the source, for metrics
+	logger             *slog.Logger                       // Silent unless set with SetLogger
+	scannedHeight      int64                              // Last block searched by the running search
+	search             *search                            // The running search, for the status
+	progress           func(SyncStatus)                   // Set with SetProgressFunc
+	lastErr            error                              // Last error reading from the source, for the status
+	lastErrAt          time.Time
+	synced             chan struct{} // Closed once the tracker has searched up to the chain head
+	syncedOnce         sync.Once
+	confirmations      int           // Of the last search up to the head, for Ready
+	maxLag             int64         // Set with SetMaxLag
+	tracking           bool          // StartTracking's loop is running
+	interval           time.Duration // StartTracking's polling interval
+	lastActive         time.Time     // Last time StartTracking's loop polled or searched a window, for Health
+	store              Store         // Set with WithStore, saved to after every search
+	clock              Clock
+	conflictPolicy     ConflictPolicy // Set with SetConflictPolicy
+	mu                 sync.RWMutex   // Guards the redeem list and maps between the tracking loop and callbacks
 }
 
-// Create a new tracker object to track an evenblt.
+// Create a new tracker object to track an event, reading from a JSON-RPC URL without retries.
+//
+// Deprecated: Use New with WithEndpoints, which validates its settings and can configure the rest of the tracker.
 func NewTracker(rpcSourceAddress string, rpcSearchLimit int, TrackedEvent Rpc_RedeemEvent) *Tracker {
+	return NewTrackerWithSource(NewJsonRpcSource(rpcSourceAddress), rpcSearchLimit, TrackedEvent)
+}
+
+// Create a new tracker that reads redeem events from any log source, eg. a static export for air-gapped validators.
+// New with WithSource can also configure the rest of the tracker.
+func NewTrackerWithSource(source LogSource, rpcSearchLimit int, TrackedEvent Rpc_RedeemEvent) *Tracker {
 	return &Tracker{
-		RpcAddress:        rpcSourceAddress,
-		rpcSearchLimit:    rpcSearchLimit,
-		TrackedEvent:      TrackedEvent,
-		ValidatorList:     []Validator_RedeemEvent{},
-		tokenIdMap:        map[string][]Validator_RedeemEvent{},
-		addressMap:        map[string][]Validator_RedeemEvent{},
-		LastTrackerHeight: 0,
-		Startsig:          make(chan string),
+		source:         source,
+		rpcSearchLimit: rpcSearchLimit,
+		trackedEvent:   TrackedEvent,
+		validatorList:  []Validator_RedeemEvent{},
+		tokenIdMap:     map[string][]Validator_RedeemEvent{},
+		addressMap:     map[string][]Validator_RedeemEvent{},
+		nodeIdMap:      map[string][]Validator_RedeemEvent{},
+		seenLogs:       map[string]struct{}{},
+		logger:         discardLogger,
+		synced:         make(chan struct{}),
+		maxLag:         DefaultMaxLag,
+		confirmations:  DefaultConfirmations,
+		interval:       DefaultInterval,
+		clock:          systemClock{},
 	}
 }
 
+// Track the contract with the interval and confirmations set with WithInterval and WithConfirmations, as StartTracking
+// does, until the context is cancelled.
+func (nft_tracker *Tracker) Run(ctx context.Context) {
+	nft_tracker.mu.RLock()
+	interval, confirmations := nft_tracker.interval, nft_tracker.confirmations
+	nft_tracker.mu.RUnlock()
+	nft_tracker.StartTracking(ctx, interval, confirmations)
+}
+
 // Start tracking redeem events from a Validator Pass smart contract address, you should be able to deterministically call validateNFTMembership()
-// for peer validation in a CometBFT callback.
-func (nft_tracker *Tracker) StartTracking(ctx context.Context, interval time.Duration, confirmations int) (errChannel chan error) { // To-Do: Error channel logic
-	ethereum_client, err := ethclient.Dial(nft_tracker.RpcAddress)
-	if err != nil {
-		panic(err) // Crash if no access to RPC.
-	}
-	defer ethereum_client.Close()
-	// Record the latest block and search back in time to the start block until all historical redeem events are recorded.
-	// Get the current block number
-	latestBlock, noLatestBlock := ethereum_client.BlockNumber(ctx)
-	if noLatestBlock != nil {
-		errChannel <- noLatestBlock
-	}
+// for peer validation in a CometBFT callback. Runs until the context is cancelled. Source errors don't stop it, they are
+// retried every interval and reported by Status and Health; the returned channel is always nil.
+func (nft_tracker *Tracker) StartTracking(ctx context.Context, interval time.Duration, confirmations int) (errChannel chan error) {
+	nft_tracker.startLoop(interval, confirmations)
+	defer nft_tracker.stopLoop()
+	// Do a historical search of all redeem events from deployBlock (or the imported snapshot) to the latest block.
+	// Errors are recorded for Status and Health and the search is retried every interval; Synced is only closed,
+	// and Ready only passes, once it has succeeded.
 	startTime := time.Now()
-	// Do a historical search of all redeem events from deployBlock to latestBlock
-	list, err := nft_tracker.FindRedeems(nft_tracker.TrackedEvent.deployBlock, int(latestBlock)-confirmations)
-	if err != nil {
-		errChannel <- noLatestBlock
+	for {
+		list, err := nft_tracker.Backfill(ctx, confirmations)
+		if err == nil {
+			nft_tracker.logger.Info("Historical search complete", "redeems", list, "took", time.Since(startTime))
+			break
+		}
+		nft_tracker.logger.Warn("Historical search failed, retrying", "retryIn", interval, "err", err)
+		select {
+		case <-ctx.Done():
+			return errChannel
+		case <-nft_tracker.clock.After(interval):
+		}
+		nft_tracker.recordActive()
 	}
-	nft_tracker.Startsig <- "done"
-	fmt.Println("Found", list, "redeem events in historical search, took time:", time.Since(startTime))
-	latestCheckedBlock := int(latestBlock)
+	latestCheckedBlock := nft_tracker.resumeBlock() - 1
 
-	ticker := time.NewTicker(interval)
-	for range ticker.C {
-		fmt.Println("Checking for new blocks")
-		latestBlock, noLatestBlock := ethereum_client.BlockNumber(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return errChannel
+		case <-nft_tracker.clock.After(interval):
+		}
+		nft_tracker.recordActive()
+		nft_tracker.logger.Debug("Checking for new blocks")
+		// Roll back redeems from blocks that are no longer on the chain before searching new blocks.
+		reorged, err := nft_tracker.handleReorg(ctx)
+		if err != nil {
+			nft_tracker.recordError(err)
+			nft_tracker.logger.Warn("Could not check for a reorg", "err", err)
+			continue
+		}
+		if reorged {
+			latestCheckedBlock = nft_tracker.resumeBlock() - 1
+			nft_tracker.logger.Warn("Chain reorganised, rescanning", "fromBlock", latestCheckedBlock+1)
+		}
+		latestBlock, noLatestBlock := nft_tracker.source.BlockNumber(ctx)
 		if noLatestBlock != nil {
-			panic(noLatestBlock) // Need to investigate potential errors that could be surfaced here.
+			nft_tracker.recordError(noLatestBlock)
+			nft_tracker.logger.Warn("Could not read the chain head", "err", noLatestBlock)
+			continue // Retry next interval, Health reports the source as unreachable meanwhile.
 		}
+		nft_tracker.recordHead(latestBlock)
 		elgibleBlock := int(latestBlock) - confirmations // Block eligible to be searched based on confirmation parameter
 		if elgibleBlock > latestCheckedBlock {
 			// Find all redeem events from deployblock to latest block.
-			nft_tracker.FindRedeems(latestCheckedBlock, elgibleBlock)
-			latestCheckedBlock = int(latestBlock)
+			if _, err := nft_tracker.FindRedeems(ctx, latestCheckedBlock, elgibleBlock); err != nil {
+				nft_tracker.logger.Warn("Could not search blocks", "fromBlock", latestCheckedBlock, "toBlock", elgibleBlock, "err", err)
+				continue // Retry the same blocks next interval.
+			}
+			latestCheckedBlock = elgibleBlock
 		} else {
-			fmt.Println("No new blocks searched since interval. Latest block is:", latestBlock, "  while last checked block was: ", latestCheckedBlock)
+			nft_tracker.logger.Debug("No new blocks to search", "head", latestBlock, "lastCheckedBlock", latestCheckedBlock)
 		}
 	}
-	return errChannel
 }
 
 // RPC FUNCTIONS
 
 // Used to make many ethereum remote procedure calls over time to handle limits from rpc provider.
 // Setting a maxBlockSearch of 0 will assume that you have unlimited RPC access, eg. lite or full node locally hosted.
-func (nft_tracker *Tracker) FindRedeems(fromBlock int, toBlock int) (int, error) {
-	RedeemsFound := 0
+// Cancelling the context stops the search, the tracker keeps what earlier searches found.
+func (nft_tracker *Tracker) FindRedeems(ctx context.Context, fromBlock int, toBlock int) (redeemsFound int, err error) {
 	lastUpdate := 0
+	current := &search{fromBlock: fromBlock, toBlock: toBlock, started: nft_tracker.clock.Now()}
+	nft_tracker.recordSearch(current, fromBlock-1)
+	defer func() {
+		if err != nil {
+			nft_tracker.recordError(err)
+		}
+		nft_tracker.recordSearch(nil, toBlock)
+	}()
+	// Record the hash of the last scanned block so snapshots can be tied to a specific chain. It is read before the logs,
+	// so a reorg during the search leaves a stale hash that the next reorg check catches, rather than hiding stale logs.
+	blockHash, err := nft_tracker.source.BlockHash(ctx, toBlock)
+	if err != nil {
+		return 0, err
+	}
+	// Only extend the scanned chain if it is still the source's chain, StartTracking rolls back otherwise.
+	if err := nft_tracker.checkFinalizedBlock(ctx); err != nil {
+		return 0, err
+	}
 	if nft_tracker.rpcSearchLimit == 0 { // Unlimited RPC, no need to search incrementally.
-		list, err := nft_tracker.FetchAppendRedeems(nft_tracker.TrackedEvent.deployBlock, toBlock)
+		list, err := nft_tracker.FetchAppendRedeems(ctx, fromBlock, toBlock)
 		if err != nil {
 			return 0, err
 		}
-		RedeemsFound = len(list)
+		redeemsFound = len(list)
 	} else {
 		for currentBlock := fromBlock; currentBlock <= toBlock; currentBlock += nft_tracker.rpcSearchLimit + 1 {
 			// Search through all blocks incrementing by rpcSearchLimit.
-			list, err := nft_tracker.FetchAppendRedeems(currentBlock, (currentBlock + nft_tracker.rpcSearchLimit))
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			list, err := nft_tracker.FetchAppendRedeems(ctx, currentBlock, min(currentBlock+nft_tracker.rpcSearchLimit, toBlock))
 			if err != nil {
 				return 0, err
 			}
-			RedeemsFound += len(list)
-			ProgressUpdate(fromBlock, currentBlock, toBlock, &lastUpdate)
+			redeemsFound += len(list)
+			nft_tracker.recordSearch(current, min(currentBlock+nft_tracker.rpcSearchLimit, toBlock))
+			if percent := (currentBlock - fromBlock) * 100 / max(toBlock-fromBlock, 1); percent > lastUpdate { // Every 1%
+				nft_tracker.logger.Debug("Search progress", "percent", percent, "block", currentBlock, "toBlock", toBlock)
+				lastUpdate = percent
+			}
 		}
 	}
-	return RedeemsFound, nil
+	nft_tracker.setFinalizedHeight(toBlock, blockHash)
+	if nft_tracker.store != nil {
+		if err := nft_tracker.SaveSnapshot(nft_tracker.store); err != nil {
+			nft_tracker.logger.Warn("Could not save the tracker state", "err", err)
+		}
+	}
+	return redeemsFound, nil
 }
 
-func (nft_tracker *Tracker) FetchAppendRedeems(fromBlock int, toBlock int) ([]Validator_RedeemEvent, error) {
+// Search from the tracker's resume block up to the source's head minus confirmations, as StartTracking does
+// before it starts polling. Returns the number of redeem events found.
+func (nft_tracker *Tracker) Backfill(ctx context.Context, confirmations int) (int, error) {
+	latestBlock, err := nft_tracker.source.BlockNumber(ctx)
+	if err != nil {
+		nft_tracker.recordError(err)
+		return 0, err
+	}
+	nft_tracker.recordHead(latestBlock)
+	nft_tracker.mu.Lock()
+	nft_tracker.confirmations = confirmations
+	nft_tracker.mu.Unlock()
+	toBlock := int(latestBlock) - confirmations
+	if toBlock < nft_tracker.resumeBlock() {
+		nft_tracker.markSynced()
+		return 0, nil // Already up to date.
+	}
+	found, err := nft_tracker.FindRedeems(ctx, nft_tracker.resumeBlock(), toBlock)
+	if err == nil {
+		nft_tracker.markSynced()
+	}
+	return found, err
+}
+
+// Fetch redeem events in a block range and ingest them into the tracker.
+// Only events that were not already ingested are returned, so re-scanning a range never changes the tracker state.
+func (nft_tracker *Tracker) FetchAppendRedeems(ctx context.Context, fromBlock int, toBlock int) ([]Validator_RedeemEvent, error) {
 	RedeemsFound := []Validator_RedeemEvent{}
-	ValidatorList, err := FetchRedeemEventsRPC(nft_tracker.RpcAddress, nft_tracker.TrackedEvent, fromBlock, toBlock)
+	ValidatorList, err := FetchRedeemEvents(ctx, nft_tracker.source, nft_tracker.trackedEvent, fromBlock, toBlock)
 	if err != nil {
 		return nil, err
 	}
 	if len(ValidatorList) > 0 {
+		nft_tracker.mu.Lock()
+		defer nft_tracker.mu.Unlock()
 		for vpass := range ValidatorList {
-			fmt.Println(ValidatorList[vpass].ToString())
+			if err := ValidatorList[vpass].decodeErr; err != nil {
+				nft_tracker.logger.Warn("Could not decode redeem event", append(redeemAttrs(ValidatorList[vpass]), "err", err)...)
+			}
+			if ValidatorList[vpass].tokenId == "" {
+				continue // Without a tokenId the redeem can't be indexed.
+			}
+			if !nft_tracker.ingestRedeem(ValidatorList[vpass]) {
+				continue // Already ingested from an overlapping search window.
+			}
+			nft_tracker.logger.Debug("Ingested redeem event", redeemAttrs(ValidatorList[vpass])...)
 			RedeemsFound = append(RedeemsFound, ValidatorList[vpass])
-			nft_tracker.ValidatorList = append(nft_tracker.ValidatorList, ValidatorList[vpass])
-
-			// Add to corresponding maps for tokenid and validator address
-			nft_tracker.AddToTokenIdMap(ValidatorList[vpass])
-			nft_tracker.AddToAddressMap(ValidatorList[vpass])
 		}
-		// Update nft_tracker.lastTrackerHeight
-		nft_tracker.LastTrackerHeight = toBlock
+		eventsIngestedCounter.WithLabelValues(nft_tracker.contractLabel()).Add(float64(len(RedeemsFound)))
 	}
 	return RedeemsFound, nil
 }
 
-func (nft_tracker *Tracker) AddToTokenIdMap(validatorRedeem Validator_RedeemEvent) {
-	currentRedeem, exists := nft_tracker.tokenIdMap[validatorRedeem.tokenId]
-	if !exists {
-		currentRedeem = []Validator_RedeemEvent{}
-		currentRedeem = append(currentRedeem, validatorRedeem)
-		nft_tracker.tokenIdMap[validatorRedeem.tokenId] = currentRedeem
-	} else {
-		currentRedeem = append(currentRedeem, validatorRedeem)
-		nft_tracker.tokenIdMap[validatorRedeem.tokenId] = currentRedeem
+// Add a redeem event to the validator list and maps, unless its log was already ingested. The tokenId is kept in
+// canonical form, so lookups give the same answer however it was written. Returns false for duplicates.
+// The caller must hold the tracker lock.
+func (nft_tracker *Tracker) ingestRedeem(validatorRedeem Validator_RedeemEvent) bool {
+	logKey := validatorRedeem.LogKey()
+	if _, seen := nft_tracker.seenLogs[logKey]; seen {
+		return false
+	}
+	if canonical, err := CanonicalTokenId(validatorRedeem.tokenId); err == nil {
+		validatorRedeem.tokenId = canonical
 	}
+	nft_tracker.seenLogs[logKey] = struct{}{}
+	nft_tracker.validatorList = insertOrdered(nft_tracker.validatorList, validatorRedeem)
+
+	// Add to corresponding maps for tokenid and validator address
+	nft_tracker.AddToTokenIdMap(validatorRedeem)
+	nft_tracker.AddToAddressMap(validatorRedeem)
+	nft_tracker.AddToNodeIdMap(validatorRedeem)
+	return true
 }
 
+// Redeem events for each tokenId are kept in on-chain order, so the latest redeem is the last element.
+func (nft_tracker *Tracker) AddToTokenIdMap(validatorRedeem Validator_RedeemEvent) {
+	currentRedeem := nft_tracker.tokenIdMap[validatorRedeem.tokenId]
+	nft_tracker.tokenIdMap[validatorRedeem.tokenId] = insertOrdered(currentRedeem, validatorRedeem)
+}
+
+// Redeem events for each CometBFT validator address are kept in on-chain order, so the latest redeem is the last element.
 func (nft_tracker *Tracker) AddToAddressMap(validatorRedeem Validator_RedeemEvent) {
-	currentRedeem, exists := nft_tracker.addressMap[validatorRedeem.validatorAddress]
-	if !exists {
-		currentRedeem = []Validator_RedeemEvent{}
-		currentRedeem = append(currentRedeem, validatorRedeem)
-		nft_tracker.addressMap[validatorRedeem.validatorAddress] = currentRedeem
-	} else {
-		currentRedeem = append(currentRedeem, validatorRedeem)
-		nft_tracker.addressMap[validatorRedeem.validatorAddress] = currentRedeem
-	}
+	key := addressKey(validatorRedeem.cometAddress)
+	currentRedeem := nft_tracker.addressMap[key]
+	nft_tracker.addressMap[key] = insertOrdered(currentRedeem, validatorRedeem)
 }
 
 // Fetch a full list of Validator Passes from a smart contract address.
-func FetchRedeemEventsRPC(rpcSource string, TrackedEvent Rpc_RedeemEvent, fromBlock int, toBlock int) ([]Validator_RedeemEvent, error) {
-	var redeemEventsInRange []Validator_RedeemEvent
+func FetchRedeemEventsRPC(ctx context.Context, rpcSource string, TrackedEvent Rpc_RedeemEvent, fromBlock int, toBlock int) ([]Validator_RedeemEvent, error) {
+	source := NewJsonRpcSource(rpcSource)
+	defer source.Close()
+	return FetchRedeemEvents(ctx, source, TrackedEvent, fromBlock, toBlock)
+}
 
-	// Initialise an ethereum RPC client
-	ethereum_client, err := ethclient.Dial(rpcSource)
+// Fetch the redeem events in a block range from any log source.
+func FetchRedeemEvents(ctx context.Context, source LogSource, TrackedEvent Rpc_RedeemEvent, fromBlock int, toBlock int) ([]Validator_RedeemEvent, error) {
+	var redeemEventsInRange []Validator_RedeemEvent
+	// To-Do: Handle responses that are error messages, for example if the RPC is down.
+	response, err := source.FetchLogs(ctx, TrackedEvent, fromBlock, toBlock)
 	if err != nil {
 		return nil, err
 	}
-	defer ethereum_client.Close()
-	// Build the RPC arguments for eth_getLogs
-	RpcArguments := map[string]interface{}{
-		"fromBlock": string(fmt.Sprintf("0x%x", fromBlock)), // fromBlock,
-		"toBlock":   string(fmt.Sprintf("0x%x", toBlock)),   // toBlock,
-		"address":   TrackedEvent.contractAddress,
-		"topics": []string{
-			TrackedEvent.EventSignature,
-		},
-	}
-
-	// fmt.Printf("Searching for redeem event logs in blocks %d to %d\n", fromBlock, toBlock)
-	response := make([]RedeemEventRpc, 1)
-	// To-Do: Handle responses that are error messages, for example if the RPC is down.
-	getLogsFailed := ethereum_client.Client().Call(&response, "eth_getLogs", RpcArguments)
-	if getLogsFailed != nil {
-		return nil, getLogsFailed
-	}
 	// response handling logic
-	if len(response) > 0 {
-		for val := range response {
-			redeemEventsInRange = append(redeemEventsInRange, *NewValidatorRedeemEvent(response[val].Topics[1], response[val].Data, response[val].BlockNumber))
+	for val := range response {
+		if len(response[val].Topics) < 2 {
+			continue // Not a redeem event, it has no tokenId topic.
 		}
+		redeemEventsInRange = append(redeemEventsInRange, *TrackedEvent.decodeLog(response[val]))
 	}
-
 	return redeemEventsInRange, nil
 }
 
-// Verbose function for printing the progress of the search
-func ProgressUpdate(startBlock int, currentBlock int, toBlock int, lastUpdate *int) {
-	currentBlockPosition := currentBlock - startBlock
-	destinationBlockPosition := toBlock - startBlock
-	progress := (float64(currentBlockPosition) / float64(destinationBlockPosition)) * 100
-
-	if int(progress) > *lastUpdate { // Only update every 1% completion
-		fmt.Printf("Completion percentage of search: %d%%\n", int(progress))
-		*lastUpdate = int(progress)
-		//fmt.Printf("Searching for redeem events in blocks %d to %d\n", currentBlock, currentBlock+4)
-	}
+// Fetch the hash of a block, eg. to record which chain a scan was made on.
+func FetchBlockHashRPC(ctx context.Context, rpcSource string, blockNumber int) (string, error) {
+	source := NewJsonRpcSource(rpcSource)
+	defer source.Close()
+	return source.BlockHash(ctx, blockNumber)
 }
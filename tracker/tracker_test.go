@@ -3,23 +3,58 @@ package validatorpass_tracker
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/Openmesh-Network/nft-authorise/tracker/rpctest"
 	ethereum "github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
 const contractAddress string = "0x8D64aB58a17dA7d8788367549c513386f09a0A70"
-const deployBlock = 5517796 // 0x55bc06 This is the block at which the validator pass contact was deployed on-chain.
-// const rpcSource = "https://rpc.sepolia.org"
-const rpcSource = "https://rpc.ankr.com/eth_sepolia"
+const deployBlock = 5618691 // This is the block at which the validator pass contact was deployed on-chain.
 const redeemed = "Redeemed(uint256,bytes32)"
 
+// Tests run against a scripted copy of the Sepolia validator pass redeems served by rpctest, see TestMain.
+var rpcSource string
+
 var RedeemEvent = NewRedeemEvent(redeemed, contractAddress, deployBlock)
 
-// To fix: Tests all run out of time. Try with own Ethereum RPC.
+// Redeems on the scripted chain, one per tokenId.
+var sepoliaRedeems = []struct {
+	block            uint64
+	tokenId          string
+	validatorAddress string
+}{
+	{5618694, "0x0000000000000000000000000000000000000000000000000000000000000001", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"},
+	{5618760, "0x0000000000000000000000000000000000000000000000000000000000000002", "0x2757295701725127590000000000000000000000000000000000000000000000"},
+	{5618790, "0x0000000000000000000000000000000000000000000000000000000000000003", "0x2175091590317500000000000000000000000000000000000000000000000000"},
+}
+
+const sepoliaHead = 5618900
+
+func newSepoliaServer() *rpctest.Server {
+	server := rpctest.NewServer(sepoliaHead)
+	for _, redeem := range sepoliaRedeems {
+		server.AddLogs(redeem.block, rpctest.Log{
+			Address: contractAddress,
+			Topics:  []string{RedeemEvent.EventSignature, redeem.tokenId},
+			Data:    redeem.validatorAddress,
+		})
+	}
+	return server
+}
+
+func TestMain(m *testing.M) {
+	server := newSepoliaServer()
+	rpcSource = server.URL()
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
 func TestNftTracker(t *testing.T) {
 	// Compute Keccak256 hash of the event signature
 	hash := ethereum.Keccak256([]byte(redeemed))
@@ -27,96 +62,183 @@ func TestNftTracker(t *testing.T) {
 
 	// Concatenate "0x" with the event signature
 	EventSignatureWithPrefix := "0x" + EventSignature
+	if EventSignatureWithPrefix != RedeemEvent.EventSignature {
+		t.Fatal("Event sig:", EventSignatureWithPrefix, "does not match", RedeemEvent.EventSignature)
+	}
 
-	t.Log("Event sig:", EventSignatureWithPrefix)
 	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
-	ctx := context.Background()
-	trackerobj.StartTracking(ctx, 2*time.Minute, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trackerobj.StartTracking(ctx, 2*time.Minute, 20)
+	<-trackerobj.Synced()
+	if len(trackerobj.validatorList) != len(sepoliaRedeems) {
+		t.Errorf("historical search found %d redeems, want %d", len(trackerobj.validatorList), len(sepoliaRedeems))
+	}
+	if trackerobj.FinalizedHeight() != sepoliaHead-20 {
+		t.Errorf("finalized height %d, want %d", trackerobj.FinalizedHeight(), sepoliaHead-20)
+	}
 }
+
 func TestFindVPassRPC(t *testing.T) {
 	// Testing reveals that response is empty if there are no redeem events found.
-	FindVPassinRange(5618691, 5618693, t)
+	if found := FindVPassinRange(5618691, 5618693, t); found != 0 {
+		t.Errorf("found %d redeems in an empty range", found)
+	}
 
-	// One Validator pass object found in this range. (Next check for a double redeem within 3 blocks.)
-	FindVPassinRange(5618693, 5618750, t)
+	// One Validator pass object found in this range.
+	if found := FindVPassinRange(5618693, 5618750, t); found != 1 {
+		t.Errorf("found %d redeems, want 1", found)
+	}
 
 	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
 	// Test longer range with historical fetch loop.
-	trackerobj.FindVPassHistorical(5618685, 5618705, t)
-
-	// Test live search using main.go
+	if found := trackerobj.FindVPassHistorical(5618685, 5618705, t); found != 1 {
+		t.Errorf("found %d redeems, want 1", found)
+	}
 }
 
 func TestCallbackfuncs(t *testing.T) {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, 5618691))
 	go func() {
 		trackerobj.StartTracking(ctx, 2*time.Minute, 20)
 	}()
-	time.Sleep(3 * time.Second)
+	<-trackerobj.Synced()
 	redeemed := VerifyAddress("0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", trackerobj)
-	t.Log("Tracked a successful redeem for cometBFT address: ", redeemed)
+	if !redeemed {
+		t.Error("Did not track the redeem for cometBFT address")
+	}
 }
 
 func TestFetchRPC(t *testing.T) {
 	nft_tracker := NewTracker(rpcSource, 4, RedeemEvent)
-	RedeemsFound := []Validator_RedeemEvent{}
-	// Ripped straight from FetchAppendRPC, lazy test
-	ValidatorList, err := nft_tracker.FetchAppendRedeems(5618693, 5618695) // Hardcode test values.
+	ValidatorList, err := nft_tracker.FetchAppendRedeems(context.Background(), 5618693, 5618695) // Hardcode test values.
 	if err != nil {
-		t.Log(err)
+		t.Fatal(err)
 	}
-	if len(ValidatorList) > 0 {
-		for vpass := range ValidatorList {
-			RedeemsFound = append(RedeemsFound, ValidatorList[vpass])
-			nft_tracker.ValidatorList = append(nft_tracker.ValidatorList, ValidatorList[vpass])
-		}
+	if len(ValidatorList) != 1 || ValidatorList[0].validatorAddress != sepoliaRedeems[0].validatorAddress {
+		t.Fatalf("unexpected redeems %v", ValidatorList)
 	}
-	for r := range RedeemsFound {
-		//fmt.Println(RedeemsFound[r].ToString())
-		fmt.Println(RedeemsFound[r].validatorAddress)
+	if len(nft_tracker.validatorList) != 1 {
+		t.Errorf("tracker holds %d redeems, want 1", len(nft_tracker.validatorList))
 	}
 }
 
+// Public RPC providers limit the block range of eth_getLogs, the tracker has to search in windows of rpcSearchLimit+1 blocks.
 func TestMaximumBlockRange(t *testing.T) {
-	ethereum_client, err := ethclient.Dial(rpcSource)
-	if err != nil {
-		panic(err) // Crash if no access to RPC.
+	server := newSepoliaServer()
+	defer server.Close()
+	server.SetRangeLimit(5)
+
+	list, err := FetchRedeemEventsRPC(context.Background(), server.URL(), RedeemEvent, 5618691, 5618695)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("search within the range limit returned %d redeems, %v", len(list), err)
+	}
+	if _, err := FetchRedeemEventsRPC(context.Background(), server.URL(), RedeemEvent, 5618691, 5618696); err == nil {
+		t.Fatal("search past the range limit did not fail")
+	}
+	trackerobj := NewTracker(server.URL(), 4, RedeemEvent)
+	found, err := trackerobj.FindRedeems(context.Background(), 5618691, 5618800)
+	if err != nil || found != len(sepoliaRedeems) {
+		t.Fatalf("windowed search found %d redeems, %v", found, err)
+	}
+}
+
+func TestFindRedeemsSurfacesRpcErrors(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	trackerobj := NewTracker(server.URL(), 4, RedeemEvent)
+	server.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+	if _, err := trackerobj.FindRedeems(context.Background(), 5618691, 5618700); err == nil {
+		t.Fatal("RPC failure was not returned")
 	}
-	defer ethereum_client.Close()
-	list, err := FetchRedeemEventsRPC(rpcSource, RedeemEvent, 5618691, 5618695)
+	if trackerobj.FinalizedHeight() != 0 {
+		t.Error("failed search advanced the finalized height")
+	}
+	// Searching again recovers, and the retried window is not double counted.
+	if found, err := trackerobj.FindRedeems(context.Background(), 5618691, 5618700); err != nil || found != 1 {
+		t.Fatalf("retried search found %d redeems, %v", found, err)
+	}
+}
+
+// Cancelling the context stops a search waiting to retry a failed call, rather than waiting out the backoff.
+func TestFindRedeemsCancelled(t *testing.T) {
+	server := newSepoliaServer()
+	defer server.Close()
+	trackerobj, err := New(WithEvent(NewRedeemEvent(redeemed, contractAddress, 5618691)), WithEndpoints(server.URL()), WithSearchLimit(10), WithRetries(3, time.Hour))
 	if err != nil {
-		t.Log(err)
+		t.Fatal(err)
 	}
-	if len(list) > 0 {
-		for i := range list {
-			print(list[i].ToString())
+	cancelled := func(search func(ctx context.Context) error) error {
+		t.Helper()
+		calls := server.Calls("eth_getLogs")
+		server.FailNext("eth_getLogs", &rpctest.Error{Code: -32000, Message: "upstream unavailable"})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- search(ctx) }()
+		waitUntil(t, func() bool { return server.Calls("eth_getLogs") > calls })
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("search kept running after it was cancelled")
+			return nil
 		}
 	}
+
+	err = cancelled(func(ctx context.Context) error {
+		_, err := trackerobj.FindRedeems(ctx, 5618691, 5618800)
+		return err
+	})
+	if !errors.Is(err, context.Canceled) || trackerobj.FinalizedHeight() != 0 {
+		t.Fatalf("cancelled search returned %v at height %d", err, trackerobj.FinalizedHeight())
+	}
+	// StartTracking stops during the historical search too.
+	cancelled(func(ctx context.Context) error {
+		trackerobj.StartTracking(ctx, time.Minute, 20)
+		return nil
+	})
+	select {
+	case <-trackerobj.Synced():
+		t.Error("tracker synced by a cancelled historical search")
+	default:
+	}
 }
 
 func TestHex(t *testing.T) {
 	fromBlock := 5729623
-	t.Log(string(fmt.Sprintf("0x%x", fromBlock)))
+	if hexBlock := fmt.Sprintf("0x%x", fromBlock); hexBlock != "0x576d57" {
+		t.Error("unexpected hex block", hexBlock)
+	}
 }
 
 func TestUnlimitedBlockRange(t *testing.T) {
 	trackerobj := NewTracker(rpcSource, 0, NewRedeemEvent(redeemed, contractAddress, deployBlock))
 	// Test longer range with historical fetch loop.
-	trackerobj.FindVPassHistorical(5618693, 5729623, t)
+	if found := trackerobj.FindVPassHistorical(5618693, 5729623, t); found != len(sepoliaRedeems) {
+		t.Errorf("found %d redeems, want %d", found, len(sepoliaRedeems))
+	}
 
-	trackerobj.StartTracking(context.Background(), 2*time.Second, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trackerobj.StartTracking(ctx, 2*time.Second, 20)
+	<-trackerobj.Synced()
+	if len(trackerobj.validatorList) != len(sepoliaRedeems) {
+		t.Errorf("tracker holds %d redeems after re-scanning, want %d", len(trackerobj.validatorList), len(sepoliaRedeems))
+	}
 }
 
 func TestAddToMap(t *testing.T) {
 	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, 5618691))
 	trackerobj.AddToAddressMap(*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000", "5618691"))
-	t.Log(trackerobj.addressMap["0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"][0].ToString())
+	t.Log(trackerobj.addressMap["61A83A39C806449DDC66FEB6C86A1994456A8C8B"][0].ToString())
 }
 
 // /////////////////// Helper functions /////////////////////
-func FindVPassinRange(toblock int, fromblock int, t *testing.T) {
-	list, err := FetchRedeemEventsRPC(rpcSource, NewRedeemEvent(redeemed, contractAddress, deployBlock), toblock, fromblock)
+func FindVPassinRange(toblock int, fromblock int, t *testing.T) int {
+	list, err := FetchRedeemEventsRPC(context.Background(), rpcSource, NewRedeemEvent(redeemed, contractAddress, deployBlock), toblock, fromblock)
 	if err != nil {
 		panic(err)
 	}
@@ -127,10 +249,11 @@ func FindVPassinRange(toblock int, fromblock int, t *testing.T) {
 		t.Log("Found Validator pass with token id: ", list[vp].tokenId, "and validator address: ", list[vp].validatorAddress)
 	}
 	t.Log("Found", len(list), "NFTs")
+	return len(list)
 }
 
-func (nft_tracker *Tracker) FindVPassHistorical(toblock int, fromblock int, t *testing.T) {
-	list, err := nft_tracker.FetchAppendRedeems(toblock, fromblock)
+func (nft_tracker *Tracker) FindVPassHistorical(toblock int, fromblock int, t *testing.T) int {
+	list, err := nft_tracker.FetchAppendRedeems(context.Background(), toblock, fromblock)
 	if err != nil {
 		panic(err)
 	}
@@ -141,4 +264,56 @@ func (nft_tracker *Tracker) FindVPassHistorical(toblock int, fromblock int, t *t
 		t.Log("Found Validator pass with token id: ", list[vp].tokenId, "and validator address: ", list[vp].validatorAddress)
 	}
 	t.Log("Found", len(list), "NFTs")
+	return len(list)
+}
+
+func TestVerifySameBlockReRedeem(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, 5618691))
+	const tokenId = "0x0000000000000000000000000000000000000000000000000000000000000001"
+	const firstAddress = "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"
+	const secondAddress = "0x2757295701725127590000000000000000000000000000000000000000000000"
+	// Ingest the later log first to make sure ordering does not depend on arrival order.
+	later := *NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: []string{"", tokenId}, Data: secondAddress, BlockNumber: "0x55bc08", TransactionIndex: "0x3", LogIndex: "0x7"})
+	earlier := *NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: []string{"", tokenId}, Data: firstAddress, BlockNumber: "0x55bc08", TransactionIndex: "0x1", LogIndex: "0x2"})
+	for _, event := range []Validator_RedeemEvent{later, earlier} {
+		trackerobj.AddToTokenIdMap(event)
+		trackerobj.AddToAddressMap(event)
+	}
+	if !VerifyValidatorAddress(secondAddress, tokenId, trackerobj) {
+		t.Error("latest redeem in the block was not authorised")
+	}
+	if VerifyValidatorAddress(firstAddress, tokenId, trackerobj) {
+		t.Error("earlier redeem in the same block was still authorised")
+	}
+	if VerifyAddress(firstAddress, trackerobj) || !VerifyAddress(secondAddress, trackerobj) {
+		t.Error("VerifyAddress did not resolve the re-redeem by log position")
+	}
+}
+
+func TestIngestIsIdempotent(t *testing.T) {
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, 5618691))
+	log := RedeemEventRpc{
+		Topics:           []string{RedeemEvent.EventSignature, "0x0000000000000000000000000000000000000000000000000000000000000001"},
+		Data:             "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000",
+		BlockNumber:      "0x55bc08",
+		TransactionHash:  "0xABC0000000000000000000000000000000000000000000000000000000000001",
+		TransactionIndex: "0x0",
+		LogIndex:         "0x4",
+	}
+	if !trackerobj.ingestRedeem(*NewValidatorRedeemEventFromLog(log)) {
+		t.Fatal("first ingestion of a log was treated as a duplicate")
+	}
+	// Re-scanning the same range returns the same log, possibly with a differently cased hash.
+	log.TransactionHash = "0xabc0000000000000000000000000000000000000000000000000000000000001"
+	if trackerobj.ingestRedeem(*NewValidatorRedeemEventFromLog(log)) {
+		t.Fatal("second ingestion of the same log was not deduplicated")
+	}
+	if len(trackerobj.validatorList) != 1 || len(trackerobj.tokenIdMap[log.Topics[1]]) != 1 || len(trackerobj.addressMap["61A83A39C806449DDC66FEB6C86A1994456A8C8B"]) != 1 {
+		t.Fatalf("state changed on re-ingestion: %d events", len(trackerobj.validatorList))
+	}
+	// A different log in the same transaction is a separate redeem.
+	log.LogIndex = "0x5"
+	if !trackerobj.ingestRedeem(*NewValidatorRedeemEventFromLog(log)) {
+		t.Fatal("distinct log in the same transaction was deduplicated")
+	}
 }
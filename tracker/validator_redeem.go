@@ -1,20 +1,32 @@
 package validatorpass_tracker
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
+	cmtcrypto "github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
 // VALIDATOR REDEEM EVENTS
 
 type Validator_RedeemEvent struct { // Optimisation: store strings as bytes[32] if memory is an issue
-	tokenId             string // NFT token ID
-	validatorAddress    string // CometBFT validator address
-	redeemedBlockHeight int64  // Block height at which the validator pass was redeemed
+	tokenId             string            // NFT token ID
+	validatorAddress    string            // Raw bytes32 validator payload as emitted by the contract
+	cometAddress        cmtcrypto.Address // CometBFT validator address decoded from the payload
+	pubKey              cmtcrypto.PubKey  // CometBFT consensus public key, only set for EncodingEd25519PubKey payloads
+	nodeId              string            // CometBFT p2p node ID, only set for events tracked WithNodeIdBinding
+	redeemedBlockHeight int64             // Block height at which the validator pass was redeemed
+	txIndex             int64             // Index of the redeem transaction within its block
+	logIndex            int64             // Index of the redeem log within its block
+	txHash              string            // Hash of the redeem transaction, together with logIndex this identifies the log
+	decodeErr           error             // Why part of the log could not be decoded, logged by the tracker when ingesting
 }
 
 // Records validator pass redeem events including the redeemed validator address and the the block height at which it was redeemed.
@@ -23,18 +35,161 @@ type Validator_RedeemEvent struct { // Optimisation: store strings as bytes[32]
 func NewValidatorRedeemEvent(tokenId string, validatorAddress string, redeemedBlockHeight string) *Validator_RedeemEvent {
 	heightNumerical, err := strconv.ParseInt(redeemedBlockHeight, 0, 0)
 	if err != nil {
-		fmt.Println("Unable to convert blockNumber response to integer: ", redeemedBlockHeight, err)
+		err = fmt.Errorf("invalid blockNumber %q: %w", redeemedBlockHeight, err)
 		heightNumerical = 0
 	}
-	return &Validator_RedeemEvent{
+	vRedeem := &Validator_RedeemEvent{
 		tokenId:             tokenId,
 		validatorAddress:    validatorAddress,
 		redeemedBlockHeight: heightNumerical,
+		decodeErr:           err,
+	}
+	vRedeem.setDecodeErr(vRedeem.decodePayload(EncodingTruncatedAddress))
+	return vRedeem
+}
+
+// Decode the CometBFT address (and public key) from the raw payload using the encoding of the tracked event.
+func (vRedeem *Validator_RedeemEvent) decodePayload(encoding PayloadEncoding) error {
+	address, pubKey, err := DecodeValidatorPayload(vRedeem.validatorAddress, encoding)
+	vRedeem.cometAddress = address
+	vRedeem.pubKey = pubKey
+	return err
+}
+
+// Records a validator pass redeem event from an eth_getLogs response, including its position within the block.
+// The position (transaction index and log index) orders redeems that happen within the same block.
+// A log without a tokenId topic is recorded with an empty tokenId and a decoding error, the tracker skips it.
+func NewValidatorRedeemEventFromLog(log RedeemEventRpc) *Validator_RedeemEvent {
+	tokenId, topicsErr := "", error(nil)
+	if len(log.Topics) >= 2 {
+		tokenId = log.Topics[1]
+	} else {
+		topicsErr = fmt.Errorf("log has %d topics, expected the event signature and tokenId", len(log.Topics))
+	}
+	vRedeem := NewValidatorRedeemEvent(tokenId, log.Data, log.BlockNumber)
+	vRedeem.setDecodeErr(topicsErr)
+	var txIndexErr, logIndexErr error
+	vRedeem.txIndex, txIndexErr = parseHexIndex(log.TransactionIndex)
+	vRedeem.logIndex, logIndexErr = parseHexIndex(log.LogIndex)
+	vRedeem.setDecodeErr(errors.Join(txIndexErr, logIndexErr))
+	vRedeem.txHash = strings.ToLower(log.TransactionHash)
+	return vRedeem
+}
+
+// Indexes missing from the RPC response are treated as 0, the same as the first position in a block.
+func parseHexIndex(index string) (int64, error) {
+	if index == "" {
+		return 0, nil
+	}
+	indexNumerical, err := strconv.ParseInt(index, 0, 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid index %q: %w", index, err)
+	}
+	return indexNumerical, nil
+}
+
+// Record a decoding problem, keeping earlier ones. Decoding carries on so one bad field doesn't drop the event.
+func (vRedeem *Validator_RedeemEvent) setDecodeErr(err error) {
+	if err != nil {
+		vRedeem.decodeErr = errors.Join(vRedeem.decodeErr, err)
 	}
 }
 
 func (vRedeem *Validator_RedeemEvent) ToString() string {
-	return fmt.Sprintf("TokenId: %s, Validator Address: %s, Redeemed@Height: %d", vRedeem.tokenId, vRedeem.validatorAddress, vRedeem.redeemedBlockHeight)
+	return fmt.Sprintf("TokenId: %s, Validator Address: %s, CometBFT Address: %s, Redeemed@Height: %d, TxIndex: %d, LogIndex: %d", vRedeem.tokenId, vRedeem.validatorAddress, vRedeem.cometAddress, vRedeem.redeemedBlockHeight, vRedeem.txIndex, vRedeem.logIndex)
+}
+
+// The redeemed token's ID, as the 0x-prefixed 32 byte hex topic emitted by the contract.
+func (vRedeem *Validator_RedeemEvent) TokenId() string {
+	return vRedeem.tokenId
+}
+
+// The raw bytes32 payload emitted by the contract, from which the CometBFT address is decoded.
+func (vRedeem *Validator_RedeemEvent) Payload() string {
+	return vRedeem.validatorAddress
+}
+
+// The Ethereum block the pass was redeemed in.
+func (vRedeem *Validator_RedeemEvent) BlockNumber() int64 {
+	return vRedeem.redeemedBlockHeight
+}
+
+// The hash of the redeem transaction, empty for events built without one.
+func (vRedeem *Validator_RedeemEvent) TransactionHash() string {
+	return vRedeem.txHash
+}
+
+// The position of the redeem within its block: the transaction index and the log index.
+func (vRedeem *Validator_RedeemEvent) Position() (txIndex int64, logIndex int64) {
+	return vRedeem.txIndex, vRedeem.logIndex
+}
+
+// A copy that shares no memory with the tracker's state, to hand out to callers.
+func (vRedeem *Validator_RedeemEvent) clone() Validator_RedeemEvent {
+	cloned := *vRedeem
+	cloned.cometAddress = bytes.Clone(vRedeem.cometAddress)
+	if pubKey, ok := vRedeem.pubKey.(ed25519.PubKey); ok {
+		cloned.pubKey = ed25519.PubKey(bytes.Clone(pubKey))
+	}
+	return cloned
+}
+
+func cloneRedeems(redeems []Validator_RedeemEvent) []Validator_RedeemEvent {
+	cloned := make([]Validator_RedeemEvent, len(redeems))
+	for i := range redeems {
+		cloned[i] = redeems[i].clone()
+	}
+	return cloned
+}
+
+// Identity of the log that emitted this redeem event, used to ingest every log exactly once.
+// Events built without a transaction hash fall back to their on-chain position.
+func (vRedeem *Validator_RedeemEvent) LogKey() string {
+	if vRedeem.txHash == "" {
+		return fmt.Sprintf("%d:%d:%d", vRedeem.redeemedBlockHeight, vRedeem.txIndex, vRedeem.logIndex)
+	}
+	return fmt.Sprintf("%s:%d", vRedeem.txHash, vRedeem.logIndex)
+}
+
+// ORDERING
+
+// Compare the on-chain position of two redeem events by (block height, transaction index, log index).
+// Returns -1 if a happened before b, 1 if a happened after b and 0 if they are the same log.
+func CompareRedeemEvents(a Validator_RedeemEvent, b Validator_RedeemEvent) int {
+	switch {
+	case a.redeemedBlockHeight != b.redeemedBlockHeight:
+		return compareInt64(a.redeemedBlockHeight, b.redeemedBlockHeight)
+	case a.txIndex != b.txIndex:
+		return compareInt64(a.txIndex, b.txIndex)
+	default:
+		return compareInt64(a.logIndex, b.logIndex)
+	}
+}
+
+func compareInt64(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Returns true if this redeem event happened on-chain after the other redeem event.
+func (vRedeem *Validator_RedeemEvent) IsAfter(other Validator_RedeemEvent) bool {
+	return CompareRedeemEvents(*vRedeem, other) > 0
+}
+
+// Insert a redeem event into a list that is already ordered by on-chain position, keeping it ordered.
+// The latest redeem event is always the last element of the list.
+func insertOrdered(redeemList []Validator_RedeemEvent, newRedeem Validator_RedeemEvent) []Validator_RedeemEvent {
+	position := sort.Search(len(redeemList), func(i int) bool {
+		return CompareRedeemEvents(redeemList[i], newRedeem) > 0
+	})
+	redeemList = append(redeemList, Validator_RedeemEvent{})
+	copy(redeemList[position+1:], redeemList[position:])
+	redeemList[position] = newRedeem
+	return redeemList
 }
 
 // RPC Redeem events that we are interested in and what contract they are associated to.
@@ -42,6 +197,8 @@ type Rpc_RedeemEvent struct {
 	EventSignature  string // Redeemed(uint256,bytes32)
 	contractAddress string
 	deployBlock     int
+	payloadEncoding PayloadEncoding // How the redeem payload encodes the CometBFT validator identity
+	bindsNodeId     bool            // Whether the redeem payload also carries a p2p node ID
 }
 
 // Function for initialising the ethereum events you are interested in tracking, requires event, contract address and deploy block.
@@ -53,6 +210,40 @@ func NewRedeemEvent(event string, contractAddress string, deployBlock int) Rpc_R
 		EventSignature:  GetEventSignature(event),
 		contractAddress: contractAddress,
 		deployBlock:     deployBlock,
+		payloadEncoding: EncodingTruncatedAddress,
+	}
+}
+
+// Returns a copy of the event that decodes redeem payloads with the given encoding, eg. EncodingEd25519PubKey
+// for contracts where validators redeem with their consensus public key.
+func (event Rpc_RedeemEvent) WithPayloadEncoding(encoding PayloadEncoding) Rpc_RedeemEvent {
+	event.payloadEncoding = encoding
+	return event
+}
+
+// Decode an eth_getLogs entry for this event into a redeem event, using the event's payload encoding.
+func (event Rpc_RedeemEvent) decodeLog(log RedeemEventRpc) *Validator_RedeemEvent {
+	vRedeem := NewValidatorRedeemEventFromLog(log)
+	if event.payloadEncoding != EncodingTruncatedAddress {
+		// Payloads fail to decode for the same reasons with every encoding, the error is already recorded.
+		vRedeem.decodePayload(event.payloadEncoding)
+	}
+	if event.bindsNodeId {
+		vRedeem.decodeNodeId()
+	}
+	return vRedeem
+}
+
+// Convert a redeem event back into the eth_getLogs form it was decoded from.
+func (vRedeem *Validator_RedeemEvent) toLog(event Rpc_RedeemEvent) RedeemEventRpc {
+	return RedeemEventRpc{
+		Address:          event.contractAddress,
+		Topics:           []string{event.EventSignature, vRedeem.tokenId},
+		Data:             vRedeem.validatorAddress,
+		BlockNumber:      fmt.Sprintf("0x%x", vRedeem.redeemedBlockHeight),
+		TransactionHash:  vRedeem.txHash,
+		TransactionIndex: fmt.Sprintf("0x%x", vRedeem.txIndex),
+		LogIndex:         fmt.Sprintf("0x%x", vRedeem.logIndex),
 	}
 }
 
@@ -88,8 +279,8 @@ func GetEventSignature(eventString string) string {
 func UpdateRedeemEvent(newRedeem Validator_RedeemEvent, redeemList []Validator_RedeemEvent) (updatedList []Validator_RedeemEvent) {
 	for redeem := range redeemList { // For each redeem if for the same tokenId
 		if redeemList[redeem].tokenId == newRedeem.tokenId {
-			// Double check that the newRedeem has a higher recorded block height.
-			if newRedeem.redeemedBlockHeight > redeemList[redeem].redeemedBlockHeight {
+			// Double check that the newRedeem happened after the recorded redeem.
+			if newRedeem.IsAfter(redeemList[redeem]) {
 				updatedList = append(updatedList, newRedeem)
 			}
 		} else { // Add events for new tokenId and keep events relating to unique tokenIds (eg. not the same as newRedeem's)
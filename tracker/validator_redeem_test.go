@@ -1,3 +1,95 @@
 package validatorpass_tracker
 
+import (
+	"context"
+	"testing"
+)
+
 // Basic tests for the functions in these objects
+
+func TestCompareRedeemEvents(t *testing.T) {
+	first := *NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: []string{"", "0x01"}, Data: "0xaa", BlockNumber: "0x10", TransactionIndex: "0x1", LogIndex: "0x2"})
+	sameTx := *NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: []string{"", "0x01"}, Data: "0xbb", BlockNumber: "0x10", TransactionIndex: "0x1", LogIndex: "0x3"})
+	laterTx := *NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: []string{"", "0x01"}, Data: "0xcc", BlockNumber: "0x10", TransactionIndex: "0x2", LogIndex: "0x0"})
+	laterBlock := *NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: []string{"", "0x01"}, Data: "0xdd", BlockNumber: "0x11", TransactionIndex: "0x0", LogIndex: "0x0"})
+
+	ordered := []Validator_RedeemEvent{first, sameTx, laterTx, laterBlock}
+	for i := range ordered {
+		for j := range ordered {
+			want := compareInt64(int64(i), int64(j))
+			if got := CompareRedeemEvents(ordered[i], ordered[j]); got != want {
+				t.Errorf("CompareRedeemEvents(%d, %d) = %d, want %d", i, j, got, want)
+			}
+		}
+	}
+	if !laterTx.IsAfter(sameTx) || sameTx.IsAfter(laterTx) {
+		t.Error("IsAfter does not follow transaction index within a block")
+	}
+}
+
+func TestMalformedLog(t *testing.T) {
+	for _, topics := range [][]string{nil, {RedeemEvent.EventSignature}} {
+		vRedeem := NewValidatorRedeemEventFromLog(RedeemEventRpc{Topics: topics, Data: "0xaa", BlockNumber: "0x10"})
+		if vRedeem.tokenId != "" || vRedeem.decodeErr == nil {
+			t.Errorf("log with %d topics decoded as %+v", len(topics), vRedeem)
+		}
+	}
+
+	// The tracker skips the malformed log and ingests the rest.
+	logs := []RedeemEventRpc{
+		{Topics: []string{RedeemEvent.EventSignature}, Data: "0xaa", BlockNumber: "0x10"},
+		{Topics: []string{RedeemEvent.EventSignature, "0x01"}, Data: "0xbb", BlockNumber: "0x11"},
+	}
+	trackerobj := NewTrackerWithSource(NewStaticSource(0x20, logs), 0, NewRedeemEvent(DefaultRedeemEvent, "", 0))
+	if _, err := trackerobj.FindRedeems(context.Background(), 0, 0x20); err != nil {
+		t.Fatal(err)
+	}
+	if len(trackerobj.validatorList) != 1 || trackerobj.validatorList[0].tokenId != "0x0000000000000000000000000000000000000000000000000000000000000001" {
+		t.Errorf("ingested %v", trackerobj.validatorList)
+	}
+}
+
+// A tokenId written differently, in a topic or by a caller, is the same token at every entry point.
+func TestTokenIdCanonicalised(t *testing.T) {
+	const address = "0x61a83a39c806449ddc66feb6c86a1994456a8c8b000000000000000000000000"
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	trackerobj.ingestRedeem(*NewValidatorRedeemEvent("0x1", address, "0x10"))
+	trackerobj.ingestRedeem(*NewValidatorRedeemEvent("0x0000000000000000000000000000000000000000000000000000000000000001", address, "0x11"))
+	trackerobj.setFinalizedHeight(0x20, "")
+	if len(trackerobj.tokenIdMap) != 1 {
+		t.Fatalf("one token indexed under %d tokenIds", len(trackerobj.tokenIdMap))
+	}
+	for _, tokenId := range []string{"1", "0x1", "0x01", "0x0000000000000000000000000000000000000000000000000000000000000001"} {
+		if !VerifyValidatorAddress(address, tokenId, trackerobj) {
+			t.Errorf("token %s not verified", tokenId)
+		}
+		if authorised, err := VerifyValidatorAddressAt(address, tokenId, 0x10, trackerobj); err != nil || !authorised {
+			t.Errorf("token %s not verified at its first redeem: %v", tokenId, err)
+		}
+		if history, err := trackerobj.TokenHistory(tokenId); err != nil || len(history) != 2 {
+			t.Errorf("token %s has %d redeems, %v", tokenId, len(history), err)
+		}
+	}
+	if VerifyValidatorAddress(address, "not a tokenId", trackerobj) {
+		t.Error("invalid tokenId verified")
+	}
+}
+
+func TestInsertOrdered(t *testing.T) {
+	events := []Validator_RedeemEvent{
+		{tokenId: "0x01", validatorAddress: "0xcc", redeemedBlockHeight: 16, txIndex: 2},
+		{tokenId: "0x01", validatorAddress: "0xaa", redeemedBlockHeight: 16, txIndex: 1, logIndex: 0},
+		{tokenId: "0x01", validatorAddress: "0xdd", redeemedBlockHeight: 17},
+		{tokenId: "0x01", validatorAddress: "0xbb", redeemedBlockHeight: 16, txIndex: 1, logIndex: 5},
+	}
+	list := []Validator_RedeemEvent{}
+	for _, event := range events {
+		list = insertOrdered(list, event)
+	}
+	want := []string{"0xaa", "0xbb", "0xcc", "0xdd"}
+	for i := range want {
+		if list[i].validatorAddress != want[i] {
+			t.Fatalf("position %d has %s, want %s", i, list[i].validatorAddress, want[i])
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	cmtproto "github.com/cometbft/cometbft/proto/tendermint/types"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// CONSENSUS-AGREED ETHEREUM HEIGHT
+
+// Size of the tracker's part of a vote extension: its finalized Ethereum height as a big endian uint64.
+const heightExtensionSize = 8
+
+// Prefix of the transaction the proposer injects to carry the agreed Ethereum height and the votes it was derived from.
+var agreedHeightTxPrefix = []byte("agreed-height:")
+
+// Enable consensus on the Ethereum height used to authorise joins, using ABCI++ vote extensions.
+// Each validator extends its precommit with its tracker's finalized height, the proposer derives the height
+// that more than 2/3 of the voting power has reached and commits it at the start of the block, and FinalizeBlock
+// feeds it into the tracker so joins are verified against the same height on every node. Proposals only carry a
+// height the proposer's tracker has reached, and validators reject proposals carrying a height their own tracker has
+// not reached, so FinalizeBlock only waits for the tracker when replaying or block syncing blocks it did not vote on.
+// Requires vote extensions to be enabled in the consensus parameters (VoteExtensionsEnableHeight).
+// Vote extensions of the wrapped application are carried after the tracker's height and passed through unchanged.
+func (app *AuthorisedApplication) EnableHeightAgreement() *AuthorisedApplication {
+	app.heightAgreement = true
+	return app
+}
+
+// Derive the agreed Ethereum height from the extended votes of the last commit: the highest height that
+// validators holding more than 2/3 of the voting power have finalized.
+// Absent votes and votes without a valid extension count towards the total power but not towards any height.
+func AgreedEthereumHeight(votes []abcitypes.ExtendedVoteInfo) (int64, bool) {
+	type reportedHeight struct {
+		height int64
+		power  int64
+	}
+	reports := []reportedHeight{}
+	var totalPower int64
+	for _, vote := range votes {
+		totalPower += vote.Validator.Power
+		if vote.BlockIdFlag != cmtproto.BlockIDFlagCommit {
+			continue
+		}
+		height, _, err := splitHeightExtension(vote.VoteExtension)
+		if err != nil {
+			continue
+		}
+		reports = append(reports, reportedHeight{height: height, power: vote.Validator.Power})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].height > reports[j].height
+	})
+	var accumulatedPower int64
+	for _, report := range reports {
+		accumulatedPower += report.power
+		if accumulatedPower*3 > totalPower*2 {
+			return report.height, true
+		}
+	}
+	return 0, false
+}
+
+// Split a vote extension into the tracker's finalized height and the wrapped application's extension.
+func splitHeightExtension(extension []byte) (int64, []byte, error) {
+	if len(extension) < heightExtensionSize {
+		return 0, nil, fmt.Errorf("vote extension is %d bytes, expected at least %d", len(extension), heightExtensionSize)
+	}
+	height := binary.BigEndian.Uint64(extension[:heightExtensionSize])
+	if height > uint64(1<<62) {
+		return 0, nil, fmt.Errorf("vote extension height %d out of range", height)
+	}
+	return int64(height), extension[heightExtensionSize:], nil
+}
+
+// Remove the tracker's height from the vote extensions so the wrapped application only sees its own extensions.
+func stripHeightExtensions(commit abcitypes.ExtendedCommitInfo) abcitypes.ExtendedCommitInfo {
+	votes := make([]abcitypes.ExtendedVoteInfo, len(commit.Votes))
+	for i, vote := range commit.Votes {
+		votes[i] = vote
+		if _, innerExtension, err := splitHeightExtension(vote.VoteExtension); err == nil {
+			votes[i].VoteExtension = innerExtension
+		}
+	}
+	return abcitypes.ExtendedCommitInfo{Round: commit.Round, Votes: votes}
+}
+
+// Decode an agreed height transaction, returning the commit it was derived from.
+func decodeAgreedHeightTx(tx []byte) (abcitypes.ExtendedCommitInfo, bool, error) {
+	if !bytes.HasPrefix(tx, agreedHeightTxPrefix) {
+		return abcitypes.ExtendedCommitInfo{}, false, nil
+	}
+	commit := abcitypes.ExtendedCommitInfo{}
+	if err := commit.Unmarshal(bytes.TrimPrefix(tx, agreedHeightTxPrefix)); err != nil {
+		return abcitypes.ExtendedCommitInfo{}, true, fmt.Errorf("invalid agreed height transaction: %w", err)
+	}
+	return commit, true, nil
+}
+
+// Record the chain ID and the genesis validators' keys, which vote extension signatures are verified with.
+func (app *AuthorisedApplication) InitChain(ctx context.Context, req *abcitypes.RequestInitChain) (*abcitypes.ResponseInitChain, error) {
+	res, err := app.Application.InitChain(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.chainID = req.ChainId
+	validators := req.Validators
+	if len(res.Validators) > 0 {
+		validators = res.Validators // The wrapped application replaced the genesis validators.
+	}
+	return res, app.recordValidatorKeys(validators)
+}
+
+// Remember the keys of validators in updates, so their vote extensions can be verified once they vote. Keys are
+// kept after a validator is removed, it may still have voted in the last commit. The caller must hold the app lock.
+func (app *AuthorisedApplication) recordValidatorKeys(updates []abcitypes.ValidatorUpdate) error {
+	for _, update := range updates {
+		pubKey, err := cryptoenc.PubKeyFromProto(update.PubKey)
+		if err != nil {
+			return err
+		}
+		app.validatorKeys[addressKey(pubKey.Address())] = pubKey
+	}
+	return nil
+}
+
+// Extend the precommit with the tracker's finalized Ethereum height.
+func (app *AuthorisedApplication) ExtendVote(ctx context.Context, req *abcitypes.RequestExtendVote) (*abcitypes.ResponseExtendVote, error) {
+	res, err := app.Application.ExtendVote(ctx, req)
+	if err != nil || !app.heightAgreement {
+		return res, err
+	}
+	extension := binary.BigEndian.AppendUint64(make([]byte, 0, heightExtensionSize+len(res.VoteExtension)), uint64(app.trackerIns.FinalizedHeight()))
+	return &abcitypes.ResponseExtendVote{VoteExtension: append(extension, res.VoteExtension...)}, nil
+}
+
+// Reject vote extensions that do not start with a well formed height, then let the wrapped application verify its own part.
+// The height itself can't be checked, another validator's tracker may be ahead of or behind this one.
+func (app *AuthorisedApplication) VerifyVoteExtension(ctx context.Context, req *abcitypes.RequestVerifyVoteExtension) (*abcitypes.ResponseVerifyVoteExtension, error) {
+	if !app.heightAgreement {
+		return app.Application.VerifyVoteExtension(ctx, req)
+	}
+	_, innerExtension, err := splitHeightExtension(req.VoteExtension)
+	if err != nil {
+		return &abcitypes.ResponseVerifyVoteExtension{Status: abcitypes.ResponseVerifyVoteExtension_REJECT}, nil
+	}
+	innerReq := *req
+	innerReq.VoteExtension = innerExtension
+	return app.Application.VerifyVoteExtension(ctx, &innerReq)
+}
+
+// Prepend the agreed height transaction to the wrapped application's proposal, when enough validators reported a height
+// and this node's tracker has reached it. Agreed height transactions from the mempool are dropped, they would get
+// the proposal rejected.
+func (app *AuthorisedApplication) PrepareProposal(ctx context.Context, req *abcitypes.RequestPrepareProposal) (*abcitypes.ResponsePrepareProposal, error) {
+	if !app.heightAgreement {
+		return app.Application.PrepareProposal(ctx, req)
+	}
+	var agreedTx []byte
+	if height, agreed := AgreedEthereumHeight(req.LocalLastCommit.Votes); agreed && height <= app.trackerIns.FinalizedHeight() {
+		encodedCommit, err := req.LocalLastCommit.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		agreedTx = append(append([]byte{}, agreedHeightTxPrefix...), encodedCommit...)
+	}
+
+	innerReq := *req
+	innerReq.Txs = withoutAgreedHeightTxs(req.Txs)
+	innerReq.LocalLastCommit = stripHeightExtensions(req.LocalLastCommit)
+	innerReq.MaxTxBytes -= int64(len(agreedTx))
+	res, err := app.Application.PrepareProposal(ctx, &innerReq)
+	if err != nil {
+		return nil, err
+	}
+	res.Txs = withoutAgreedHeightTxs(res.Txs)
+	if agreedTx != nil {
+		res.Txs = append([][]byte{agreedTx}, res.Txs...)
+	}
+	return res, nil
+}
+
+// Returns the transactions without the ones using the agreed height prefix.
+func withoutAgreedHeightTxs(txs [][]byte) [][]byte {
+	kept := make([][]byte, 0, len(txs))
+	for _, tx := range txs {
+		if !bytes.HasPrefix(tx, agreedHeightTxPrefix) {
+			kept = append(kept, tx)
+		}
+	}
+	return kept
+}
+
+// Reject proposals whose agreed height transaction does not match the last commit, or that carry it anywhere but
+// first, or whose agreed height this node's tracker has not reached yet.
+func (app *AuthorisedApplication) ProcessProposal(ctx context.Context, req *abcitypes.RequestProcessProposal) (*abcitypes.ResponseProcessProposal, error) {
+	if !app.heightAgreement {
+		return app.Application.ProcessProposal(ctx, req)
+	}
+	reject := &abcitypes.ResponseProcessProposal{Status: abcitypes.ResponseProcessProposal_REJECT}
+	innerReq := *req
+	for i, tx := range req.Txs {
+		commit, isAgreedHeight, err := decodeAgreedHeightTx(tx)
+		if !isAgreedHeight {
+			continue
+		}
+		if i != 0 || err != nil || app.verifyAgreedHeightCommit(commit, req.ProposedLastCommit, req.Height-1) != nil {
+			return reject, nil
+		}
+		height, agreed := AgreedEthereumHeight(commit.Votes)
+		if !agreed || height > app.trackerIns.FinalizedHeight() {
+			return reject, nil
+		}
+		innerReq.Txs = req.Txs[1:]
+	}
+	return app.Application.ProcessProposal(ctx, &innerReq)
+}
+
+var (
+	errCommitMismatch            = errors.New("agreed height votes do not match the proposed last commit")
+	errInvalidExtensionSignature = errors.New("invalid vote extension signature")
+)
+
+// Check that the votes carried by an agreed height transaction are the votes of the last commit, at the given block
+// height. The validators, their power and their block ID flags are checked against the last commit so a proposer
+// can't invent or drop votes, and the extensions of commit votes against their validator's signature, the way
+// CometBFT's VerifyExtension does, so a proposer can't change the heights they report.
+func (app *AuthorisedApplication) verifyAgreedHeightCommit(commit abcitypes.ExtendedCommitInfo, lastCommit abcitypes.CommitInfo, height int64) error {
+	if commit.Round != lastCommit.Round || len(commit.Votes) != len(lastCommit.Votes) {
+		return errCommitMismatch
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	for i, vote := range commit.Votes {
+		lastVote := lastCommit.Votes[i]
+		if !bytes.Equal(vote.Validator.Address, lastVote.Validator.Address) || vote.Validator.Power != lastVote.Validator.Power || vote.BlockIdFlag != lastVote.BlockIdFlag {
+			return errCommitMismatch
+		}
+		if vote.BlockIdFlag != cmtproto.BlockIDFlagCommit {
+			continue // Only commit votes count towards the agreed height.
+		}
+		pubKey, known := app.validatorKeys[addressKey(vote.Validator.Address)]
+		if !known {
+			return fmt.Errorf("%w: unknown validator %X", errInvalidExtensionSignature, vote.Validator.Address)
+		}
+		signBytes := cmttypes.VoteExtensionSignBytes(app.chainID, &cmtproto.Vote{Height: height, Round: commit.Round, Extension: vote.VoteExtension})
+		if !pubKey.VerifySignature(signBytes, vote.ExtensionSignature) {
+			return fmt.Errorf("%w from validator %X", errInvalidExtensionSignature, vote.Validator.Address)
+		}
+	}
+	return nil
+}
+
+// Apply the agreed height transaction at the start of a block, before any joins in the block are verified.
+// Returns the transactions that remain for the rest of FinalizeBlock and the result of the agreed height transaction, if any.
+// The caller must hold the app lock.
+func (app *AuthorisedApplication) applyAgreedHeight(txs [][]byte) ([][]byte, *abcitypes.ExecTxResult) {
+	if !app.heightAgreement || len(txs) == 0 {
+		return txs, nil
+	}
+	commit, isAgreedHeight, err := decodeAgreedHeightTx(txs[0])
+	if !isAgreedHeight {
+		return txs, nil
+	}
+	if err != nil {
+		return txs[1:], &abcitypes.ExecTxResult{Code: CodeInvalidJoin, Log: err.Error()}
+	}
+	height, agreed := AgreedEthereumHeight(commit.Votes)
+	if !agreed {
+		return txs[1:], &abcitypes.ExecTxResult{Code: CodeInvalidJoin, Log: "no Ethereum height agreed by 2/3 of the voting power"}
+	}
+	// ProcessProposal only accepted the height once this node's tracker reached it. Blocks replayed after a restart or
+	// received through block sync skip ProcessProposal, their joins wait for the tracker, see authorise.
+	app.agreedHeight = max(app.agreedHeight, height)
+	app.trackerIns.SetAgreedHeight(height)
+	return txs[1:], &abcitypes.ExecTxResult{Code: abcitypes.CodeTypeOK, Log: fmt.Sprintf("agreed Ethereum height %d", height)}
+}
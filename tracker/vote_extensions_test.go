@@ -0,0 +1,176 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/cometbft/cometbft/crypto"
+	"github.com/cometbft/cometbft/crypto/ed25519"
+	cryptoenc "github.com/cometbft/cometbft/crypto/encoding"
+	cmtproto "github.com/cometbft/cometbft/proto/tendermint/types"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+func heightVote(address string, power int64, height uint64) abcitypes.ExtendedVoteInfo {
+	return abcitypes.ExtendedVoteInfo{
+		Validator:     abcitypes.Validator{Address: []byte(address), Power: power},
+		VoteExtension: binary.BigEndian.AppendUint64(nil, height),
+		BlockIdFlag:   cmtproto.BlockIDFlagCommit,
+	}
+}
+
+func TestAgreedEthereumHeight(t *testing.T) {
+	votes := []abcitypes.ExtendedVoteInfo{
+		heightVote("a", 10, 100),
+		heightVote("b", 10, 120),
+		heightVote("c", 10, 90),
+		heightVote("d", 10, 130),
+	}
+	// 2/3 of 40 is reached once 30 power is accounted for: 130, 120, 100.
+	if height, agreed := AgreedEthereumHeight(votes); !agreed || height != 100 {
+		t.Errorf("agreed height %d (%v), want 100", height, agreed)
+	}
+	votes[3].BlockIdFlag = cmtproto.BlockIDFlagAbsent
+	if height, agreed := AgreedEthereumHeight(votes); !agreed || height != 90 {
+		t.Errorf("agreed height with an absent vote %d (%v), want 90", height, agreed)
+	}
+	votes[2].VoteExtension = []byte{1}
+	if _, agreed := AgreedEthereumHeight(votes); agreed {
+		t.Error("height agreed without 2/3 of the voting power")
+	}
+}
+
+const testChainId = "nft-authorise-test"
+
+// A commit vote whose extension carries an Ethereum height, signed by the validator for the given block height.
+func signedHeightVote(privKey crypto.PrivKey, power int64, ethHeight uint64, blockHeight int64) abcitypes.ExtendedVoteInfo {
+	vote := heightVote(string(privKey.PubKey().Address()), power, ethHeight)
+	signBytes := cmttypes.VoteExtensionSignBytes(testChainId, &cmtproto.Vote{Height: blockHeight, Extension: vote.VoteExtension})
+	vote.ExtensionSignature, _ = privKey.Sign(signBytes)
+	return vote
+}
+
+func TestHeightAgreementFlow(t *testing.T) {
+	ctx := context.Background()
+	trackerobj := NewTracker(rpcSource, 4, NewRedeemEvent(redeemed, contractAddress, deployBlock).WithPayloadEncoding(EncodingEd25519PubKey))
+	early := ed25519.GenPrivKey().PubKey()
+	late := ed25519.GenPrivKey().PubKey()
+	redeemPubKey(trackerobj, "0x01", early, "0x64") // Block 100
+	redeemPubKey(trackerobj, "0x02", late, "0xc8")  // Block 200
+	trackerobj.setFinalizedHeight(200, "")
+
+	validators := []crypto.PrivKey{ed25519.GenPrivKey(), ed25519.GenPrivKey(), ed25519.GenPrivKey()}
+	genesis := []abcitypes.ValidatorUpdate{}
+	for _, validator := range validators {
+		protoKey, _ := cryptoenc.PubKeyToProto(validator.PubKey())
+		genesis = append(genesis, abcitypes.ValidatorUpdate{PubKey: protoKey, Power: 10})
+	}
+	app := NewAuthorisedApplication(&passThroughApp{}, trackerobj, nil).EnableHeightAgreement()
+	if _, err := app.InitChain(ctx, &abcitypes.RequestInitChain{ChainId: testChainId, Validators: genesis}); err != nil {
+		t.Fatal(err)
+	}
+	extended, err := app.ExtendVote(ctx, &abcitypes.RequestExtendVote{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height, _, err := splitHeightExtension(extended.VoteExtension); err != nil || height != 200 {
+		t.Fatalf("vote extension carries height %d, %v", height, err)
+	}
+	if res, _ := app.VerifyVoteExtension(ctx, &abcitypes.RequestVerifyVoteExtension{VoteExtension: []byte{1, 2}}); res.Status != abcitypes.ResponseVerifyVoteExtension_REJECT {
+		t.Error("malformed vote extension was accepted")
+	}
+
+	// Anyone could submit an agreed height transaction to get honest proposals rejected; it never enters the mempool,
+	// and one that got there anyway is dropped from the proposal.
+	injected := append(append([]byte{}, agreedHeightTxPrefix...), "forged"...)
+	if res, _ := app.CheckTx(ctx, &abcitypes.RequestCheckTx{Tx: injected}); res.Code != CodeReservedTx {
+		t.Errorf("CheckTx accepted an agreed height transaction with code %d", res.Code)
+	}
+
+	// Most validators have only scanned to block 150, so the late redeem must not be authorised yet.
+	commit := abcitypes.ExtendedCommitInfo{Votes: []abcitypes.ExtendedVoteInfo{
+		signedHeightVote(validators[0], 10, 200, 1),
+		signedHeightVote(validators[1], 10, 150, 1),
+		signedHeightVote(validators[2], 10, 150, 1),
+	}}
+	proposal, err := app.PrepareProposal(ctx, &abcitypes.RequestPrepareProposal{
+		Height:          2,
+		MaxTxBytes:      1 << 20,
+		Txs:             [][]byte{EncodeJoinTx(early, 5), injected, EncodeJoinTx(late, 5)},
+		LocalLastCommit: commit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proposal.Txs) != 3 {
+		t.Fatalf("proposal has %d transactions, want the agreed height and two joins", len(proposal.Txs))
+	}
+
+	lastCommit := abcitypes.CommitInfo{}
+	for _, vote := range commit.Votes {
+		lastCommit.Votes = append(lastCommit.Votes, abcitypes.VoteInfo{Validator: vote.Validator, BlockIdFlag: vote.BlockIdFlag})
+	}
+	processProposal := func(txs [][]byte, lastCommit abcitypes.CommitInfo) abcitypes.ResponseProcessProposal_ProposalStatus {
+		processed, err := app.ProcessProposal(ctx, &abcitypes.RequestProcessProposal{Height: 2, Txs: txs, ProposedLastCommit: lastCommit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return processed.Status
+	}
+	if processProposal(proposal.Txs, lastCommit) != abcitypes.ResponseProcessProposal_ACCEPT {
+		t.Fatal("valid proposal was rejected")
+	}
+	forgedPower := abcitypes.CommitInfo{Votes: append([]abcitypes.VoteInfo{}, lastCommit.Votes...)}
+	forgedPower.Votes[1].Validator.Power = 100
+	if processProposal(proposal.Txs, forgedPower) != abcitypes.ResponseProcessProposal_REJECT {
+		t.Fatal("proposal with forged votes was accepted")
+	}
+
+	// A proposer changing the heights validators reported breaks their extension signatures.
+	tampered := abcitypes.ExtendedCommitInfo{Votes: append([]abcitypes.ExtendedVoteInfo{}, commit.Votes...)}
+	tampered.Votes[1].VoteExtension = binary.BigEndian.AppendUint64(nil, 200)
+	encoded, _ := tampered.Marshal()
+	if processProposal(append([][]byte{append(append([]byte{}, agreedHeightTxPrefix...), encoded...)}, proposal.Txs[1:]...), lastCommit) != abcitypes.ResponseProcessProposal_REJECT {
+		t.Fatal("proposal with a tampered vote extension was accepted")
+	}
+
+	// A height this node's tracker has not reached is neither proposed nor accepted, so FinalizeBlock doesn't wait for it.
+	ahead := abcitypes.ExtendedCommitInfo{Votes: []abcitypes.ExtendedVoteInfo{
+		signedHeightVote(validators[0], 10, 300, 1),
+		signedHeightVote(validators[1], 10, 300, 1),
+		signedHeightVote(validators[2], 10, 300, 1),
+	}}
+	aheadProposal, err := app.PrepareProposal(ctx, &abcitypes.RequestPrepareProposal{Height: 2, MaxTxBytes: 1 << 20, LocalLastCommit: ahead})
+	if err != nil || len(aheadProposal.Txs) != 0 {
+		t.Fatalf("proposed %d transactions for a height the tracker has not reached, %v", len(aheadProposal.Txs), err)
+	}
+	encoded, _ = ahead.Marshal()
+	if processProposal([][]byte{append(append([]byte{}, agreedHeightTxPrefix...), encoded...)}, lastCommit) != abcitypes.ResponseProcessProposal_REJECT {
+		t.Fatal("proposal with a height the tracker has not reached was accepted")
+	}
+
+	block, err := app.FinalizeBlock(ctx, &abcitypes.RequestFinalizeBlock{Height: 2, Txs: proposal.Txs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trackerobj.AgreedHeight() != 150 {
+		t.Fatalf("tracker agreed height %d, want 150", trackerobj.AgreedHeight())
+	}
+	wantCodes := []uint32{abcitypes.CodeTypeOK, abcitypes.CodeTypeOK, CodeUnauthorisedJoin}
+	for i, want := range wantCodes {
+		if block.TxResults[i].Code != want {
+			t.Errorf("tx %d has code %d, want %d: %s", i, block.TxResults[i].Code, want, block.TxResults[i].Log)
+		}
+	}
+
+	// The validator keys survive a restart, so extensions can still be verified.
+	restarted := NewAuthorisedApplication(&passThroughApp{height: 2}, trackerobj, nil).WithStateStore(app.stateStore).EnableHeightAgreement()
+	if _, err := restarted.Info(ctx, &abcitypes.RequestInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.verifyAgreedHeightCommit(commit, lastCommit, 1); err != nil {
+		t.Errorf("extensions not verified after a restart: %v", err)
+	}
+}
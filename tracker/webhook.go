@@ -0,0 +1,369 @@
+package validatorpass_tracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WEBHOOKS
+
+const (
+	webhookQueuePrefix = "webhook/"         // Store keys of deliveries waiting to be sent
+	webhookHeightKey   = "webhook-height"   // Store key of the height up to which changes have been queued
+	webhookSequenceKey = "webhook-sequence" // Store key of the sequence number of the first change queued at that height
+)
+
+// Header carrying the delivery's signature, see VerifyWebhookSignature.
+const WebhookSignatureHeader = "X-Webhook-Signature"
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// A URL that is sent every committed change, signed with a shared secret.
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// The JSON body POSTed to webhooks, one per change.
+type WebhookPayload struct {
+	Id              string          `json:"id"`       // The same for every attempt, receivers can use it to drop duplicates
+	Sequence        uint64          `json:"sequence"` // Increases with every change sent, receivers can use it to apply changes in order
+	ContractAddress string          `json:"contractAddress"`
+	EventSignature  string          `json:"eventSignature"`
+	Change          ValidatorChange `json:"change"`
+}
+
+// A payload waiting to be sent to a webhook, as kept in the store.
+type webhookDelivery struct {
+	Queued      time.Time `json:"queued"`
+	Sequence    uint64    `json:"sequence"` // Deliveries to a webhook are attempted in sequence order
+	URL         string    `json:"url"`
+	Body        string    `json:"body"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// Sends a tracker's changes to webhooks. Deliveries are queued in a store before they are sent and retried with
+// exponential backoff until a webhook answers with a 2xx status, so they survive restarts and webhook outages.
+// Delivery is at least once: a change can be sent again after a restart, with the same payload id.
+type Notifier struct {
+	Client      *http.Client
+	MinBackoff  time.Duration // Delay before the first retry, doubled on every failed attempt
+	MaxBackoff  time.Duration
+	MaxAttempts int // Deliveries are dropped after this many failed attempts, 0 to retry forever
+
+	tracker        *Tracker
+	store          Store
+	webhooks       map[string]Webhook // By URL
+	queue          map[string]*webhookDelivery
+	sequence       uint64 // Sequence number of the next change
+	height         int64  // Height of the last change queued
+	heightSequence uint64 // Sequence number of the first change queued at height
+}
+
+// Create a notifier sending the tracker's changes to webhooks, queueing deliveries in a store.
+func NewNotifier(trackerIns *Tracker, store Store, webhooks []Webhook) *Notifier {
+	notifier := &Notifier{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MinBackoff:  time.Second,
+		MaxBackoff:  10 * time.Minute,
+		MaxAttempts: 50,
+		tracker:     trackerIns,
+		store:       store,
+		webhooks:    map[string]Webhook{},
+		queue:       map[string]*webhookDelivery{},
+	}
+	for _, webhook := range webhooks {
+		notifier.webhooks[webhook.URL] = webhook
+	}
+	return notifier
+}
+
+// Send changes until the context is cancelled. Deliveries left in the store by an earlier run are sent first, then
+// changes committed after the last queued one, or after the tracker's current height on the first run.
+func (notifier *Notifier) Run(ctx context.Context) error {
+	fromHeight, err := notifier.load()
+	if err != nil {
+		return err
+	}
+	// The changes committed since the last run are queued before any delivery is attempted, so deliveries
+	// that are still queued are not sent twice.
+	sub := notifier.tracker.subscribe(fromHeight)
+	defer notifier.tracker.unsubscribe(sub)
+	for _, change := range sub.take() {
+		notifier.enqueue(change)
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sub.notify:
+			for _, change := range sub.take() {
+				notifier.enqueue(change)
+			}
+		case <-timer.C:
+			notifier.deliverDue(ctx)
+		}
+		timer.Reset(notifier.untilNextAttempt())
+	}
+}
+
+// Read the queue left by an earlier run, and the height to resume the change stream from.
+func (notifier *Notifier) load() (int64, error) {
+	keys, err := notifier.store.Keys(webhookQueuePrefix)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		encoded, err := notifier.store.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		delivery := &webhookDelivery{}
+		if err := json.Unmarshal(encoded, delivery); err != nil {
+			return 0, fmt.Errorf("invalid webhook delivery %s: %w", key, err)
+		}
+		notifier.queue[key] = delivery
+	}
+	encoded, err := notifier.store.Get(webhookHeightKey)
+	if errors.Is(err, ErrNotFound) {
+		return notifier.tracker.FinalizedHeight(), nil // Don't announce the whole history on the first run.
+	} else if err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseInt(string(encoded), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s in store: %w", webhookHeightKey, err)
+	}
+	if encoded, err = notifier.store.Get(webhookSequenceKey); err != nil && !errors.Is(err, ErrNotFound) {
+		return 0, err
+	} else if err == nil {
+		if notifier.sequence, err = strconv.ParseUint(string(encoded), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid %s in store: %w", webhookSequenceKey, err)
+		}
+	}
+	// Changes at the last queued height may not all have been queued, queue that height again. They are numbered
+	// from the same sequence number as before, so changes that were queued keep their ids.
+	notifier.height, notifier.heightSequence = height, notifier.sequence
+	return height - 1, nil
+}
+
+// Queue a change for every webhook. Every change gets the next sequence number, which its payload id is derived from:
+// a redeem that is rolled back by a reorg and included again at the same height is a new change with a new id.
+func (notifier *Notifier) enqueue(change ValidatorChange) {
+	if change.Height != notifier.height {
+		notifier.height, notifier.heightSequence = change.Height, notifier.sequence
+	}
+	sequence := notifier.sequence
+	notifier.sequence++
+	for url := range notifier.webhooks {
+		digest := sha256.Sum256([]byte(url + "\x00" + notifier.tracker.trackedEvent.contractAddress + "\x00" + strconv.FormatUint(sequence, 10)))
+		payload := WebhookPayload{
+			Id:              hex.EncodeToString(digest[:16]),
+			Sequence:        sequence,
+			ContractAddress: notifier.tracker.trackedEvent.contractAddress,
+			EventSignature:  notifier.tracker.trackedEvent.EventSignature,
+			Change:          change,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			notifier.logger().Error("Could not encode webhook payload", "err", err)
+			continue
+		}
+		key := webhookQueuePrefix + payload.Id
+		if _, queued := notifier.queue[key]; queued {
+			continue // Queued again after a restart, keep the attempts made so far.
+		}
+		delivery := &webhookDelivery{Queued: time.Now(), Sequence: sequence, URL: url, Body: string(body), NextAttempt: time.Now()}
+		if err := notifier.save(key, delivery); err != nil {
+			notifier.logger().Warn("Could not save webhook delivery, it will be lost on restart", "url", url, "err", err)
+		}
+		notifier.queue[key] = delivery
+	}
+	if err := notifier.store.Put(webhookSequenceKey, []byte(strconv.FormatUint(notifier.heightSequence, 10))); err != nil {
+		notifier.logger().Warn("Could not save webhook sequence", "err", err)
+	}
+	if err := notifier.store.Put(webhookHeightKey, []byte(strconv.FormatInt(change.Height, 10))); err != nil {
+		notifier.logger().Warn("Could not save webhook height", "err", err)
+	}
+}
+
+// Deliveries are logged with the tracker's logger, see SetLogger.
+func (notifier *Notifier) logger() *slog.Logger {
+	return notifier.tracker.logger.With("component", "webhook")
+}
+
+func (notifier *Notifier) save(key string, delivery *webhookDelivery) error {
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return notifier.store.Put(key, encoded)
+}
+
+// Attempt every delivery that is due, removing it from the queue once it succeeds or runs out of attempts.
+// Webhooks are sent to concurrently, so a slow or unreachable webhook doesn't hold up the others. Each webhook's
+// deliveries are sent in sequence order, and the pass stops for a webhook at its first failure: one
+// request timeout at most, with the webhook's later deliveries retried after the failed one.
+func (notifier *Notifier) deliverDue(ctx context.Context) {
+	now := time.Now()
+	due := map[string][]string{} // Keys by URL
+	for key, delivery := range notifier.queue {
+		if delivery.NextAttempt.After(now) {
+			continue
+		}
+		if _, configured := notifier.webhooks[delivery.URL]; !configured {
+			notifier.remove(key) // Queued for a webhook that has since been removed from the config.
+			continue
+		}
+		due[delivery.URL] = append(due[delivery.URL], key)
+	}
+	urls := sortedKeys(due)
+	sent := make([]int, len(urls))     // Deliveries sent to each webhook, in order
+	failed := make([]error, len(urls)) // Why the next delivery to each webhook failed, if it did
+	wg := sync.WaitGroup{}
+	for i, url := range urls {
+		keys := due[url]
+		// A whole batch of changes is queued at the same instant, the sequence numbers give their order.
+		sort.SliceStable(keys, func(a, b int) bool {
+			return notifier.queue[keys[a]].Sequence < notifier.queue[keys[b]].Sequence
+		})
+		bodies := make([][]byte, len(keys))
+		for j, key := range keys {
+			bodies[j] = []byte(notifier.queue[key].Body)
+		}
+		wg.Add(1)
+		go func(i int, webhook Webhook) {
+			defer wg.Done()
+			for _, body := range bodies {
+				if failed[i] = notifier.send(ctx, webhook, body); failed[i] != nil {
+					return
+				}
+				sent[i]++
+			}
+		}(i, notifier.webhooks[url])
+	}
+	wg.Wait()
+
+	for i, url := range urls {
+		keys := due[url]
+		for _, key := range keys[:sent[i]] {
+			notifier.remove(key)
+		}
+		if failed[i] == nil || ctx.Err() != nil {
+			continue // Shutting down, the failed delivery stays queued as it was.
+		}
+		key, delivery := keys[sent[i]], notifier.queue[keys[sent[i]]]
+		delivery.Attempts++
+		if notifier.MaxAttempts > 0 && delivery.Attempts >= notifier.MaxAttempts {
+			notifier.logger().Error("Dropping webhook delivery", "url", url, "attempts", delivery.Attempts, "err", failed[i])
+			notifier.remove(key)
+			continue
+		}
+		delivery.NextAttempt = now.Add(notifier.backoff(delivery.Attempts))
+		notifier.logger().Warn("Webhook delivery failed", "url", url, "attempts", delivery.Attempts, "retryAt", delivery.NextAttempt, "err", failed[i])
+		for _, key := range keys[sent[i]:] {
+			notifier.queue[key].NextAttempt = delivery.NextAttempt
+			if err := notifier.save(key, notifier.queue[key]); err != nil {
+				notifier.logger().Warn("Could not save webhook delivery", "url", url, "err", err)
+			}
+		}
+	}
+}
+
+func (notifier *Notifier) remove(key string) {
+	delete(notifier.queue, key)
+	if err := notifier.store.Delete(key); err != nil {
+		notifier.logger().Warn("Could not remove webhook delivery", "key", key, "err", err)
+	}
+}
+
+func (notifier *Notifier) backoff(attempts int) time.Duration {
+	backoff := notifier.MinBackoff
+	for i := 1; i < attempts && backoff < notifier.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, notifier.MaxBackoff)
+}
+
+// Time until the earliest queued delivery is due, an hour if the queue is empty.
+func (notifier *Notifier) untilNextAttempt() time.Duration {
+	next := time.Hour
+	for _, delivery := range notifier.queue {
+		next = min(next, time.Until(delivery.NextAttempt))
+	}
+	return max(next, 0)
+}
+
+func (notifier *Notifier) send(ctx context.Context, webhook Webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, time.Now(), body))
+	res, err := notifier.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+// Signature header for a webhook body: "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>" keyed by the secret>".
+// The time is part of the signature so receivers can reject old deliveries being replayed.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + unix + ",v1=" + webhookMac(secret, unix, body)
+}
+
+func webhookMac(secret string, unix string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unix + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a webhook delivery's signature header, for receivers. Deliveries signed more than tolerance ago are rejected,
+// a tolerance of 0 accepts any age.
+func VerifyWebhookSignature(secret string, header string, body []byte, tolerance time.Duration) error {
+	unix, signature := "", ""
+	for _, field := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "t":
+			unix = value
+		case "v1":
+			signature = value
+		}
+	}
+	signedAt, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || signature == "" {
+		return fmt.Errorf("%w: malformed header %q", ErrInvalidSignature, header)
+	}
+	if !hmac.Equal([]byte(signature), []byte(webhookMac(secret, unix, body))) {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(signedAt, 0)) > tolerance {
+		return fmt.Errorf("%w: signed at %s", ErrInvalidSignature, time.Unix(signedAt, 0).Format(time.RFC3339))
+	}
+	return nil
+}
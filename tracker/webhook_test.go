@@ -0,0 +1,245 @@
+package validatorpass_tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook receiver that fails its first requests.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	payloads []WebhookPayload
+	invalid  int
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if err := VerifyWebhookSignature("secret", r.Header.Get(WebhookSignatureHeader), body, time.Minute); err != nil {
+		receiver.invalid++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if receiver.failures > 0 {
+		receiver.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	payload := WebhookPayload{}
+	json.Unmarshal(body, &payload)
+	receiver.payloads = append(receiver.payloads, payload)
+}
+
+func (receiver *webhookReceiver) received() []WebhookPayload {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]WebhookPayload{}, receiver.payloads...)
+}
+
+func pendingDeliveries(store Store) int {
+	keys, _ := store.Keys(webhookQueuePrefix)
+	return len(keys)
+}
+
+func subscriberCount(trackerobj *Tracker) int {
+	trackerobj.mu.RLock()
+	defer trackerobj.mu.RUnlock()
+	return len(trackerobj.subscribers)
+}
+
+func TestNotifier(t *testing.T) {
+	receiver := &webhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	store := NewMemoryStore()
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	events := stateHashEvents()
+	trackerobj.ingestRedeem(events[0])
+	trackerobj.setFinalizedHeight(0x10, "")
+
+	run := func() (context.CancelFunc, chan struct{}) {
+		notifier := NewNotifier(trackerobj, store, []Webhook{{URL: server.URL, Secret: "secret"}})
+		notifier.MinBackoff, notifier.MaxBackoff, notifier.MaxAttempts = 10*time.Millisecond, 20*time.Millisecond, 0
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			if err := notifier.Run(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+		return cancel, stopped
+	}
+	cancel, stopped := run()
+	waitUntil(t, func() bool { return subscriberCount(trackerobj) == 1 })
+
+	// The first run only announces changes committed after it started, and retries failed deliveries.
+	trackerobj.ingestRedeem(events[1])
+	trackerobj.setFinalizedHeight(0x12, "")
+	waitUntil(t, func() bool { return len(receiver.received()) == 1 })
+	payload := receiver.received()[0]
+	if payload.Change.Kind != ChangeAdded || payload.Change.Height != 0x11 || payload.ContractAddress != contractAddress || payload.Id == "" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+	waitUntil(t, func() bool { return pendingDeliveries(store) == 0 })
+	cancel()
+	<-stopped
+
+	// Deliveries queued while the webhook is down are kept in the store and sent by the next run. A restart queues
+	// the changes at the last queued height again, so the change at 0x11 is sent again with the same id.
+	receiver.mu.Lock()
+	receiver.failures = 1000
+	receiver.mu.Unlock()
+	cancel, stopped = run()
+	trackerobj.ingestRedeem(events[2])
+	trackerobj.setFinalizedHeight(0x20, "")
+	waitUntil(t, func() bool { return pendingDeliveries(store) == 2 })
+	cancel()
+	<-stopped
+	receiver.mu.Lock()
+	receiver.failures = 0
+	receiver.mu.Unlock()
+	cancel, stopped = run()
+	defer func() { cancel(); <-stopped }()
+	reRedeemed := func() bool {
+		for _, received := range receiver.received() {
+			if received.Change.Kind == ChangeReRedeemed && received.Change.Height == 0x14 {
+				return true
+			}
+		}
+		return false
+	}
+	waitUntil(t, func() bool { return pendingDeliveries(store) == 0 && reRedeemed() })
+	ids := map[string]int{}
+	for _, received := range receiver.received() {
+		ids[received.Id]++
+	}
+	if len(ids) != 2 || ids[payload.Id] < 2 {
+		t.Errorf("deliveries by id %v, want the change at 0x11 redelivered with id %s", ids, payload.Id)
+	}
+	if receiver.invalid != 0 {
+		t.Error("deliveries with invalid signatures")
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	header := SignWebhook("secret", time.Now(), body)
+	if err := VerifyWebhookSignature("secret", header, body, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyWebhookSignature("other", header, body, time.Minute); err == nil {
+		t.Error("signature verified with the wrong secret")
+	}
+	if err := VerifyWebhookSignature("secret", header, []byte(`{"id":"2"}`), time.Minute); err == nil {
+		t.Error("signature verified for a different body")
+	}
+	old := SignWebhook("secret", time.Now().Add(-time.Hour), body)
+	if err := VerifyWebhookSignature("secret", old, body, time.Minute); err == nil {
+		t.Error("old signature accepted")
+	}
+	if err := VerifyWebhookSignature("secret", "v1=abc", body, 0); err == nil {
+		t.Error("header without a timestamp accepted")
+	}
+}
+
+func TestNotifierIdsAcrossRollback(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	trackerobj.setFinalizedHeight(0x0f, "")
+	notifier := NewNotifier(trackerobj, NewMemoryStore(), []Webhook{{URL: server.URL, Secret: "secret"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() { defer close(stopped); notifier.Run(ctx) }()
+	defer func() { cancel(); <-stopped }()
+	waitUntil(t, func() bool { return subscriberCount(trackerobj) == 1 })
+
+	// The redeem is rolled back by a reorg and included again at the same height: added, removed, added.
+	event := stateHashEvents()[0]
+	trackerobj.ingestRedeem(event)
+	trackerobj.setFinalizedHeight(0x10, "")
+	waitUntil(t, func() bool { return len(receiver.received()) == 1 })
+	trackerobj.RollbackTo(0x0f)
+	waitUntil(t, func() bool { return len(receiver.received()) == 2 })
+	trackerobj.ingestRedeem(event)
+	trackerobj.setFinalizedHeight(0x10, "")
+	waitUntil(t, func() bool { return len(receiver.received()) == 3 })
+
+	received := receiver.received()
+	if received[0].Change.Kind != ChangeAdded || received[1].Change.Kind != ChangeRemoved || received[2].Change.Kind != ChangeAdded {
+		t.Fatalf("received %v, %v, %v", received[0].Change.Kind, received[1].Change.Kind, received[2].Change.Kind)
+	}
+	// Receivers dropping duplicates by id must not drop the re-added redeem.
+	if received[0].Id == received[2].Id || received[0].Sequence >= received[1].Sequence || received[1].Sequence >= received[2].Sequence {
+		t.Errorf("re-added redeem sent as id %s sequence %d after id %s sequence %d", received[2].Id, received[2].Sequence, received[0].Id, received[0].Sequence)
+	}
+}
+
+func TestNotifierDeliversConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer stuck.Close()
+	defer close(release)
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	trackerobj.setFinalizedHeight(0x0f, "")
+	notifier := NewNotifier(trackerobj, NewMemoryStore(), []Webhook{{URL: stuck.URL, Secret: "secret"}, {URL: server.URL, Secret: "secret"}})
+	notifier.Client.Timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() { defer close(stopped); notifier.Run(ctx) }()
+	defer func() { cancel(); <-stopped }()
+	waitUntil(t, func() bool { return subscriberCount(trackerobj) == 1 })
+
+	// The healthy webhook receives the change while the other one hangs.
+	trackerobj.ingestRedeem(stateHashEvents()[0])
+	trackerobj.setFinalizedHeight(0x10, "")
+	waitUntil(t, func() bool { return len(receiver.received()) == 1 })
+}
+
+func TestNotifierDeliversInSequenceOrder(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	trackerobj := NewTracker(rpcSource, 4, RedeemEvent)
+	notifier := NewNotifier(trackerobj, NewMemoryStore(), []Webhook{{URL: server.URL, Secret: "secret"}})
+
+	// A block's changes are queued together and can share a timestamp.
+	queued := time.Now()
+	for i := 0; i < 20; i++ {
+		notifier.enqueue(ValidatorChange{Kind: ChangeAdded, TokenId: fmt.Sprintf("0x%02x", i), Height: 0x10})
+	}
+	for _, delivery := range notifier.queue {
+		delivery.Queued = queued
+	}
+	notifier.deliverDue(context.Background())
+
+	received := receiver.received()
+	if len(received) != 20 {
+		t.Fatalf("received %d changes, want 20", len(received))
+	}
+	for i, payload := range received {
+		if payload.Sequence != uint64(i) {
+			t.Fatalf("change %d received with sequence %d", i, payload.Sequence)
+		}
+	}
+}